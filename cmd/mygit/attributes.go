@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Minimal gitattributes support: enough to decide how end-of-line
+// conversion should be applied when a file is hashed into a blob.
+// reference: https://git-scm.com/docs/gitattributes
+
+type attrRule struct {
+	pattern string
+	attrs   []attrAssignment
+}
+
+type attrAssignment struct {
+	name  string
+	value string // "true" (set), "false" (unset), "" (unspecified) or a value
+}
+
+// built-in macro, can be extended by "[attr]" lines on top level files
+var defaultAttrMacros = map[string][]attrAssignment{
+	"binary": {{"diff", "false"}, {"merge", "false"}, {"text", "false"}},
+}
+
+// lookupAttributes returns the attributes that apply to a path of the
+// working tree. Files closer to the path take precedence over the top level
+// .gitattributes, and .git/info/attributes overrides all. Paths outside the
+// working tree have no attributes.
+func lookupAttributes(name string) map[string]string {
+	result := map[string]string{}
+	root := filepath.Dir(gitDir)
+	name, ok := worktreePath(root, name)
+	if !ok {
+		return result
+	}
+	macros := map[string][]attrAssignment{}
+	for k, v := range defaultAttrMacros {
+		macros[k] = v
+	}
+
+	apply := func(rules []attrRule, base string) {
+		relative := strings.TrimPrefix(name, base)
+		for _, rule := range rules {
+			if !matchAttrPattern(rule.pattern, relative) {
+				continue
+			}
+			for _, a := range rule.attrs {
+				assignAttribute(result, macros, a)
+			}
+		}
+	}
+
+	apply(readAttributesFile(filepath.Join(root, ".gitattributes"), macros, true), "")
+	if dir := path.Dir(name); dir != "." {
+		dirs := strings.Split(dir, "/")
+		for i := range dirs {
+			base := strings.Join(dirs[:i+1], "/")
+			apply(readAttributesFile(filepath.Join(root, filepath.FromSlash(base), ".gitattributes"), macros, false), base+"/")
+		}
+	}
+	apply(readAttributesFile(filepath.Join(gitDir, "info", "attributes"), macros, true), "")
+
+	return result
+}
+
+// worktreePath returns the path of a file relative to the root of the
+// working tree, with slashes, or false if it's outside of it.
+func worktreePath(root, name string) (string, bool) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", false
+	}
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return "", false
+	}
+	relative, err := filepath.Rel(absRoot, absName)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(relative), true
+}
+
+func assignAttribute(result map[string]string, macros map[string][]attrAssignment, a attrAssignment) {
+	if expansion, ok := macros[a.name]; ok && a.value == "true" {
+		for _, e := range expansion {
+			assignAttribute(result, macros, e)
+		}
+	}
+	if a.value == "" {
+		delete(result, a.name)
+	} else {
+		result[a.name] = a.value
+	}
+}
+
+func readAttributesFile(filename string, macros map[string][]attrAssignment, allowMacros bool) []attrRule {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	rules := []attrRule{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		pattern, assignments := fields[0], []attrAssignment{}
+		for _, field := range fields[1:] {
+			switch {
+			case field[0] == '-':
+				assignments = append(assignments, attrAssignment{field[1:], "false"})
+			case field[0] == '!':
+				assignments = append(assignments, attrAssignment{field[1:], ""})
+			case strings.Contains(field, "="):
+				key, value, _ := strings.Cut(field, "=")
+				assignments = append(assignments, attrAssignment{key, value})
+			default:
+				assignments = append(assignments, attrAssignment{field, "true"})
+			}
+		}
+		if strings.HasPrefix(pattern, "[attr]") {
+			if allowMacros {
+				macros[pattern[len("[attr]"):]] = assignments
+			}
+			continue
+		}
+		if pattern[0] == '!' || strings.HasSuffix(pattern, "/") {
+			// negative and directory patterns are not allowed in attributes
+			continue
+		}
+		rules = append(rules, attrRule{pattern, assignments})
+	}
+	return rules
+}
+
+// matchAttrPattern matches patterns without a slash against the base name,
+// other patterns against the full relative path (supporting "**").
+func matchAttrPattern(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	return matchPathSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchPathSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchPathSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// convertToGit applies the "clean" side of end-of-line conversion based on
+// the "text" and "eol" attributes of the path: CRLF is normalized to LF
+// when the file is text (either explicitly or detected with text=auto).
+func convertToGit(name string, content []byte) []byte {
+	attrs := lookupAttributes(name)
+
+	text, hasText := attrs["text"]
+	_, hasEol := attrs["eol"]
+	if !hasText {
+		// legacy attribute
+		text, hasText = attrs["crlf"]
+	}
+
+	switch {
+	case hasText && text == "false":
+		return content
+	case hasText && text == "auto":
+		if isBinaryContent(content) {
+			return content
+		}
+	case hasText && text == "true":
+	case hasEol:
+	default:
+		return content
+	}
+
+	if !bytes.Contains(content, []byte("\r\n")) {
+		return content
+	}
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+}
+
+// isBinaryContent mimics git's heuristic: any NUL, any lone CR or too many
+// non-printable characters make the content binary.
+func isBinaryContent(content []byte) bool {
+	printable, nonPrintable := 0, 0
+	for i, c := range content {
+		switch {
+		case c == 0:
+			return true
+		case c == '\r':
+			if i+1 >= len(content) || content[i+1] != '\n' {
+				return true
+			}
+		case c == '\n':
+		case c == 127:
+			nonPrintable++
+		case c < 32:
+			switch c {
+			case '\b', '\t', '\033', '\014':
+				printable++
+			case 032: // DOS EOF at the end of the file is ignored
+				if i != len(content)-1 {
+					nonPrintable++
+				}
+			default:
+				nonPrintable++
+			}
+		default:
+			printable++
+		}
+	}
+	return (printable >> 7) < nonPrintable
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Reading of git configuration files: the global ones (~/.gitconfig and
+// $XDG_CONFIG_HOME/git/config) and then the repository's .git/config, so
+// values from the repository take precedence.
+// reference: https://git-scm.com/docs/git-config#_configuration_file
+
+func configFiles() []string {
+	files := []string{}
+	home, _ := os.UserHomeDir()
+	xdgHome := os.Getenv("XDG_CONFIG_HOME")
+	if xdgHome == "" && home != "" {
+		xdgHome = filepath.Join(home, ".config")
+	}
+	if xdgHome != "" {
+		files = append(files, filepath.Join(xdgHome, "git", "config"))
+	}
+	if home != "" {
+		files = append(files, filepath.Join(home, ".gitconfig"))
+	}
+	return append(files, filepath.Join(gitDir, "config"))
+}
+
+// loadConfig returns all config values by key ("section.subsection.name",
+// with section and name in lowercase), in the order they were read.
+func loadConfig() map[string][]string {
+	config := map[string][]string{}
+	for _, file := range configFiles() {
+		parseConfigFile(file, func(key, value string) {
+			config[key] = append(config[key], value)
+		})
+	}
+	return config
+}
+
+// getConfig returns the last value set for a key.
+func getConfig(key string) (string, bool) {
+	values := loadConfig()[canonicalConfigKey(key)]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// getConfigAll returns all the values of a multi-valued key.
+func getConfigAll(key string) []string {
+	return loadConfig()[canonicalConfigKey(key)]
+}
+
+func getConfigBool(key string, defaultValue bool) bool {
+	value, ok := getConfig(key)
+	if !ok {
+		return defaultValue
+	}
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1", "":
+		return true
+	case "false", "no", "off", "0":
+		return false
+	}
+	fatal("fatal: bad boolean config value '%s' for '%s'\n", value, key)
+	return false
+}
+
+func getConfigInt(key string, defaultValue int) int {
+	value, ok := getConfig(key)
+	if !ok || value == "" {
+		return defaultValue
+	}
+	multiplier := 1
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		fatal("fatal: bad numeric config value '%s' for '%s'\n", value, key)
+	}
+	return number * multiplier
+}
+
+// canonicalConfigKey lowercases the section and name of a key, keeping the
+// subsection (e.g. a remote or branch name) as is.
+func canonicalConfigKey(key string) string {
+	first := strings.IndexByte(key, '.')
+	last := strings.LastIndexByte(key, '.')
+	if first < 0 {
+		return strings.ToLower(key)
+	}
+	return strings.ToLower(key[:first]) + key[first:last] + strings.ToLower(key[last:])
+}
+
+func parseConfigFile(filename string, setValue func(key, value string)) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// continuation lines
+		for strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") && scanner.Scan() {
+			line = line[:len(line)-1] + scanner.Text()
+		}
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			var ok bool
+			if section, line, ok = parseSectionHeader(line); !ok {
+				fatal("fatal: bad config line in file %s: %s\n", filename, line)
+			}
+			// a key/value pair can follow the header on the same line
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+		}
+
+		name, value, hasValue := strings.Cut(line, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if hasValue {
+			value = parseConfigValue(value)
+		}
+		setValue(section+"."+name, value)
+	}
+}
+
+// parseSectionHeader returns the section of a "[section "subsection"]"
+// line, as used in keys, and whatever follows the header.
+func parseSectionHeader(line string) (string, string, bool) {
+	end := strings.LastIndexByte(line, ']')
+	if end < 0 {
+		return "", line, false
+	}
+	var section string
+	name, subsection, hasSubsection := strings.Cut(line[1:end], " ")
+	if hasSubsection {
+		subsection = strings.TrimSpace(subsection)
+		if unquoted, err := strconv.Unquote(subsection); err == nil {
+			subsection = unquoted
+		}
+		section = strings.ToLower(name) + "." + subsection
+	} else {
+		// also covers the deprecated [section.subsection] syntax
+		section = strings.ToLower(name)
+	}
+	return section, strings.TrimSpace(line[end+1:]), true
+}
+
+// parseConfigValue handles quotes, escapes and trailing comments.
+func parseConfigValue(raw string) string {
+	var value strings.Builder
+	inQuotes := false
+	pendingSpace := ""
+	raw = strings.TrimSpace(raw)
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '\\' && i+1 < len(raw):
+			i++
+			value.WriteString(pendingSpace)
+			pendingSpace = ""
+			switch raw[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'b':
+				value.WriteByte('\b')
+			default:
+				value.WriteByte(raw[i])
+			}
+		case !inQuotes && (c == '#' || c == ';'):
+			return value.String()
+		case !inQuotes && (c == ' ' || c == '\t'):
+			pendingSpace += string(c)
+		default:
+			value.WriteString(pendingSpace)
+			pendingSpace = ""
+			value.WriteByte(c)
+		}
+	}
+	return value.String()
+}
+
+// setConfig sets a key in the repository's .git/config, replacing all of
+// its current values.
+func setConfig(key, value string) {
+	writeConfig(key, value, true)
+}
+
+// addConfig adds a value to a multi-valued key in .git/config.
+func addConfig(key, value string) {
+	writeConfig(key, value, false)
+}
+
+// writeConfig rewrites .git/config with the new value at the end of the
+// key's section, adding the section if needed. Comments and formatting of
+// the other lines are kept.
+func writeConfig(key, value string, replace bool) {
+	key = canonicalConfigKey(key)
+	dot := strings.LastIndexByte(key, '.')
+	if dot <= 0 {
+		fatal("error: key does not contain a section: %s\n", key)
+	}
+	section, name := key[:dot], key[dot+1:]
+	entry := "\t" + name + " = " + quoteConfigValue(value)
+
+	path := filepath.Join(gitDir, "config")
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		fatal(err.Error())
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	result := []string{}
+	current := ""
+	insertAt := -1 // after the last line of the section
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			current, _, _ = parseSectionHeader(trimmed)
+		} else if current == section && replace {
+			lineName, _, _ := strings.Cut(trimmed, "=")
+			if strings.ToLower(strings.TrimSpace(lineName)) == name {
+				continue
+			}
+		}
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		result = append(result, line)
+		if current == section && trimmed != "" {
+			insertAt = len(result)
+		}
+	}
+
+	if insertAt < 0 {
+		sectionName, subsection, hasSubsection := strings.Cut(section, ".")
+		if hasSubsection {
+			result = append(result, fmt.Sprintf("[%s %s]\n", sectionName, strconv.Quote(subsection)))
+		} else {
+			result = append(result, "["+sectionName+"]\n")
+		}
+		insertAt = len(result)
+	}
+	result = append(result[:insertAt], append([]string{entry + "\n"}, result[insertAt:]...)...)
+	writeFileAtomic(path, []byte(strings.Join(result, "")))
+}
+
+// quoteConfigValue quotes and escapes a value so it's read back as is.
+func quoteConfigValue(value string) string {
+	var quoted strings.Builder
+	for _, c := range value {
+		switch c {
+		case '"', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteRune(c)
+		case '\n':
+			quoted.WriteString("\\n")
+		case '\t':
+			quoted.WriteString("\\t")
+		default:
+			quoted.WriteRune(c)
+		}
+	}
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;") {
+		return "\"" + quoted.String() + "\""
+	}
+	return quoted.String()
+}
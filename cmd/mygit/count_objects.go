@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func gitCountObjects() {
+	usage := "count-objects [-v] [-H | --human-readable]"
+
+	var verbose, human bool
+	for _, arg := range os.Args[2:] {
+		switch {
+		case arg == "--verbose":
+			verbose = true
+		case arg == "--human-readable":
+			human = true
+		case len(arg) > 1 && arg[0] == '-' && arg[1] != '-':
+			// short options, possibly combined (e.g. "-vH")
+			for _, c := range arg[1:] {
+				switch c {
+				case 'v':
+					verbose = true
+				case 'H':
+					human = true
+				default:
+					printUsageAndExit(usage)
+				}
+			}
+		default:
+			printUsageAndExit(usage)
+		}
+	}
+
+	formatSize := func(bytes int64) string {
+		if human {
+			return humanizeBytes(bytes)
+		}
+		return fmt.Sprint(bytes / 1024)
+	}
+
+	var looseCount, looseSize, garbageCount, garbageSize int64
+	reportGarbage := func(message, path string, size int64) {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "warning: %s: %s\n", message, path)
+		}
+		garbageCount++
+		garbageSize += size
+	}
+
+	objectsDir := filepath.Join(gitDir, "objects")
+	dirs, _ := os.ReadDir(objectsDir)
+	for _, dir := range dirs {
+		if len(dir.Name()) != 2 || !dir.IsDir() || !isHexString(dir.Name()) {
+			continue
+		}
+		entries, _ := os.ReadDir(filepath.Join(objectsDir, dir.Name()))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			if len(entry.Name()) == 38 && isHexString(entry.Name()) {
+				looseCount++
+				looseSize += diskUsage(info)
+			} else {
+				reportGarbage("garbage found", filepath.Join(objectsDir, dir.Name(), entry.Name()), diskUsage(info))
+			}
+		}
+	}
+
+	if !verbose {
+		if human {
+			fmt.Printf("%d objects, %s\n", looseCount, humanizeBytes(looseSize))
+		} else {
+			fmt.Printf("%d objects, %d kilobytes\n", looseCount, looseSize/1024)
+		}
+		return
+	}
+
+	// unlike loose objects, packs count their file size and not disk usage
+	var packCount, inPack, packSize int64
+	for _, pack := range getPacks() {
+		packCount++
+		inPack += int64(pack.index.count())
+		for _, ext := range []string{".pack", ".idx"} {
+			if info, err := os.Stat(strings.TrimSuffix(pack.path, ".pack") + ext); err == nil {
+				packSize += info.Size()
+			}
+		}
+	}
+
+	// anything in the pack directory that isn't part of a valid pack
+	packDir := filepath.Join(objectsDir, "pack")
+	entries, _ := os.ReadDir(packDir)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		path := filepath.Join(packDir, name)
+		base, ext := strings.TrimSuffix(name, filepath.Ext(name)), filepath.Ext(name)
+		switch {
+		case !strings.HasPrefix(name, "pack-"):
+			reportGarbage("garbage found", path, diskUsage(info))
+		case ext == ".pack" && !fileExists(filepath.Join(packDir, base+".idx")):
+			reportGarbage("no corresponding .idx", path, diskUsage(info))
+		case ext == ".idx" && !fileExists(filepath.Join(packDir, base+".pack")):
+			reportGarbage("no corresponding .pack", path, diskUsage(info))
+		case ext == ".pack" || ext == ".idx":
+		case ext == ".keep" || ext == ".bitmap" || ext == ".rev" || ext == ".promisor" || ext == ".mtimes":
+			if !fileExists(filepath.Join(packDir, base+".pack")) {
+				reportGarbage("garbage found", path, diskUsage(info))
+			}
+		default:
+			reportGarbage("garbage found", path, diskUsage(info))
+		}
+	}
+
+	fmt.Printf("count: %d\n", looseCount)
+	fmt.Printf("size: %s\n", formatSize(looseSize))
+	fmt.Printf("in-pack: %d\n", inPack)
+	fmt.Printf("packs: %d\n", packCount)
+	fmt.Printf("size-pack: %s\n", formatSize(packSize))
+	fmt.Printf("prune-packable: %d\n", len(packedLooseObjects()))
+	fmt.Printf("garbage: %d\n", garbageCount)
+	fmt.Printf("size-garbage: %s\n", formatSize(garbageSize))
+}
+
+// humanizeBytes formats a size like git does for -H: "1.50 KiB".
+func humanizeBytes(bytes int64) string {
+	units := []struct {
+		name     string
+		shift    uint
+		rounding int64
+	}{{"GiB", 30, 5368709}, {"MiB", 20, 5243}, {"KiB", 10, 5}}
+	for _, unit := range units {
+		if bytes > 1<<unit.shift {
+			x := bytes + unit.rounding
+			fraction := (x & (1<<unit.shift - 1)) * 100 >> unit.shift
+			return fmt.Sprintf("%d.%02d %s", x>>unit.shift, fraction, unit.name)
+		}
+	}
+	if bytes == 1 {
+		return "1 byte"
+	}
+	return fmt.Sprintf("%d bytes", bytes)
+}
+
+func isHexString(s string) bool {
+	return strings.Trim(s, "0123456789abcdef") == ""
+}
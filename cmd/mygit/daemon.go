@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A daemon serving repositories over TCP (git://). Each connection is
+// served by a child process running "daemon --inetd" on it, so they can run
+// in parallel and a failing request can't take the daemon down: serving
+// switches the current repository, and errors are often fatal.
+// reference: https://git-scm.com/docs/git-daemon
+
+// exportOptions tell which repositories a server exports and how.
+type exportOptions struct {
+	basePath    string
+	exportAll   bool
+	verbose     bool
+	directories []string        // only these directories are served
+	services    map[string]bool // enabled services
+}
+
+func gitDaemon() {
+	usage := "daemon [--verbose] [--inetd | [--listen=<host>] [--port=<n>]] [--base-path=<path>] [--export-all] [--enable=<service>] [--disable=<service>] [<directory>...]"
+
+	opts := exportOptions{services: map[string]bool{"upload-pack": true, "receive-pack": false}}
+	var inetd bool
+	host, port := "", defaultDaemonPort
+	// the arguments given to the child processes
+	childArgs := []string{"daemon", "--inetd"}
+	for _, arg := range os.Args[2:] {
+		switch {
+		case arg == "--verbose":
+			opts.verbose = true
+		case arg == "--inetd":
+			inetd = true
+			continue
+		case arg == "--export-all":
+			opts.exportAll = true
+		case strings.HasPrefix(arg, "--listen="):
+			host = strings.TrimPrefix(arg, "--listen=")
+			continue
+		case strings.HasPrefix(arg, "--port="):
+			port = strings.TrimPrefix(arg, "--port=")
+			continue
+		case strings.HasPrefix(arg, "--base-path="):
+			opts.basePath = strings.TrimPrefix(arg, "--base-path=")
+		case strings.HasPrefix(arg, "--enable=") || strings.HasPrefix(arg, "--disable="):
+			option, service, _ := strings.Cut(arg, "=")
+			if _, ok := opts.services[service]; !ok {
+				fatal("fatal: unknown service '%s'\n", service)
+			}
+			opts.services[service] = option == "--enable"
+		case strings.HasPrefix(arg, "-"):
+			printUsageAndExit(usage)
+		default:
+			dir, err := filepath.Abs(arg)
+			if err != nil {
+				fatal(err.Error())
+			}
+			opts.directories = append(opts.directories, dir)
+		}
+		childArgs = append(childArgs, arg)
+	}
+
+	if inetd {
+		if err := serveDaemonRequest(os.Stdin, os.Stdout, opts); err != nil {
+			opts.log("%s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		fatal("fatal: unable to listen on %s: %s\n", net.JoinHostPort(host, port), err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fatal(err.Error())
+	}
+	opts.log("Ready to rumble")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			opts.log("accept: %s", err)
+			continue
+		}
+		if err := spawnDaemonChild(self, childArgs, conn); err != nil {
+			opts.log("unable to serve %s: %s", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// spawnDaemonChild runs a child process to serve a connection, with the
+// address of the client in REMOTE_ADDR and REMOTE_PORT like git.
+func spawnDaemonChild(self string, args []string, conn net.Conn) error {
+	defer conn.Close()
+	file, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cmd := exec.Command(self, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = file, file, os.Stderr
+	cmd.Env = os.Environ()
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("REMOTE_ADDR=%s", addr.IP), fmt.Sprintf("REMOTE_PORT=%d", addr.Port))
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// serveDaemonRequest reads the request of a client, in the form
+// "<service> <path>\0host=<host>\0" with extra parameters (like
+// "version=2") after another NUL, and serves it. Like git, the client is
+// not told why a request is denied.
+func serveDaemonRequest(in io.Reader, out io.Writer, opts exportOptions) error {
+	if addr := os.Getenv("REMOTE_ADDR"); addr != "" {
+		opts.log("Connection from %s", net.JoinHostPort(addr, os.Getenv("REMOTE_PORT")))
+	}
+	reader, writer := newPktReader(in), newPktWriter(out)
+	kind, data, err := reader.readPacket()
+	if err != nil {
+		return err
+	}
+	if kind != pktData {
+		return errPktUnexpected
+	}
+	fields := strings.Split(strings.TrimSuffix(string(data), "\n"), "\000")
+	service, path, ok := strings.Cut(fields[0], " ")
+	if !ok {
+		return fmt.Errorf("protocol error: invalid request %q", fields[0])
+	}
+	serve := serveOptions{}
+	for _, param := range fields[1:] {
+		if version := protocolVersion(param); version != 0 {
+			serve.version = version
+		}
+	}
+	opts.log("Request %s for '%s'", service, path)
+
+	dir, err := opts.repository(path)
+	if name, ok := strings.CutPrefix(service, "git-"); err == nil && (!ok || !opts.services[name]) {
+		err = errors.New("service not enabled")
+	}
+	if err != nil {
+		rejectRequest(writer, fmt.Errorf("access denied or repository not exported: %s", path))
+		return fmt.Errorf("'%s': %w", path, err)
+	}
+	useRepository(dir)
+	return serveService(service, in, out, serve)
+}
+
+// repository returns the repository for a request, if it can be served:
+// the path is under the base path (when given) and in the directories
+// listed (if any), and the repository is exported (has the file
+// git-daemon-export-ok, unless all are).
+func (opts exportOptions) repository(path string) (string, error) {
+	if strings.HasPrefix(path, "~") {
+		return "", errors.New("user paths are not supported")
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", errors.New("non-absolute path denied")
+	}
+	if slices.Contains(strings.Split(path, "/"), "..") {
+		return "", errors.New("path not allowed")
+	}
+	if opts.basePath != "" {
+		path = filepath.Join(opts.basePath, path)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	path, dir, err := findServedRepository(path)
+	if err != nil {
+		return "", errors.New("not a repository")
+	}
+	if len(opts.directories) > 0 && !slices.ContainsFunc(opts.directories, func(allowed string) bool {
+		return path == allowed || strings.HasPrefix(path, allowed+"/")
+	}) {
+		return "", errors.New("not in whitelist")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "git-daemon-export-ok")); err != nil && !opts.exportAll {
+		return "", errors.New("repository not exported")
+	}
+	return dir, nil
+}
+
+// log reports what the daemon does when verbose.
+func (opts exportOptions) log(format string, args ...any) {
+	if opts.verbose {
+		fmt.Fprintf(os.Stderr, "[%d] %s\n", os.Getpid(), fmt.Sprintf(format, args...))
+	}
+}
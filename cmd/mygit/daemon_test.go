@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeServedRepository creates the bare minimum of a repository found by
+// findGitDir, exported to daemons when exportOK.
+func makeServedRepository(t *testing.T, dir string, exportOK bool) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if exportOK {
+		if err := os.WriteFile(filepath.Join(dir, "git-daemon-export-ok"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportedRepository(t *testing.T) {
+	root := t.TempDir()
+	makeServedRepository(t, filepath.Join(root, "pub.git"), true)
+	makeServedRepository(t, filepath.Join(root, "priv.git"), false)
+	makeServedRepository(t, filepath.Join(root, "work", ".git"), true)
+	makeServedRepository(t, filepath.Join(root, "other", "x.git"), true)
+
+	tests := []struct {
+		opts exportOptions
+		path string
+		want string // the git directory, relative to root, or "" if denied
+	}{
+		{exportOptions{basePath: root}, "/pub.git", "pub.git"},
+		{exportOptions{basePath: root}, "/pub", "pub.git"},
+		{exportOptions{basePath: root}, "/work", "work/.git"},
+		{exportOptions{basePath: root}, "/other/x.git", "other/x.git"},
+		{exportOptions{basePath: root}, "/priv.git", ""},
+		{exportOptions{basePath: root, exportAll: true}, "/priv.git", "priv.git"},
+		{exportOptions{basePath: root}, "/missing.git", ""},
+		{exportOptions{basePath: root}, "pub.git", ""},
+		{exportOptions{basePath: root}, "~user/pub.git", ""},
+		{exportOptions{basePath: root}, "/other/../pub.git", ""},
+		{exportOptions{basePath: root, directories: []string{filepath.Join(root, "other")}}, "/other/x.git", "other/x.git"},
+		{exportOptions{basePath: root, directories: []string{filepath.Join(root, "other")}}, "/pub.git", ""},
+		{exportOptions{}, filepath.Join(root, "pub.git"), "pub.git"},
+		{exportOptions{}, "/pub.git", ""},
+	}
+	for _, test := range tests {
+		dir, err := test.opts.repository(test.path)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("repository(%q) with base path %q = %s, want it denied", test.path, test.opts.basePath, dir)
+		case test.want != "" && err != nil:
+			t.Errorf("repository(%q) with base path %q: %s", test.path, test.opts.basePath, err)
+		case test.want != "" && dir != filepath.Join(root, test.want):
+			t.Errorf("repository(%q) with base path %q = %s, want %s", test.path, test.opts.basePath, dir, filepath.Join(root, test.want))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseExpiryDate understands the date formats used by options like
+// gc.pruneExpire: "now", "never", relative dates like "2.weeks.ago" or
+// "3 days ago", unix timestamps ("@1700000000") and absolute dates.
+// Objects older than the returned time can be expired; "never" returns the
+// zero time.
+func parseExpiryDate(value string, now time.Time) (time.Time, error) {
+	// keywords and relative dates are case insensitive, absolute dates are
+	// parsed as given (like "T" in ISO 8601)
+	value = strings.TrimSpace(value)
+	lower := strings.ToLower(value)
+	switch lower {
+	case "never", "false":
+		return time.Time{}, nil
+	case "now", "all":
+		// anything written up to now is considered old enough
+		return now.Add(time.Second), nil
+	}
+
+	if timestamp, ok := strings.CutPrefix(lower, "@"); ok {
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date: %s", value)
+		}
+		return time.Unix(seconds, 0), nil
+	}
+
+	if relative, ok := strings.CutSuffix(lower, "ago"); ok {
+		fields := strings.FieldsFunc(relative, func(r rune) bool { return r == '.' || r == ' ' })
+		if len(fields)%2 != 0 || len(fields) == 0 {
+			return time.Time{}, fmt.Errorf("invalid date: %s", value)
+		}
+		date := now
+		for i := 0; i < len(fields); i += 2 {
+			count, err := strconv.Atoi(fields[i])
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid date: %s", value)
+			}
+			switch strings.TrimSuffix(fields[i+1], "s") {
+			case "second":
+				date = date.Add(-time.Duration(count) * time.Second)
+			case "minute":
+				date = date.Add(-time.Duration(count) * time.Minute)
+			case "hour":
+				date = date.Add(-time.Duration(count) * time.Hour)
+			case "day":
+				date = date.AddDate(0, 0, -count)
+			case "week":
+				date = date.AddDate(0, 0, -7*count)
+			case "month":
+				date = date.AddDate(0, -count, 0)
+			case "year":
+				date = date.AddDate(-count, 0, 0)
+			default:
+				return time.Time{}, fmt.Errorf("invalid date: %s", value)
+			}
+		}
+		return date, nil
+	}
+
+	layouts := []string{
+		time.RFC3339,
+		"2006-01-02 15:04:05 -0700",
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05",
+		"2006-01-02",
+		time.RFC1123Z,
+		"Mon Jan 2 15:04:05 2006 -0700",
+	}
+	for _, layout := range layouts {
+		if date, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return date, nil
+		}
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date: %s", value)
+}
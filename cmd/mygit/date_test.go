@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpiryDate(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"never", time.Time{}},
+		{"Never", time.Time{}},
+		{"now", now.Add(time.Second)},
+		{"@1700000000", time.Unix(1700000000, 0)},
+		{"1700000000", time.Unix(1700000000, 0)},
+		{"2.weeks.ago", now.AddDate(0, 0, -14)},
+		{"3 Days Ago", now.AddDate(0, 0, -3)},
+		{"1.hour.30.minutes.ago", now.Add(-90 * time.Minute)},
+		{"2024-03-05", time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)},
+		{"2024-03-05 10:00:00", time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)},
+		{"2024-03-05T10:00:00", time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)},
+		{"2024-03-05T10:00:00+02:00", time.Date(2024, 3, 5, 8, 0, 0, 0, time.UTC)},
+		{"2024-03-05 10:00:00 +0200", time.Date(2024, 3, 5, 8, 0, 0, 0, time.UTC)},
+		{"Tue, 05 Mar 2024 10:00:00 +0000", time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)},
+		{"Tue Mar 5 10:00:00 2024 +0000", time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)},
+		{"Sat Aug 17 08:30:00 2024 -0300", time.Date(2024, 8, 17, 11, 30, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, err := parseExpiryDate(test.value, now)
+		if err != nil {
+			t.Errorf("parseExpiryDate(%q): %s", test.value, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("parseExpiryDate(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+
+	for _, value := range []string{"", "yesterday-ish", "2.fortnights.ago", "weeks.ago", "@soon"} {
+		if _, err := parseExpiryDate(value, now); err == nil {
+			t.Errorf("parseExpiryDate(%q) succeeded", value)
+		}
+	}
+}
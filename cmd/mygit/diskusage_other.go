@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func diskUsage(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func gitFetch() {
+	usage := "fetch [-q | --quiet] [-v | --verbose] [--progress] [-u | --update-head-ok] [<remote> [<refspec>...]]"
+
+	var opts fetchOptions
+	args := []string{}
+	for _, arg := range os.Args[2:] {
+		switch arg {
+		case "-q", "--quiet":
+			opts.quiet = true
+		case "-v", "--verbose":
+			opts.verbose = true
+		case "--progress":
+			opts.forceProgress = true
+		case "-u", "--update-head-ok":
+			opts.updateHeadOK = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				printUsageAndExit(usage)
+			}
+			args = append(args, arg)
+		}
+	}
+
+	remoteName := defaultRemote()
+	if len(args) > 0 {
+		remoteName = args[0]
+	}
+	var refspecArgs []string
+	if len(args) > 1 {
+		refspecArgs = args[1:]
+	}
+	if !fetchRemote(remoteName, refspecArgs, opts) {
+		os.Exit(1)
+	}
+}
+
+type fetchOptions struct {
+	quiet, verbose, forceProgress bool
+	updateHeadOK                  bool // allow updating the checked out branch
+}
+
+// fetchRemote fetches from a remote (or url) the refs matching refspecArgs,
+// or the configured refspecs, and writes FETCH_HEAD. It returns false if
+// any ref couldn't be updated.
+func fetchRemote(remoteName string, refspecArgs []string, opts fetchOptions) bool {
+	url := remoteURL(remoteName)
+
+	// refspecs from the command line are fetched for merging, otherwise
+	// only the upstream of the current branch is
+	refspecs := remoteRefspecs(remoteName, "fetch")
+	if len(refspecArgs) > 0 {
+		refspecs = nil
+		for _, arg := range refspecArgs {
+			spec, err := parseRefspec(arg, false)
+			if err != nil {
+				fatal("fatal: %s\n", err)
+			}
+			refspecs = append(refspecs, spec)
+		}
+	}
+	if len(refspecs) == 0 {
+		spec, _ := parseRefspec("HEAD", false)
+		refspecs = append(refspecs, spec)
+	}
+	forMerge := func(name string) bool {
+		if len(refspecArgs) > 0 {
+			return true
+		}
+		branch := strings.TrimPrefix(readSymbolicRef("HEAD"), "refs/heads/")
+		remote, _ := getConfig("branch." + branch + ".remote")
+		merge, _ := getConfig("branch." + branch + ".merge")
+		return remote == remoteName && merge == name
+	}
+
+	remote, err := connectRemote(url, "git-upload-pack")
+	if err != nil {
+		fatal("fatal: %s\n", err)
+	}
+	defer remote.close()
+	// tags are listed too, to follow the ones pointing to fetched commits
+	prefixes := []string{"refs/tags/"}
+	for _, spec := range refspecs {
+		if !spec.negative {
+			prefixes = append(prefixes, spec.prefixes()...)
+		}
+	}
+	remoteRefs, err := remote.listRefs(prefixes)
+	if err != nil {
+		fatal("fatal: %s\n", err)
+	}
+	remoteHashes := map[string]string{}
+	remoteNames := []string{}
+	for _, ref := range remoteRefs {
+		if ref.hash != "" {
+			remoteHashes[ref.name] = ref.hash
+			remoteNames = append(remoteNames, ref.name)
+		}
+	}
+	mappings, err := mapRefs(refspecs, remoteNames, nil, false)
+	if err != nil {
+		fatal("fatal: %s\n", err)
+	}
+	// the index and working tree of the checked out branch would be left
+	// behind, unless it's unborn
+	if current := readSymbolicRef("HEAD"); !opts.updateHeadOK && !isBareRepository() && readRef(current) != "" {
+		for _, mapping := range mappings {
+			if mapping.dst == current {
+				worktree, _ := filepath.Abs(filepath.Dir(gitDir))
+				fatal("fatal: refusing to fetch into branch '%s' checked out at '%s'\n", current, worktree)
+			}
+		}
+	}
+
+	// like FETCH_HEAD, refs to merge come first
+	displayURL := strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+	updates, mergeUpdates := []*refUpdate{}, []*refUpdate{}
+	fetchHead, mergeFetchHead := []string{}, []string{}
+	wants := []string{}
+	fetched := map[string]bool{}
+	for _, mapping := range mappings {
+		hash := remoteHashes[mapping.src]
+		fetched[mapping.src] = true
+		line := fmt.Sprintf("%s\tnot-for-merge\t%s", hash, describeRemoteRef(mapping.src, displayURL))
+		var update *refUpdate
+		if mapping.dst != "" {
+			update = &refUpdate{remoteName: mapping.src, name: mapping.dst, oldHash: readRef(mapping.dst), newHash: hash, force: mapping.force}
+		}
+		if forMerge(mapping.src) {
+			mergeFetchHead = append(mergeFetchHead, strings.Replace(line, "not-for-merge", "", 1))
+			if update != nil {
+				mergeUpdates = append(mergeUpdates, update)
+			}
+		} else {
+			fetchHead = append(fetchHead, line)
+			if update != nil {
+				updates = append(updates, update)
+			}
+		}
+		binaryHash, _ := hex.DecodeString(hash)
+		if !hasObject(binaryHash) && !slices.Contains(wants, hash) {
+			wants = append(wants, hash)
+		}
+	}
+	updates = append(mergeUpdates, updates...)
+	fetchHead = append(mergeFetchHead, fetchHead...)
+	followTags := []string{}
+	for _, name := range remoteNames {
+		if strings.HasPrefix(name, "refs/tags/") && !fetched[name] && readRef(name) == "" {
+			followTags = append(followTags, name)
+		}
+	}
+
+	if len(wants) > 0 {
+		showProgress := progressEnabled(opts.quiet, opts.forceProgress)
+		pack, err := remote.fetchPack(wants, newHaveWalker(localTips()), showProgress)
+		if err != nil {
+			fatal("fatal: %s\n", err)
+		}
+		if err := unpackObjects(pack, showProgress); err != nil {
+			fatal("fatal: %s\n", err)
+		}
+	}
+
+	// the remote includes the annotated tags of the objects it sent, and
+	// lightweight tags can be followed when their commit is here now
+	for _, tag := range followTags {
+		hash, _ := hex.DecodeString(remoteHashes[tag])
+		if hasObject(hash) {
+			fetchHead = append(fetchHead, fmt.Sprintf("%s\tnot-for-merge\t%s", remoteHashes[tag], describeRemoteRef(tag, displayURL)))
+			updates = append(updates, &refUpdate{remoteName: tag, name: tag, newHash: remoteHashes[tag]})
+		}
+	}
+
+	writeFileAtomic(filepath.Join(gitDir, "FETCH_HEAD"), []byte(strings.Join(fetchHead, "\n")+"\n"))
+	return applyRefUpdates(updates, displayURL, opts.quiet, opts.verbose)
+}
+
+// remoteURL returns the url of a configured remote, or the name itself when
+// it's already a url or the path of a repository.
+func remoteURL(remoteName string) string {
+	if url, ok := getConfig("remote." + remoteName + ".url"); ok {
+		return url
+	}
+	if _, ok := localRepositoryPath(remoteName); !ok {
+		return remoteName
+	}
+	if _, err := findGitDir(remoteName); err != nil {
+		fatal("fatal: '%s' does not appear to be a git repository\n", remoteName)
+	}
+	return remoteName
+}
+
+// defaultRemote is the remote of the current branch, or origin.
+func defaultRemote() string {
+	branch := strings.TrimPrefix(readSymbolicRef("HEAD"), "refs/heads/")
+	if remote, ok := getConfig("branch." + branch + ".remote"); ok && branch != "" {
+		return remote
+	}
+	return "origin"
+}
+
+// describeRemoteRef describes a fetched ref for FETCH_HEAD, like git.
+func describeRemoteRef(name, url string) string {
+	if branch, ok := strings.CutPrefix(name, "refs/heads/"); ok {
+		return "branch '" + branch + "' of " + url
+	}
+	if tag, ok := strings.CutPrefix(name, "refs/tags/"); ok {
+		return "tag '" + tag + "' of " + url
+	}
+	if name == "HEAD" {
+		return url
+	}
+	return "'" + name + "' of " + url
+}
+
+type refUpdate struct {
+	remoteName       string
+	name             string
+	oldHash, newHash string
+	force            bool
+}
+
+// applyRefUpdates updates the local refs after a fetch, reporting each one
+// like git does. Updates that aren't fast-forwards are rejected unless
+// forced, and so are changes to existing tags. It returns false if any
+// update was rejected.
+func applyRefUpdates(updates []*refUpdate, url string, quiet, verbose bool) bool {
+	width := 10
+	for _, update := range updates {
+		if length := len(shortRefName(update.remoteName)); length > width {
+			width = length
+		}
+	}
+
+	ok := true
+	header := false
+	for _, update := range updates {
+		var flag byte
+		var summary, reason string
+		oldHash, _ := hex.DecodeString(update.oldHash)
+		newHash, _ := hex.DecodeString(update.newHash)
+		isTag := strings.HasPrefix(update.name, "refs/tags/")
+		switch {
+		case update.oldHash == update.newHash:
+			if !verbose {
+				continue
+			}
+			flag, summary = '=', "[up to date]"
+		case update.oldHash == "":
+			flag, summary = '*', "[new branch]"
+			if isTag {
+				summary = "[new tag]"
+			} else if !strings.HasPrefix(update.remoteName, "refs/heads/") {
+				summary = "[new ref]"
+			}
+			writeRef(update.name, update.newHash)
+		case isTag && !update.force:
+			flag, summary, reason = '!', "[rejected]", "would clobber existing tag"
+			ok = false
+		case !isTag && isAncestor(oldHash, newHash):
+			flag, summary = ' ', abbrevHash(oldHash, 7)+".."+abbrevHash(newHash, 7)
+			writeRef(update.name, update.newHash)
+		case update.force:
+			flag, summary, reason = '+', abbrevHash(oldHash, 7)+"..."+abbrevHash(newHash, 7), "forced update"
+			writeRef(update.name, update.newHash)
+		default:
+			flag, summary, reason = '!', "[rejected]", "non-fast-forward"
+			ok = false
+		}
+
+		if quiet && flag != '!' {
+			continue
+		}
+		if !header {
+			fmt.Fprintf(os.Stderr, "From %s\n", url)
+			header = true
+		}
+		line := fmt.Sprintf(" %c %-17s %-*s -> %s", flag, summary, width, shortRefName(update.remoteName), shortRefName(update.name))
+		if reason != "" {
+			line += "  (" + reason + ")"
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+	return ok
+}
+
+// shortRefName strips the usual prefixes of a ref name for display.
+func shortRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if short, ok := strings.CutPrefix(name, prefix); ok {
+			return short
+		}
+	}
+	return name
+}
+
+// localTips returns the commits the local refs point to, the starting
+// points of the haves offered to a remote.
+func localTips() [][]byte {
+	tips := [][]byte{}
+	refs := listRefs()
+	if head := readRef("HEAD"); head != "" {
+		refs["HEAD"] = head
+	}
+	for _, name := range sortedKeys(refs) {
+		hash, err := hex.DecodeString(refs[name])
+		if err == nil && hasObject(hash) {
+			tips = append(tips, hash)
+		}
+	}
+	return tips
+}
+
+type haveCommit struct {
+	hash    string
+	parents []string
+	time    int64
+}
+
+// haveWalker walks the local history from the most recent commits, giving
+// the haves for a fetch negotiation. Ancestors of commits in common with
+// the remote are skipped.
+type haveWalker struct {
+	queue  []*haveCommit // sorted by commit time, the most recent last
+	seen   map[string]bool
+	common map[string]bool
+}
+
+func newHaveWalker(tips [][]byte) *haveWalker {
+	walker := &haveWalker{seen: map[string]bool{}, common: map[string]bool{}}
+	for _, tip := range tips {
+		walker.push(hex.EncodeToString(tip))
+	}
+	return walker
+}
+
+func (w *haveWalker) push(hash string) {
+	if w.seen[hash] {
+		return
+	}
+	w.seen[hash] = true
+	commit := loadHaveCommit(hash)
+	if commit == nil {
+		return
+	}
+	i := sort.Search(len(w.queue), func(i int) bool { return w.queue[i].time > commit.time })
+	w.queue = append(w.queue, nil)
+	copy(w.queue[i+1:], w.queue[i:])
+	w.queue[i] = commit
+}
+
+// next returns up to count haves, empty when there are no more commits.
+func (w *haveWalker) next(count int) []string {
+	haves := []string{}
+	for len(haves) < count && len(w.queue) > 0 {
+		commit := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		if w.common[commit.hash] {
+			continue
+		}
+		haves = append(haves, commit.hash)
+		for _, parent := range commit.parents {
+			w.push(parent)
+		}
+	}
+	return haves
+}
+
+// markCommon records a commit the remote also has, along with all its
+// ancestors, so they are not offered anymore.
+func (w *haveWalker) markCommon(hash string) {
+	pending := []string{hash}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if w.common[current] {
+			continue
+		}
+		w.common[current] = true
+		if commit := loadHaveCommit(current); commit != nil {
+			pending = append(pending, commit.parents...)
+		}
+	}
+}
+
+// loadHaveCommit reads the parents and committer time of a commit, peeling
+// tags. It returns nil for missing objects or objects that aren't commits.
+func loadHaveCommit(hash string) *haveCommit {
+	binaryHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil
+	}
+	objType, content, err := loadObject(binaryHash)
+	for err == nil && objType == "tag" {
+		links := objectLinks(objType, content)
+		if len(links) == 0 {
+			return nil
+		}
+		objType, content, err = loadObject(links[0].hash)
+	}
+	if err != nil || objType != "commit" {
+		return nil
+	}
+
+	commit := &haveCommit{hash: hash}
+	for _, line := range objectHeaders(content) {
+		if parent, ok := strings.CutPrefix(line, "parent "); ok {
+			commit.parents = append(commit.parents, parent)
+		} else if committer, ok := strings.CutPrefix(line, "committer "); ok {
+			// "<name> <<email>> <timestamp> <timezone>"
+			fields := strings.Fields(committer[strings.LastIndexByte(committer, '>')+1:])
+			if len(fields) > 0 {
+				commit.time, _ = strconv.ParseInt(fields[0], 10, 64)
+			}
+		}
+	}
+	return commit
+}
+
+// isAncestor checks if a commit can be reached from another one by
+// following parents.
+func isAncestor(ancestor, descendant []byte) bool {
+	target := hex.EncodeToString(ancestor)
+	seen := map[string]bool{}
+	pending := []string{hex.EncodeToString(descendant)}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if current == target {
+			return true
+		}
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+		if commit := loadHaveCommit(current); commit != nil {
+			pending = append(pending, commit.parents...)
+		}
+	}
+	return false
+}
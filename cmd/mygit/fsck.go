@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// exit code bits, same as git
+const (
+	fsckErrorObject    = 01
+	fsckErrorReachable = 02
+	fsckErrorPack      = 04
+	fsckErrorRefs      = 010
+)
+
+func gitFsck() {
+	var showUnreachable, lostFound, connectivityOnly bool
+	for _, arg := range os.Args[2:] {
+		switch arg {
+		case "--unreachable":
+			showUnreachable = true
+		case "--lost-found":
+			lostFound = true
+		case "--connectivity-only":
+			connectivityOnly = true
+		default:
+			printUsageAndExit("fsck [--unreachable] [--lost-found] [--connectivity-only]")
+		}
+	}
+
+	errorsFound := 0
+
+	// object name -> type, for all the objects in the repository
+	objects := map[string]string{}
+
+	// the objects borrowed from alternates are checked too, like git
+	looseObjects := [][]byte{}
+	for _, dir := range objectDirs() {
+		looseObjects = append(looseObjects, listLooseObjects(dir)...)
+	}
+	for _, hash := range looseObjects {
+		objName := hex.EncodeToString(hash)
+		if _, ok := objects[objName]; ok {
+			continue
+		}
+		objType, content, err := readLooseObject(hash)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: object corrupt or missing: %s\n", objName, err)
+			errorsFound |= fsckErrorObject
+			continue
+		}
+		objects[objName] = objType
+		if connectivityOnly {
+			continue
+		}
+		if actual := hashObject(false, objType, int64(len(content)), content); !bytes.Equal(actual, hash) {
+			fmt.Fprintf(os.Stderr, "error: hash mismatch for %s (expected %s)\n", findLooseObject(hash), objName)
+			errorsFound |= fsckErrorObject
+			continue
+		}
+		errorsFound |= reportObjectProblems(objType, objName, content)
+	}
+
+	for _, pack := range getPacks() {
+		if !connectivityOnly {
+			if err := pack.verifyChecksum(); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s: %s\n", pack.path, err)
+				errorsFound |= fsckErrorPack
+			}
+			if verifyPackCRCs(pack) > 0 {
+				errorsFound |= fsckErrorPack
+			}
+		}
+
+		for i := 0; i < pack.index.count(); i++ {
+			hash := pack.index.name(i)
+			objName := hex.EncodeToString(hash)
+			objType, content, err := pack.readObjectAt(pack.index.offset(i))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s: object corrupt or missing in %s: %s\n", objName, pack.path, err)
+				errorsFound |= fsckErrorPack
+				continue
+			}
+			objects[objName] = objType
+			if connectivityOnly {
+				continue
+			}
+			if actual := hashObject(false, objType, int64(len(content)), content); !bytes.Equal(actual, hash) {
+				fmt.Fprintf(os.Stderr, "error: hash mismatch for %s in %s (got %x)\n", objName, pack.path, actual)
+				errorsFound |= fsckErrorPack
+				continue
+			}
+			errorsFound |= reportObjectProblems(objType, objName, content)
+		}
+	}
+
+	// connectivity: everything must be reachable from refs, HEAD and reflogs
+	roots := []objectLink{}
+	addRoot := func(value, description, problem string) {
+		hash, err := hex.DecodeString(value)
+		if err != nil || len(hash) != 20 {
+			fmt.Fprintf(os.Stderr, "error: %s: invalid sha1 %q\n", description, value)
+			errorsFound |= fsckErrorRefs
+			return
+		}
+		if _, ok := objects[value]; !ok {
+			fmt.Fprintf(os.Stderr, "error: %s: %s %s\n", description, problem, value)
+			errorsFound |= fsckErrorRefs
+			return
+		}
+		roots = append(roots, objectLink{hash: hash})
+	}
+
+	refs := listRefs()
+	refNames := sortedKeys(refs)
+	for _, name := range refNames {
+		addRoot(refs[name], name, "invalid sha1 pointer")
+	}
+
+	if head := readRef("HEAD"); head != "" {
+		addRoot(head, "HEAD", "invalid sha1 pointer")
+	} else if target := readSymbolicRef("HEAD"); target != "" {
+		fmt.Fprintf(os.Stderr, "notice: HEAD points to an unborn branch (%s)\n", strings.TrimPrefix(target, "refs/heads/"))
+	}
+	if len(refs) == 0 {
+		fmt.Fprintf(os.Stderr, "notice: No default references\n")
+	}
+
+	// like git, reflogs don't keep objects alive when saving lost objects
+	if !lostFound {
+		reflogs := readReflogs()
+		for _, name := range sortedKeys(reflogs) {
+			for _, value := range reflogs[name] {
+				addRoot(value, name, "invalid reflog entry")
+			}
+		}
+	}
+
+	reached := walkObjects(roots, func(missing objectLink, from []byte, fromType string) {
+		if from != nil {
+			fmt.Printf("broken link from %7s %x\n              to %7s %x\n", fromType, from, missing.objType, missing.hash)
+		}
+		fmt.Printf("missing %s %x\n", missing.objType, missing.hash)
+		errorsFound |= fsckErrorReachable
+	})
+
+	// unreachable objects referenced by other unreachable objects are not
+	// dangling: only the tips of lost history are reported by default
+	unreachable := []string{}
+	referenced := map[string]bool{}
+	for objName := range objects {
+		if _, ok := reached[objName]; ok {
+			continue
+		}
+		unreachable = append(unreachable, objName)
+		hash, _ := hex.DecodeString(objName)
+		objType, content, err := loadObject(hash)
+		if err != nil {
+			continue
+		}
+		for _, link := range objectLinks(objType, content) {
+			referenced[hex.EncodeToString(link.hash)] = true
+		}
+	}
+	sort.Strings(unreachable)
+
+	for _, objName := range unreachable {
+		objType := objects[objName]
+		if showUnreachable {
+			fmt.Printf("unreachable %s %s\n", objType, objName)
+		} else if !referenced[objName] {
+			fmt.Printf("dangling %s %s\n", objType, objName)
+		}
+		if lostFound && !referenced[objName] {
+			saveLostFound(objName, objType)
+		}
+	}
+
+	os.Exit(errorsFound)
+}
+
+func reportObjectProblems(objType, objName string, content []byte) int {
+	errorsFound := 0
+	for _, problem := range checkObject(objType, content) {
+		fmt.Fprintf(os.Stderr, "%s in %s %s: %s\n", problem.severity, objType, objName, problem)
+		if problem.severity == "error" {
+			errorsFound |= fsckErrorObject
+		}
+	}
+	return errorsFound
+}
+
+// verifyPackCRCs checks the raw data of each entry against the CRC32
+// recorded in the index.
+func verifyPackCRCs(pack *packFile) int {
+	info, err := pack.file.Stat()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	count := pack.index.count()
+	positions := make([]int, count)
+	for i := range positions {
+		positions[i] = i
+	}
+	sort.Slice(positions, func(a, b int) bool {
+		return pack.index.offset(positions[a]) < pack.index.offset(positions[b])
+	})
+
+	errors := 0
+	for n, i := range positions {
+		start, end := pack.index.offset(i), info.Size()-20
+		if n+1 < count {
+			end = pack.index.offset(positions[n+1])
+		}
+		crc := crc32.NewIEEE()
+		io.Copy(crc, io.NewSectionReader(pack.file, start, end-start))
+		if crc.Sum32() != pack.index.crc(i) {
+			fmt.Fprintf(os.Stderr, "error: index CRC mismatch for object %x from %s at offset %d\n", pack.index.name(i), pack.path, start)
+			errors++
+		}
+	}
+	return errors
+}
+
+// saveLostFound writes a dangling object into .git/lost-found: commits as
+// their name in "commit/", other objects in "other/" (blobs with their
+// content).
+func saveLostFound(objName, objType string) {
+	dir := filepath.Join(gitDir, "lost-found", "other")
+	if objType == "commit" {
+		dir = filepath.Join(gitDir, "lost-found", "commit")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fatal(err.Error())
+	}
+
+	content := []byte(objName + "\n")
+	if objType == "blob" {
+		hash, _ := hex.DecodeString(objName)
+		_, _, content = readObject(hash)
+	}
+	if err := os.WriteFile(filepath.Join(dir, objName), content, 0644); err != nil {
+		fatal(err.Error())
+	}
+}
+
+// listLooseObjects returns the names of all loose objects in an object
+// directory (in <dir>/xx/).
+func listLooseObjects(objectsDir string) [][]byte {
+	hashes := [][]byte{}
+	dirs, _ := os.ReadDir(objectsDir)
+	for _, dir := range dirs {
+		if len(dir.Name()) != 2 || !dir.IsDir() {
+			continue
+		}
+		entries, _ := os.ReadDir(filepath.Join(objectsDir, dir.Name()))
+		for _, entry := range entries {
+			if len(entry.Name()) != 38 {
+				continue
+			}
+			if hash, err := hex.DecodeString(dir.Name() + entry.Name()); err == nil {
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	return hashes
+}
+
+type objectLink struct {
+	hash    []byte
+	objType string // expected type of the object, if known
+}
+
+// objectLinks lists the objects directly referenced by an object: tree and
+// parents of a commit, entries of a tree (except submodules) and the
+// object of a tag.
+func objectLinks(objType string, content []byte) []objectLink {
+	links := []objectLink{}
+	addLink := func(value, linkType string) {
+		if hash, err := hex.DecodeString(value); err == nil && len(hash) == 20 {
+			links = append(links, objectLink{hash, linkType})
+		}
+	}
+
+	switch objType {
+	case "commit":
+		for _, line := range objectHeaders(content) {
+			if value, ok := strings.CutPrefix(line, "tree "); ok {
+				addLink(value, "tree")
+			} else if value, ok := strings.CutPrefix(line, "parent "); ok {
+				addLink(value, "commit")
+			}
+		}
+	case "tree":
+		entries, _ := parseTree(content)
+		for _, entry := range entries {
+			if entryType := treeEntryType(entry.mode); entryType != "commit" {
+				links = append(links, objectLink{entry.hash, entryType})
+			}
+		}
+	case "tag":
+		var object, tagType string
+		for _, line := range objectHeaders(content) {
+			if value, ok := strings.CutPrefix(line, "object "); ok {
+				object = value
+			} else if value, ok := strings.CutPrefix(line, "type "); ok {
+				tagType = value
+			}
+		}
+		addLink(object, tagType)
+	}
+	return links
+}
+
+// walkObjects finds all objects reachable from the roots, returning their
+// names and types. Objects that can't be found are passed to onMissing
+// along with the object referencing them (nil for roots).
+func walkObjects(roots []objectLink, onMissing func(missing objectLink, from []byte, fromType string)) map[string]string {
+	reached := map[string]string{}
+	walkObjectsFrom(roots, reached, onMissing)
+	return reached
+}
+
+// walkObjectsFrom is walkObjects adding the objects to reached, and not
+// going past the objects already there.
+func walkObjectsFrom(roots []objectLink, reached map[string]string, onMissing func(missing objectLink, from []byte, fromType string)) {
+	type pending struct {
+		link     objectLink
+		from     []byte
+		fromType string
+	}
+	queue := []pending{}
+	for _, root := range roots {
+		queue = append(queue, pending{link: root})
+	}
+
+	for len(queue) > 0 {
+		current := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		objName := hex.EncodeToString(current.link.hash)
+		if _, ok := reached[objName]; ok {
+			continue
+		}
+
+		// blobs have no links, no need to read them
+		if current.link.objType == "blob" {
+			if !hasObject(current.link.hash) && onMissing != nil {
+				onMissing(current.link, current.from, current.fromType)
+			}
+			reached[objName] = "blob"
+			continue
+		}
+
+		objType, content, err := loadObject(current.link.hash)
+		if err != nil {
+			if onMissing != nil {
+				onMissing(current.link, current.from, current.fromType)
+			}
+			reached[objName] = current.link.objType
+			continue
+		}
+		reached[objName] = objType
+
+		for _, link := range objectLinks(objType, content) {
+			queue = append(queue, pending{link, current.link.hash, objType})
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
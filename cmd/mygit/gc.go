@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type repackOptions struct {
+	all             bool // pack everything reachable, not only loose objects
+	keepUnreachable bool // unreachable objects from old packs are made loose
+	deleteRedundant bool // remove old packs and packed loose objects
+	pack            packOptions
+	// unreachable objects are only kept from packs modified after this
+	unpackUnreachableExpire time.Time
+}
+
+func gitRepack() {
+	usage := "repack [-a] [-A] [-d] [-q] [--window=<n>] [--depth=<n>]"
+
+	opts := repackOptions{pack: packConfigOptions()}
+	opts.pack.ofsDelta = true
+	for _, arg := range os.Args[2:] {
+		switch {
+		case arg == "-a":
+			opts.all = true
+		case arg == "-A":
+			opts.all, opts.keepUnreachable = true, true
+		case arg == "-d":
+			opts.deleteRedundant = true
+		case arg == "-q":
+			opts.pack.quiet = true
+		case arg == "-f" || arg == "-F" || arg == "-l":
+			// deltas are always recomputed, and there are no alternates
+		case strings.HasPrefix(arg, "--window="):
+			opts.pack.window = parseIntOption(arg, usage)
+		case strings.HasPrefix(arg, "--depth="):
+			opts.pack.depth = parseIntOption(arg, usage)
+		case len(arg) > 2 && arg[0] == '-' && arg[1] != '-':
+			// combined short options, e.g. "-ad"
+			for _, c := range arg[1:] {
+				switch c {
+				case 'a':
+					opts.all = true
+				case 'A':
+					opts.all, opts.keepUnreachable = true, true
+				case 'd':
+					opts.deleteRedundant = true
+				case 'q':
+					opts.pack.quiet = true
+				case 'f', 'F', 'l':
+				default:
+					printUsageAndExit(usage)
+				}
+			}
+		default:
+			printUsageAndExit(usage)
+		}
+	}
+
+	repack(opts)
+}
+
+// packConfigOptions returns the delta options from pack.window and
+// pack.depth.
+func packConfigOptions() packOptions {
+	opts := defaultPackOptions
+	opts.window = getConfigInt("pack.window", opts.window)
+	opts.depth = getConfigInt("pack.depth", opts.depth)
+	return opts
+}
+
+func repack(opts repackOptions) {
+	oldPacks := getPacks()
+
+	objects := collectObjects(rootHashes(), nil)
+	if !opts.all {
+		// incremental: only objects that aren't packed yet
+		unpacked := []*packObject{}
+		for _, object := range objects {
+			if _, _, ok := findPackedObject(object.hash); !ok {
+				unpacked = append(unpacked, object)
+			}
+		}
+		objects = unpacked
+	}
+
+	newPack := ""
+	if len(objects) > 0 {
+		checksum := writePackFiles(filepath.Join(gitDir, "objects", "pack", "pack"), objects, opts.pack)
+		newPack = filepath.Join(gitDir, "objects", "pack", fmt.Sprintf("pack-%x.pack", checksum))
+	}
+
+	if opts.deleteRedundant && opts.all {
+		packed := map[string]bool{}
+		for _, object := range objects {
+			packed[hex.EncodeToString(object.hash)] = true
+		}
+		for _, pack := range oldPacks {
+			if pack.path == newPack {
+				continue
+			}
+			if opts.keepUnreachable {
+				loosenUnreachable(pack, packed, opts.unpackUnreachableExpire)
+			}
+			for _, ext := range []string{".pack", ".idx"} {
+				if err := os.Remove(strings.TrimSuffix(pack.path, ".pack") + ext); err != nil {
+					fmt.Fprintf(os.Stderr, "warning: unable to remove %s: %s\n", pack.path, err)
+				}
+			}
+		}
+	}
+
+	reloadPacks()
+	if opts.deleteRedundant {
+		prunePackedObjects()
+	}
+}
+
+// loosenUnreachable writes as loose objects the objects of an old pack that
+// didn't make it to the new one, so they are only pruned once they expire.
+// They keep the modification time of the pack.
+func loosenUnreachable(pack *packFile, packed map[string]bool, expire time.Time) {
+	info, err := pack.file.Stat()
+	if err != nil {
+		fatal(err.Error())
+	}
+	if info.ModTime().Before(expire) {
+		return
+	}
+	for i := 0; i < pack.index.count(); i++ {
+		hash := pack.index.name(i)
+		if packed[hex.EncodeToString(hash)] || fileExists(looseObjectPath(hash)) {
+			continue
+		}
+		objType, content, err := pack.readObjectAt(pack.index.offset(i))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: unable to read %x from %s: %s\n", hash, pack.path, err)
+			continue
+		}
+		writeLooseObject(hash, objType, content)
+		os.Chtimes(looseObjectPath(hash), info.ModTime(), info.ModTime())
+	}
+}
+
+func gitGc() {
+	usage := "gc [--aggressive] [-q] [--prune=<date> | --no-prune]"
+
+	opts := repackOptions{all: true, keepUnreachable: true, deleteRedundant: true, pack: packConfigOptions()}
+	opts.pack.ofsDelta = true
+	pruneExpire, ok := getConfig("gc.pruneExpire")
+	if !ok {
+		pruneExpire = "2.weeks.ago"
+	}
+	for _, arg := range os.Args[2:] {
+		switch {
+		case arg == "--aggressive":
+			opts.pack.window = getConfigInt("gc.aggressiveWindow", 250)
+			opts.pack.depth = getConfigInt("gc.aggressiveDepth", 50)
+		case arg == "-q" || arg == "--quiet":
+			opts.pack.quiet = true
+		case arg == "--prune":
+			pruneExpire = "2.weeks.ago"
+		case strings.HasPrefix(arg, "--prune="):
+			pruneExpire = arg[len("--prune="):]
+		case arg == "--no-prune":
+			pruneExpire = "never"
+		default:
+			printUsageAndExit(usage)
+		}
+	}
+
+	expire, err := parseExpiryDate(pruneExpire, time.Now())
+	if err != nil {
+		fatal("fatal: failed to parse prune expiry value %s\n", pruneExpire)
+	}
+	opts.unpackUnreachableExpire = expire
+
+	packRefs()
+	repack(opts)
+	pruneUnreachable(expire, false, false)
+}
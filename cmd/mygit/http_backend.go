@@ -0,0 +1,208 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Server side of smart HTTP, as a CGI program (http-backend) or a server of
+// its own (serve --http). Like git http-backend, each request is served by
+// a child process running upload-pack or receive-pack with --stateless-rpc,
+// which speaks the protocol; only the advertisement of version 0 gets a
+// header from here.
+// reference: https://git-scm.com/docs/http-protocol
+// reference: https://git-scm.com/docs/git-http-backend
+
+type httpBackend struct {
+	exports exportOptions
+	self    string // the executable run for the services
+	// run as CGI: a single request, with the repository path in PATH_INFO
+	// and the services enabled by the repository's config, like git
+	cgi bool
+}
+
+func gitHTTPBackend() {
+	if len(os.Args) > 2 {
+		printUsageAndExit("http-backend")
+	}
+	if err := cgi.Serve(newCGIBackend()); err != nil {
+		fatal("fatal: %s\n", err)
+	}
+}
+
+// newCGIBackend returns the backend run as CGI, configured by the
+// environment.
+func newCGIBackend() *httpBackend {
+	backend := newHTTPBackend(exportOptions{
+		basePath:  os.Getenv("GIT_PROJECT_ROOT"),
+		exportAll: os.Getenv("GIT_HTTP_EXPORT_ALL") != "",
+	})
+	backend.cgi = true
+	return backend
+}
+
+func gitServe() {
+	usage := "serve --http <address> [--verbose] [--export-all] [--enable=<service>] [--disable=<service>] [<directory>]"
+
+	exports := exportOptions{basePath: ".", services: map[string]bool{"upload-pack": true, "receive-pack": false}}
+	var address, root string
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--http" && i+1 < len(args):
+			i++
+			address = args[i]
+		case strings.HasPrefix(arg, "--http="):
+			address = strings.TrimPrefix(arg, "--http=")
+		case arg == "--verbose":
+			exports.verbose = true
+		case arg == "--export-all":
+			exports.exportAll = true
+		case strings.HasPrefix(arg, "--enable=") || strings.HasPrefix(arg, "--disable="):
+			option, service, _ := strings.Cut(arg, "=")
+			if _, ok := exports.services[service]; !ok {
+				fatal("fatal: unknown service '%s'\n", service)
+			}
+			exports.services[service] = option == "--enable"
+		case strings.HasPrefix(arg, "-") || root != "":
+			printUsageAndExit(usage)
+		default:
+			root = arg
+		}
+	}
+	if address == "" {
+		printUsageAndExit(usage)
+	}
+	if root != "" {
+		exports.basePath = root
+	}
+
+	exports.log("Listening on %s", address)
+	if err := http.ListenAndServe(address, newHTTPBackend(exports)); err != nil {
+		fatal("fatal: %s\n", err)
+	}
+}
+
+func newHTTPBackend(exports exportOptions) *httpBackend {
+	self, err := os.Executable()
+	if err != nil {
+		fatal(err.Error())
+	}
+	return &httpBackend{exports: exports, self: self}
+}
+
+// ServeHTTP serves GET <repository>/info/refs?service=<service> with the
+// advertisement and POST <repository>/<service> with the results of a
+// request. The dumb protocol is not supported.
+func (b *httpBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if b.cgi {
+		var err error
+		if path, err = b.cgiPath(); err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	b.exports.log("%s %s", r.Method, r.URL)
+
+	var service string
+	advertise := r.Method == "GET" && strings.HasSuffix(path, "/info/refs")
+	if advertise {
+		path = strings.TrimSuffix(path, "/info/refs")
+		service = r.URL.Query().Get("service")
+	} else if i := strings.LastIndexByte(path, '/'); r.Method == "POST" && i >= 0 {
+		path, service = path[:i], path[i+1:]
+	}
+	if service != "git-upload-pack" && service != "git-receive-pack" {
+		http.Error(w, "Request not supported", http.StatusForbidden)
+		return
+	}
+	dir, err := b.exports.repository(path)
+	if err != nil {
+		b.exports.log("'%s': %s", path, err)
+		http.Error(w, "Repository not exported", http.StatusNotFound)
+		return
+	}
+	if !b.enabled(service, dir) {
+		http.Error(w, "Service not enabled: '"+service+"'", http.StatusForbidden)
+		return
+	}
+
+	var body io.Reader
+	if !advertise {
+		if r.Header.Get("Content-Type") != "application/x-"+service+"-request" {
+			http.Error(w, "Unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		body = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			if body, err = gzip.NewReader(r.Body); err != nil {
+				http.Error(w, "Bad gzip request", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	args := []string{strings.TrimPrefix(service, "git-"), "--stateless-rpc"}
+	contentType := "application/x-" + service + "-result"
+	if advertise {
+		args = append(args, "--advertise-refs")
+		contentType = "application/x-" + service + "-advertisement"
+	}
+	cmd := exec.Command(b.self, append(args, dir)...)
+	cmd.Env = os.Environ()
+	protocol := r.Header.Get("Git-Protocol")
+	if protocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+protocol)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = body, w, os.Stderr
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+	// version 0 advertisements start with the service, version 2 ones with
+	// the version
+	if advertise && protocolVersion(protocol) != 2 {
+		writer := newPktWriter(w)
+		writer.writeLine("# service=%s", service)
+		writer.flush()
+	}
+	if err := cmd.Run(); err != nil {
+		b.exports.log("%s: %s", service, err)
+	}
+}
+
+// cgiPath returns the path requested from the CGI program: PATH_INFO, under
+// the project root. Without a project root, the web server must translate
+// the path into the file system (PATH_TRANSLATED), else nothing would
+// restrict what is served.
+func (b *httpBackend) cgiPath() (string, error) {
+	if b.exports.basePath != "" {
+		return os.Getenv("PATH_INFO"), nil
+	}
+	if path := os.Getenv("PATH_TRANSLATED"); path != "" {
+		return path, nil
+	}
+	return "", errors.New("No GIT_PROJECT_ROOT or PATH_TRANSLATED from server")
+}
+
+// enabled checks if a service can be used. As CGI, upload-pack is enabled
+// unless http.uploadpack is false and receive-pack only with
+// http.receivepack, or for authenticated users (REMOTE_USER) by default.
+func (b *httpBackend) enabled(service, dir string) bool {
+	name := strings.TrimPrefix(service, "git-")
+	if !b.cgi {
+		return b.exports.services[name]
+	}
+	// there's a single request, so the repository can be switched
+	restore := useRepository(dir)
+	defer restore()
+	return getConfigBool("http."+strings.ReplaceAll(name, "-", ""), name == "upload-pack" || os.Getenv("REMOTE_USER") != "")
+}
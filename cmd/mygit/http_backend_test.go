@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestCGIRepositoryPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("REMOTE_USER", "")
+	t.Setenv("GIT_HTTP_EXPORT_ALL", "1")
+	root := t.TempDir()
+	makeServedRepository(t, filepath.Join(root, "repo.git"), false)
+
+	tests := []struct {
+		projectRoot, pathInfo, pathTranslated string
+		want                                  string // path, or "" for the 500 error
+		status                                int    // of a push to receive-pack, not enabled
+	}{
+		{root, "/repo.git/git-receive-pack", "", "/repo.git/git-receive-pack", http.StatusForbidden},
+		{root, "/repo.git/git-receive-pack", "/elsewhere/git-receive-pack", "/repo.git/git-receive-pack", http.StatusForbidden},
+		{root, "/missing.git/git-receive-pack", "", "/missing.git/git-receive-pack", http.StatusNotFound},
+		{"", "/repo.git/git-receive-pack", root + "/repo.git/git-receive-pack", root + "/repo.git/git-receive-pack", http.StatusForbidden},
+		{"", root + "/repo.git/git-receive-pack", "", "", http.StatusInternalServerError},
+		{"", "", "", "", http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Setenv("GIT_PROJECT_ROOT", test.projectRoot)
+		t.Setenv("PATH_INFO", test.pathInfo)
+		t.Setenv("PATH_TRANSLATED", test.pathTranslated)
+		backend := newCGIBackend()
+
+		path, err := backend.cgiPath()
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("cgiPath with GIT_PROJECT_ROOT=%q, PATH_INFO=%q, PATH_TRANSLATED=%q = %s, want an error",
+				test.projectRoot, test.pathInfo, test.pathTranslated, path)
+		case test.want != "" && (err != nil || path != test.want):
+			t.Errorf("cgiPath with GIT_PROJECT_ROOT=%q, PATH_INFO=%q, PATH_TRANSLATED=%q = %q, %v, want %s",
+				test.projectRoot, test.pathInfo, test.pathTranslated, path, err, test.want)
+		}
+
+		request := httptest.NewRequest("POST", "/git/repo.git/git-receive-pack", nil)
+		request.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		response := httptest.NewRecorder()
+		backend.ServeHTTP(response, request)
+		if response.Code != test.status {
+			t.Errorf("push with GIT_PROJECT_ROOT=%q, PATH_INFO=%q, PATH_TRANSLATED=%q: status %d, want %d",
+				test.projectRoot, test.pathInfo, test.pathTranslated, response.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Reading of the index (.git/index), versions 2 to 4. Only what is needed
+// to know which objects it references: the entries and the trees of the
+// cache tree extension. It's written (version 2) after updating the
+// working tree, with the files of the new commit.
+// reference: https://git-scm.com/docs/index-format
+
+type indexEntry struct {
+	mode uint32
+	hash []byte
+	name string
+}
+
+// readIndex returns the entries of the index and the tree objects cached in
+// its "TREE" extension. A missing index has no entries.
+func readIndex() ([]indexEntry, [][]byte, error) {
+	data, err := os.ReadFile(filepath.Join(gitDir, "index"))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < 12+20 || string(data[:4]) != "DIRC" {
+		return nil, nil, errors.New("index file corrupt: bad signature")
+	}
+	version := binary.BigEndian.Uint32(data[4:8])
+	if version < 2 || version > 4 {
+		return nil, nil, errors.New("index file corrupt: bad version")
+	}
+	count := binary.BigEndian.Uint32(data[8:12])
+	end := len(data) - 20
+
+	corrupt := errors.New("index file corrupt: truncated entry")
+	entries := make([]indexEntry, 0, count)
+	previousName := ""
+	pos := 12
+	for i := uint32(0); i < count; i++ {
+		// ctime, mtime, dev, ino, mode, uid, gid, size, hash and flags
+		if pos+62 > end {
+			return nil, nil, corrupt
+		}
+		entry := indexEntry{
+			mode: binary.BigEndian.Uint32(data[pos+24 : pos+28]),
+			hash: data[pos+40 : pos+60],
+		}
+		flags := binary.BigEndian.Uint16(data[pos+60 : pos+62])
+		nameStart := pos + 62
+		if version >= 3 && flags&0x4000 != 0 {
+			nameStart += 2 // extended flags
+		}
+
+		if version == 4 {
+			// the name drops some bytes from the end of the previous one
+			// and adds a new suffix
+			strip, n := readOffsetVarint(data[nameStart:end])
+			if n <= 0 || strip > len(previousName) {
+				return nil, nil, corrupt
+			}
+			nameStart += n
+			nameEnd := bytes.IndexByte(data[nameStart:end], 0)
+			if nameEnd < 0 {
+				return nil, nil, corrupt
+			}
+			entry.name = previousName[:len(previousName)-strip] + string(data[nameStart:nameStart+nameEnd])
+			pos = nameStart + nameEnd + 1
+		} else {
+			nameEnd := bytes.IndexByte(data[nameStart:end], 0)
+			if nameEnd < 0 {
+				return nil, nil, corrupt
+			}
+			entry.name = string(data[nameStart : nameStart+nameEnd])
+			// entries are padded with 1 to 8 NULs to a multiple of 8 bytes
+			pos += (nameStart - pos + nameEnd + 8) &^ 7
+		}
+		previousName = entry.name
+		entries = append(entries, entry)
+	}
+
+	trees := [][]byte{}
+	for pos+8 <= end {
+		signature := string(data[pos : pos+4])
+		size := int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+		if pos+size > end {
+			return nil, nil, errors.New("index file corrupt: truncated extension")
+		}
+		if signature == "TREE" {
+			trees = parseCacheTree(data[pos:pos+size], trees)
+		}
+		pos += size
+	}
+	return entries, trees, nil
+}
+
+// parseCacheTree appends the valid trees of a cache tree extension: each
+// node is "<path>\0<entry count> <subtrees>\n" followed by the tree hash,
+// unless the count is -1 (invalidated).
+func parseCacheTree(data []byte, trees [][]byte) [][]byte {
+	for len(data) > 0 {
+		_, rest, ok := bytes.Cut(data, []byte{0})
+		if !ok {
+			break
+		}
+		line, rest, ok := bytes.Cut(rest, []byte{'\n'})
+		if !ok {
+			break
+		}
+		data = rest
+		if bytes.HasPrefix(line, []byte("-")) {
+			continue
+		}
+		if len(data) < 20 {
+			break
+		}
+		trees = append(trees, data[:20])
+		data = data[20:]
+	}
+	return trees
+}
+
+// readOffsetVarint decodes the variable length integers used for index v4
+// path prefixes and offset deltas, returning the value and bytes read.
+func readOffsetVarint(data []byte) (int, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	value := int(data[0] & 0x7f)
+	n := 1
+	for data[n-1]&0x80 != 0 {
+		if n >= len(data) {
+			return 0, 0
+		}
+		value = ((value + 1) << 7) | int(data[n]&0x7f)
+		n++
+	}
+	return value, n
+}
+
+// writeIndex replaces the index with the given files, all at stage 0. The
+// stat data is taken from the working tree, except dev, ino, uid and gid,
+// so git refreshes those entries the first time it looks at them.
+func writeIndex(files map[string]*treeEntry) {
+	var data bytes.Buffer
+	data.WriteString("DIRC")
+	binary.Write(&data, binary.BigEndian, []uint32{2, uint32(len(files))})
+	for _, name := range sortedKeys(files) {
+		entry := files[name]
+		mode, _ := strconv.ParseUint(entry.mode, 8, 32)
+		var mtime time.Time
+		var size int64
+		if info, err := os.Lstat(filepath.FromSlash(name)); err == nil {
+			mtime, size = info.ModTime(), info.Size()
+		}
+		seconds, nanoseconds := uint32(mtime.Unix()), uint32(mtime.Nanosecond())
+		// ctime, mtime, dev, ino, mode, uid, gid and size
+		binary.Write(&data, binary.BigEndian, []uint32{seconds, nanoseconds, seconds, nanoseconds, 0, 0, uint32(mode), 0, 0, uint32(size)})
+		data.Write(entry.hash)
+		flags := len(name)
+		if flags > 0xfff {
+			flags = 0xfff
+		}
+		binary.Write(&data, binary.BigEndian, uint16(flags))
+		data.WriteString(name)
+		// padded with 1 to 8 NULs to a multiple of 8 bytes
+		data.Write(make([]byte, 8-(62+len(name))%8))
+	}
+	checksum := sha1.Sum(data.Bytes())
+	data.Write(checksum[:])
+	writeFileAtomic(filepath.Join(gitDir, "index"), data.Bytes())
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+func gitIndexPack() {
+	usage := "index-pack [-v] [-o <index-file>] [--stdin] [--threads=<n>] [<pack-file>]"
+
+	var fromStdin, verbose bool
+	threads := packThreads()
+	var packPath, indexPath string
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--stdin":
+			fromStdin = true
+		case arg == "-v":
+			verbose = true
+		case strings.HasPrefix(arg, "--threads="):
+			if threads = parseIntOption(arg, usage); threads == 0 {
+				threads = runtime.NumCPU()
+			}
+		case arg == "-o" && i+1 < len(args):
+			i++
+			indexPath = args[i]
+		case !strings.HasPrefix(arg, "-") && packPath == "":
+			packPath = arg
+		default:
+			printUsageAndExit(usage)
+		}
+	}
+	if packPath == "" && !fromStdin {
+		printUsageAndExit(usage)
+	}
+	if packPath != "" && !strings.HasSuffix(packPath, ".pack") {
+		fatal("fatal: packfile name '%s' does not end with '.pack'\n", packPath)
+	}
+
+	// temporary files are removed explicitly on errors, as fatal exits
+	// without running deferred calls
+	tempFiles := []string{}
+	fail := func(err error) {
+		for _, name := range tempFiles {
+			os.Remove(name)
+		}
+		fatal("fatal: %s\n", err)
+	}
+
+	var stream *packStream
+	var packFile *os.File // read again to resolve deltas
+	var tempPack string
+	if fromStdin {
+		// the pack is saved as it's read, to its final name once its
+		// checksum is known unless a name was given
+		dir := filepath.Dir(packPath)
+		if packPath == "" {
+			dir = filepath.Join(gitDir, "objects", "pack")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				fatal(err.Error())
+			}
+		}
+		tempFile, err := os.CreateTemp(dir, "tmp_pack_")
+		if err != nil {
+			fatal(err.Error())
+		}
+		tempPack = tempFile.Name()
+		tempFiles = append(tempFiles, tempPack)
+		stream, err = readPackStream(os.Stdin, tempFile, newProgress(verbose, "Receiving objects", 0))
+		if err != nil {
+			fail(err)
+		}
+		packFile = tempFile
+		if packPath == "" {
+			packPath = filepath.Join(dir, fmt.Sprintf("pack-%x.pack", stream.checksum))
+		}
+	} else {
+		file, err := os.Open(packPath)
+		if err != nil {
+			fatal("fatal: cannot open packfile '%s': %s\n", packPath, err)
+		}
+		stream, err = readPackStream(file, nil, newProgress(verbose, "Indexing objects", 0))
+		if err != nil {
+			fatal("fatal: %s\n", err)
+		}
+		packFile = file
+	}
+
+	deltas := newProgress(verbose && stream.deltaCount() > 0, "Resolving deltas", stream.deltaCount())
+	err := resolvePack(stream, packFile, threads, nil, func(entry *packEntry, content []byte) error {
+		if entry.isDelta() {
+			deltas.increment()
+		}
+		return nil
+	})
+	if closeErr := packFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fail(err)
+	}
+	deltas.done()
+	if indexPath == "" {
+		indexPath = strings.TrimSuffix(packPath, ".pack") + ".idx"
+	}
+	tempIndex, err := writeIndexFile(filepath.Dir(indexPath), stream)
+	if err != nil {
+		fail(err)
+	}
+	tempFiles = append(tempFiles, tempIndex)
+
+	// the pack is only moved into place with its index
+	renames := []struct{ from, to string }{}
+	if fromStdin {
+		renames = append(renames, struct{ from, to string }{tempPack, packPath})
+	}
+	renames = append(renames, struct{ from, to string }{tempIndex, indexPath})
+	for _, file := range renames {
+		os.Chmod(file.from, 0444)
+		if err := os.Rename(file.from, file.to); err != nil {
+			fail(err)
+		}
+	}
+
+	if fromStdin {
+		fmt.Printf("pack\t%x\n", stream.checksum)
+	} else {
+		fmt.Printf("%x\n", stream.checksum)
+	}
+}
+
+// writeIndexFile writes the .idx for a pack read with readPackStream, whose
+// deltas must be resolved, to a temporary file in dir. It returns the name
+// of the file, to be renamed into place.
+func writeIndexFile(dir string, stream *packStream) (string, error) {
+	objects := make([]*packObject, len(stream.entries))
+	for i, entry := range stream.entries {
+		objects[i] = &packObject{hash: entry.hash, offset: entry.offset, crc: entry.crc}
+	}
+
+	indexFile, err := os.CreateTemp(dir, "tmp_idx_")
+	if err != nil {
+		return "", err
+	}
+	err = writePackIndex(indexFile, objects, stream.checksum)
+	if closeErr := indexFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(indexFile.Name())
+		return "", err
+	}
+	return indexFile.Name(), nil
+}
+
+func gitVerifyPack() {
+	usage := "verify-pack [-v | --verbose] [-s | --stat-only] <pack>.idx..."
+
+	var verbose, statOnly bool
+	paths := []string{}
+	for _, arg := range os.Args[2:] {
+		switch arg {
+		case "-v", "--verbose":
+			verbose = true
+		case "-s", "--stat-only":
+			statOnly = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				printUsageAndExit(usage)
+			}
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		printUsageAndExit(usage)
+	}
+
+	failed := false
+	for _, path := range paths {
+		basePath := strings.TrimSuffix(strings.TrimSuffix(path, ".idx"), ".pack")
+		stream, err := verifyPack(basePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			if verbose {
+				fmt.Printf("%s.pack: bad\n", basePath)
+			}
+			failed = true
+			continue
+		}
+		if verbose || statOnly {
+			showPackInfo(stream, statOnly)
+		}
+		if verbose && !statOnly {
+			fmt.Printf("%s.pack: ok\n", basePath)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// verifyPack reads a whole pack, resolving all its objects, and checks
+// that its index matches.
+func verifyPack(basePath string) (*packStream, error) {
+	indexContent, err := os.ReadFile(basePath + ".idx")
+	if err != nil {
+		return nil, err
+	}
+	index, err := parsePackIndex(indexContent)
+	if err != nil {
+		return nil, fmt.Errorf("%s.idx: %s", basePath, err)
+	}
+	if checksum := sha1.Sum(indexContent[:len(indexContent)-20]); !bytes.Equal(checksum[:], index.checksum) {
+		return nil, fmt.Errorf("%s.idx: index checksum mismatch", basePath)
+	}
+
+	file, err := os.Open(basePath + ".pack")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stream, err := readPackStream(file, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s.pack: %s", basePath, err)
+	}
+	if !bytes.Equal(stream.checksum, index.packChecksum) {
+		return nil, fmt.Errorf("%s.pack: pack checksum does not match its index", basePath)
+	}
+	if err := resolvePack(stream, file, packThreads(), nil, nil); err != nil {
+		return nil, fmt.Errorf("%s.pack: %s", basePath, err)
+	}
+
+	if index.count() != len(stream.entries) {
+		return nil, fmt.Errorf("%s.idx: %d objects in index, %d in pack", basePath, index.count(), len(stream.entries))
+	}
+	for _, entry := range stream.entries {
+		i := index.find(entry.hash)
+		if i < 0 || index.offset(i) != entry.offset {
+			return nil, fmt.Errorf("%s.idx: object %x at offset %d is not in the index", basePath, entry.hash, entry.offset)
+		}
+		if index.crc(i) != entry.crc {
+			return nil, fmt.Errorf("%s.idx: CRC mismatch for object %x", basePath, entry.hash)
+		}
+	}
+	return stream, nil
+}
+
+// showPackInfo lists the entries of a pack, in pack order, followed by a
+// histogram of delta chain lengths.
+func showPackInfo(stream *packStream, statOnly bool) {
+	chains := map[int]int{}
+	maxDepth := 0
+	for _, entry := range stream.entries {
+		chains[entry.depth]++
+		if entry.depth > maxDepth {
+			maxDepth = entry.depth
+		}
+		if statOnly {
+			continue
+		}
+		fmt.Printf("%x %-6s %d %d %d", entry.hash, entry.objType, entry.header.size, entry.end-entry.offset, entry.offset)
+		if entry.base != nil {
+			fmt.Printf(" %d %x", entry.depth, entry.base.hash)
+		}
+		fmt.Println()
+	}
+
+	plural := func(count int) string {
+		if count == 1 {
+			return "object"
+		}
+		return "objects"
+	}
+	if chains[0] > 0 {
+		fmt.Printf("non delta: %d %s\n", chains[0], plural(chains[0]))
+	}
+	for depth := 1; depth <= maxDepth; depth++ {
+		if chains[depth] > 0 {
+			fmt.Printf("chain length = %d: %d %s\n", depth, chains[depth], plural(chains[depth]))
+		}
+	}
+}
+
+// gitShowIndex prints the contents of a pack index read from stdin: offset,
+// name and, for version 2, CRC32 of each object.
+func gitShowIndex() {
+	if len(os.Args) > 2 {
+		printUsageAndExit("show-index < <pack>.idx")
+	}
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if bytes.HasPrefix(content, []byte("\377tOc")) {
+		index, err := parsePackIndex(content)
+		if err != nil {
+			fatal("fatal: %s\n", err)
+		}
+		for i := 0; i < index.count(); i++ {
+			fmt.Printf("%d %x (%08x)\n", index.offset(i), index.name(i), index.crc(i))
+		}
+		return
+	}
+
+	// version 1: fanout table followed by offset and name of each object
+	if len(content) < 256*4 {
+		fatal("fatal: unable to read index\n")
+	}
+	count := int(binary.BigEndian.Uint32(content[255*4:]))
+	entries := content[256*4:]
+	if len(entries) < count*24 {
+		fatal("fatal: unable to read entry %d/%d\n", len(entries)/24, count)
+	}
+	for i := 0; i < count; i++ {
+		entry := entries[i*24 : i*24+24]
+		fmt.Printf("%d %x\n", binary.BigEndian.Uint32(entry), entry[4:])
+	}
+}
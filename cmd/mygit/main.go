@@ -3,13 +3,13 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"cmp"
 	"compress/zlib"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -35,10 +35,48 @@ func main() {
 		gitListTree()
 	case "write-tree":
 		gitWriteTree()
+	case "mktree":
+		gitMakeTree()
 	case "commit-tree":
 		gitCommitTree()
 	case "clone":
 		gitClone()
+	case "fetch":
+		gitFetch()
+	case "pull":
+		gitPull()
+	case "push":
+		gitPush()
+	case "daemon":
+		gitDaemon()
+	case "upload-pack":
+		gitUploadPack()
+	case "receive-pack":
+		gitReceivePack()
+	case "http-backend":
+		gitHTTPBackend()
+	case "serve":
+		gitServe()
+	case "fsck":
+		gitFsck()
+	case "pack-objects":
+		gitPackObjects()
+	case "repack":
+		gitRepack()
+	case "gc":
+		gitGc()
+	case "prune":
+		gitPrune()
+	case "count-objects":
+		gitCountObjects()
+	case "index-pack":
+		gitIndexPack()
+	case "verify-pack":
+		gitVerifyPack()
+	case "show-index":
+		gitShowIndex()
+	case "unpack-objects":
+		gitUnpackObjects()
 	default:
 		fmt.Printf("invalid command: %s\n", os.Args[1])
 		printUsageAndExit("")
@@ -61,6 +99,46 @@ func fatal(msg string, args ...any) {
 }
 
 func gitInit() {
+	repository := initRepository()
+	fmt.Printf("Initialized empty Git repository in %s\n", repository)
+}
+
+// gitDir is the directory of the repository the commands work on: .git in
+// the working tree, or another (possibly bare) repository that is served.
+var gitDir = ".git"
+
+// useRepository switches to another repository, returning a function to
+// switch back. Local repositories are served in-process this way.
+func useRepository(dir string) func() {
+	previous := gitDir
+	reloadPacks()
+	gitDir = dir
+	return func() {
+		reloadPacks()
+		gitDir = previous
+	}
+}
+
+// isBareRepository tells if the current repository has no working tree:
+// core.bare, or by default when the git directory isn't a ".git".
+func isBareRepository() bool {
+	return getConfigBool("core.bare", filepath.Base(gitDir) != ".git")
+}
+
+// findGitDir returns the repository directory of a path: its .git, or the
+// path itself for a bare repository.
+func findGitDir(path string) (string, error) {
+	if fileExists(filepath.Join(path, ".git", "HEAD")) {
+		return filepath.Join(path, ".git"), nil
+	}
+	if fileExists(filepath.Join(path, "HEAD")) && fileExists(filepath.Join(path, "objects")) {
+		return path, nil
+	}
+	return "", fmt.Errorf("'%s' does not appear to be a git repository", path)
+}
+
+// initRepository creates .git in the current directory, returning its path.
+func initRepository() string {
 	initialDirectories := []string{".git", ".git/objects", ".git/refs"}
 	for _, directory := range initialDirectories {
 		err := os.Mkdir(directory, 0755)
@@ -75,8 +153,7 @@ func gitInit() {
 		fatal("error writing to file %s: %s", headPath, err)
 	}
 	cwd, _ := os.Getwd()
-	repository := filepath.Join(cwd, ".git")
-	fmt.Printf("Initialized empty Git repository in %s\n", repository)
+	return filepath.Join(cwd, ".git")
 }
 
 func gitCatFile() {
@@ -89,101 +166,159 @@ func gitCatFile() {
 		fatal("fatal: Not a valid object name %s\n", objName)
 	}
 
-	objDir := filepath.Join(".git", "objects", objName[:2])
-	info, err := os.Stat(objDir)
-	if err != nil {
-		fatal(err.Error())
-	}
-	if !info.IsDir() {
-		fatal("fatal: not a directory %s\n", objDir)
-	}
-
-	objPath := filepath.Join(objDir, objName[2:])
-	file, err := os.Open(objPath)
+	hash, err := hex.DecodeString(objName)
 	if err != nil {
-		fatal(err.Error())
+		fatal("fatal: Not a valid object name %s\n", objName)
 	}
-	defer file.Close()
 
 	if os.Args[2] == "-e" { // only check if object exists
+		if !hasObject(hash) {
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
-	zipReader, err := zlib.NewReader(file)
+	// loose or packed
+	objType, content, err := loadObject(hash)
 	if err != nil {
-		fatal(err.Error())
+		fatal("fatal: Not a valid object name %s\n", objName)
 	}
 
-	reader := bufio.NewReader(zipReader)
-	objType, _ := reader.ReadString(' ')
-	objType = objType[:len(objType)-1]
-
-	if os.Args[2] == "-t" {
+	switch os.Args[2] {
+	case "-t":
 		fmt.Println(objType)
-		return
+	case "-s":
+		fmt.Println(len(content))
+	default: // "-p" (pretty-print)
+		os.Stdout.Write(content)
 	}
+}
 
-	lengthStr, err := reader.ReadString(0)
-	lengthStr = lengthStr[:len(lengthStr)-1]
-	if err != nil {
-		fatal(err.Error())
+func gitHashObject() {
+	usage := "hash-object [-t <type>] [-w] [--path=<file> | --no-filters] [--stdin [--literally]] [--] <file>...\n" +
+		"   or: hash-object [-t <type>] [-w] --stdin-paths [--no-filters]"
+
+	objType := "blob"
+	var writeObject, fromStdin, stdinPaths, literally, noFilters bool
+	var pathName string
+	var filenames []string
+	for i := 2; i < len(os.Args); i++ {
+		switch arg := os.Args[i]; {
+		case arg == "-w":
+			writeObject = true
+		case arg == "-t":
+			if i+1 >= len(os.Args) {
+				printUsageAndExit(usage)
+			}
+			objType = os.Args[i+1]
+			i++ // skip
+		case arg == "--stdin":
+			fromStdin = true
+		case arg == "--stdin-paths":
+			stdinPaths = true
+		case arg == "--literally":
+			literally = true
+		case arg == "--no-filters":
+			noFilters = true
+		case arg == "--path":
+			if i+1 >= len(os.Args) {
+				printUsageAndExit(usage)
+			}
+			pathName = os.Args[i+1]
+			i++ // skip
+		case strings.HasPrefix(arg, "--path="):
+			pathName = arg[len("--path="):]
+		case arg == "--":
+			filenames = append(filenames, os.Args[i+1:]...)
+			i = len(os.Args)
+		case strings.HasPrefix(arg, "-"):
+			printUsageAndExit(usage)
+		default:
+			filenames = append(filenames, arg)
+		}
 	}
-	objSize, _ := strconv.ParseInt(lengthStr, 10, 64)
 
-	if os.Args[2] == "-s" {
-		fmt.Println(objSize)
-		return
+	if stdinPaths && (fromStdin || len(filenames) > 0) {
+		fatal("fatal: --stdin-paths is incompatible with --stdin and file arguments\n")
 	}
-
-	if objSize == 0 {
-		fatal("error: object file %s is empty", objPath)
+	if pathName != "" && (noFilters || stdinPaths) {
+		fatal("fatal: --path is incompatible with --no-filters and --stdin-paths\n")
+	}
+	if !fromStdin && !stdinPaths && len(filenames) == 0 {
+		printUsageAndExit(usage)
+	}
+	if !literally && !isKnownObjectType(objType) {
+		fatal("fatal: invalid object type %q\n", objType)
 	}
 
-	// default action "-p" (pretty-print)
+	hashContent := func(content []byte, name string) []byte {
+		if objType == "blob" && !noFilters && name != "" {
+			content = convertToGit(name, content)
+		}
+		if !literally {
+			if err := checkObjectFormat(objType, content); err != nil {
+				fatal("fatal: corrupt %s: %s\n", objType, err)
+			}
+		}
+		return hashObject(writeObject, objType, int64(len(content)), content)
+	}
 
-	io.Copy(os.Stdout, reader)
-}
+	if fromStdin {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fatal(err.Error())
+		}
+		fmt.Printf("%x\n", hashContent(content, pathName))
+	}
 
-func gitHashObject() {
-	if len(os.Args) < 3 || (os.Args[2] == "-w" && len(os.Args) < 4) {
-		printUsageAndExit("hash-object [-w] <object>")
+	if stdinPaths {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			filenames = append(filenames, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			fatal(err.Error())
+		}
 	}
 
-	var writeObject bool
-	var filename string
-	if os.Args[2] == "-w" {
-		filename = os.Args[3]
-		writeObject = true
-	} else {
-		filename = os.Args[2]
+	for _, filename := range filenames {
+		name := filename
+		if pathName != "" {
+			name = pathName
+		}
+		fmt.Printf("%x\n", hashContent(readFileContent(filename), name))
 	}
+}
 
-	fmt.Printf("%x\n", hashFile(writeObject, filename))
+func isKnownObjectType(objType string) bool {
+	switch objType {
+	case "blob", "tree", "commit", "tag":
+		return true
+	}
+	return false
 }
 
+// hashFile hashes a file from the working tree as a blob, applying the
+// end-of-line conversion configured by its attributes.
 func hashFile(writeObject bool, filename string) []byte {
-	file, err := os.Open(filename)
-	if err != nil {
-		fatal(err.Error())
-	}
-	defer file.Close()
+	content := convertToGit(filename, readFileContent(filename))
+	return hashObject(writeObject, "blob", int64(len(content)), content)
+}
 
-	info, err := file.Stat()
+func readFileContent(filename string) []byte {
+	info, err := os.Stat(filename)
 	if err != nil {
 		fatal(err.Error())
 	}
 	if info.IsDir() {
 		fatal("'%s' is a directory", info.Name())
 	}
-	fileSize := info.Size()
 
-	content := make([]byte, fileSize)
-	_, err = file.Read(content)
+	content, err := os.ReadFile(filename)
 	if err != nil {
 		fatal(err.Error())
 	}
-
-	return hashObject(writeObject, "blob", fileSize, content)
+	return content
 }
 
 func hashObject(writeObject bool, contentType string, contentSize int64, content []byte) []byte {
@@ -194,39 +329,53 @@ func hashObject(writeObject bool, contentType string, contentSize int64, content
 	s.Write(content)
 
 	hash := s.Sum(nil)
-	objName := fmt.Sprintf("%x", hash)
 
 	if !writeObject {
 		return hash
 	}
 
-	objDir := filepath.Join(".git", "objects", objName[:2])
-	objPath := filepath.Join(objDir, objName[2:])
-
 	// no need to rewrite if contents match (same hash)
-	if fileExists(objPath) {
+	if hasObject(hash) {
 		return hash
 	}
 
+	writeLooseObject(hash, contentType, content)
+	return hash
+}
+
+// writeLooseObject stores an object in .git/objects/xx/yyyy...
+func writeLooseObject(hash []byte, contentType string, content []byte) {
+	objPath := looseObjectPath(hash)
+	objDir := filepath.Dir(objPath)
+
 	err := os.MkdirAll(objDir, 0755)
 	if err != nil {
 		fatal(err.Error())
 	}
 
-	objFile, err := os.OpenFile(objPath, os.O_CREATE, 0644)
+	// write to a temporary file first, so a partially written object is
+	// never visible under its final name
+	objFile, err := os.CreateTemp(objDir, "tmp_obj_")
 	if err != nil {
 		fatal(err.Error())
 	}
-	defer objFile.Close()
+	defer os.Remove(objFile.Name())
 	writer := zlib.NewWriter(objFile)
-	writer.Write(payload)
+	fmt.Fprintf(writer, "%s %d\000", contentType, len(content))
 	writer.Write(content)
 	err = writer.Close()
+	if err == nil {
+		err = objFile.Close()
+	}
+	if err == nil {
+		err = os.Chmod(objFile.Name(), 0444)
+	}
+	if err == nil {
+		err = os.Rename(objFile.Name(), objPath)
+	}
 	if err != nil {
 		fatal(err.Error())
 	}
-
-	return hash
 }
 
 func fileExists(path string) bool {
@@ -240,109 +389,278 @@ func fileExists(path string) bool {
 	return true
 }
 
+type lsTreeOptions struct {
+	recursive  bool
+	showTrees  bool
+	treesOnly  bool
+	abbrev     int
+	format     string
+	terminator string
+	paths      []string
+}
+
 func gitListTree() {
-	if len(os.Args) < 3 || (len(os.Args) == 4 && os.Args[2] != "--name-only" && os.Args[2] != "--object-only" && os.Args[2] != "-l") {
-		printUsageAndExit("ls-tree [(-l | --name-only | --object-only)] <tree_sha>")
-	}
-
-	var nameOnly, objectOnly, longFormat bool
-	var objName string
-	if os.Args[2] == "--name-only" {
-		objName = os.Args[3]
-		nameOnly = true
-	} else if os.Args[2] == "--object-only" {
-		objName = os.Args[3]
-		objectOnly = true
-	} else if os.Args[2] == "-l" {
-		objName = os.Args[3]
-		longFormat = true
-	} else {
-		objName = os.Args[2]
+	usage := "ls-tree [-d] [-r] [-t] [(-l | --name-only | --object-only)] [-z] [--full-name] [--abbrev[=<n>]] [--format=<format>] <tree-ish> [<path>...]"
+
+	opts := lsTreeOptions{terminator: "\n"}
+	var longFormat, nameOnly, objectOnly bool
+	var treeish string
+	for i := 2; i < len(os.Args); i++ {
+		switch arg := os.Args[i]; {
+		case arg == "-r":
+			opts.recursive = true
+		case arg == "-t":
+			opts.showTrees = true
+		case arg == "-d":
+			opts.treesOnly = true
+		case arg == "-l" || arg == "--long":
+			longFormat = true
+		case arg == "--name-only" || arg == "--name-status":
+			nameOnly = true
+		case arg == "--object-only":
+			objectOnly = true
+		case arg == "-z":
+			opts.terminator = "\000"
+		case arg == "--full-name" || arg == "--full-tree":
+			// paths are always shown from the top of the repository, since
+			// commands must be run from there
+		case arg == "--abbrev":
+			opts.abbrev = 7
+		case strings.HasPrefix(arg, "--abbrev="):
+			n, err := strconv.Atoi(arg[len("--abbrev="):])
+			if err != nil {
+				printUsageAndExit(usage)
+			}
+			opts.abbrev = n
+		case strings.HasPrefix(arg, "--format="):
+			opts.format = arg[len("--format="):]
+		case arg == "--":
+			opts.paths = append(opts.paths, os.Args[i+1:]...)
+			i = len(os.Args)
+		case strings.HasPrefix(arg, "-"):
+			printUsageAndExit(usage)
+		case treeish == "":
+			treeish = arg
+		default:
+			opts.paths = append(opts.paths, arg)
+		}
 	}
 
-	if len(objName) != 40 {
-		fatal("fatal: Not a valid object name %s\n", objName)
+	if treeish == "" {
+		printUsageAndExit(usage)
 	}
-
-	objDir := filepath.Join(".git", "objects", objName[:2])
-	info, err := os.Stat(objDir)
-	if err != nil {
-		fatal(err.Error())
+	exclusive := 0
+	for _, set := range []bool{longFormat, nameOnly, objectOnly, opts.format != ""} {
+		if set {
+			exclusive++
+		}
 	}
-	if !info.IsDir() {
-		fatal("fatal: not a directory %s\n", objDir)
+	if exclusive > 1 {
+		fatal("fatal: -l, --name-only, --object-only and --format are mutually exclusive\n")
 	}
 
-	objPath := filepath.Join(objDir, objName[2:])
-	file, err := os.Open(objPath)
-	if err != nil {
-		fatal(err.Error())
+	switch {
+	case longFormat:
+		opts.format = "%(objectmode) %(objecttype) %(objectname) %(objectsize:padded)%x09%(path)"
+	case nameOnly:
+		opts.format = "%(path)"
+	case objectOnly:
+		opts.format = "%(objectname)"
+	case opts.format == "":
+		opts.format = "%(objectmode) %(objecttype) %(objectname)%x09%(path)"
 	}
-	defer file.Close()
 
-	zipReader, err := zlib.NewReader(file)
-	if err != nil {
-		fatal(err.Error())
+	for i, path := range opts.paths {
+		trailingSlash := strings.HasSuffix(path, "/")
+		opts.paths[i] = filepath.ToSlash(filepath.Clean(path))
+		if trailingSlash && opts.paths[i] != "." {
+			opts.paths[i] += "/"
+		}
 	}
 
-	reader := bufio.NewReader(zipReader)
-	objType, _ := reader.ReadString(' ')
-	objType = objType[:len(objType)-1]
+	treeHash := peelObject(resolveRevision(treeish), "tree")
+	opts.listTree(treeHash, "")
+}
 
+func (opts *lsTreeOptions) listTree(treeHash []byte, base string) {
+	objType, _, content := readObject(treeHash)
 	if objType != "tree" {
-		fatal("expected a 'tree' node, found: %q\n", objType)
+		fatal("fatal: expected a 'tree' node, found: %q\n", objType)
 	}
-
-	lengthStr, err := reader.ReadString(0)
-	lengthStr = lengthStr[:len(lengthStr)-1]
+	entries, err := parseTree(content)
 	if err != nil {
-		fatal(err.Error())
+		fatal("fatal: corrupt tree %x: %s\n", treeHash, err)
 	}
-	objSize, _ := strconv.ParseInt(lengthStr, 10, 64)
 
-	if objSize == 0 {
-		fatal("error: object file %s is empty", objPath)
-	}
+	for _, entry := range entries {
+		path := base + entry.name
+		isTree := treeEntryType(entry.mode) == "tree"
 
-	hash := make([]byte, 20)
-	for {
-		fileMode, err := reader.ReadString(' ')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			fatal(err.Error())
+		matched, ancestor := opts.matchPath(path)
+		if !matched && !ancestor {
+			continue
 		}
-		fileMode = "000000" + fileMode[:len(fileMode)-1]
-		fileMode = fileMode[len(fileMode)-6:]
 
-		name, err := reader.ReadString('\000')
-		if err != nil {
-			fatal(err.Error())
+		// trees leading to a requested path are always entered, trees
+		// inside a requested path only when listing recursively
+		recurse := isTree && (ancestor || opts.recursive)
+		show := matched || opts.showTrees
+		if isTree && recurse && !opts.showTrees && !opts.treesOnly {
+			show = false
+		}
+		if !isTree && opts.treesOnly {
+			show = false
 		}
-		name = name[:len(name)-1]
 
-		_, err = reader.Read(hash)
-		if err != nil {
-			fatal(err.Error())
+		if show {
+			fmt.Print(opts.formatEntry(entry, path) + opts.terminator)
+		}
+		if recurse {
+			opts.listTree(entry.hash, path+"/")
 		}
+	}
+}
 
-		if nameOnly {
-			fmt.Println(name)
-		} else if objectOnly {
-			fmt.Printf("%x\n", hash)
-		} else if longFormat {
-			objType, objSize := getObjTypeAndSize(fmt.Sprintf("%x", hash))
-			fmt.Printf("%s %s %x\t%d\t%s\n", fileMode, objType, hash, objSize, name)
+// matchPath checks a path against the path arguments. It is "matched" when
+// it is (or is inside) one of them and an "ancestor" when it is a directory
+// leading to one of them.
+func (opts *lsTreeOptions) matchPath(path string) (matched, ancestor bool) {
+	if len(opts.paths) == 0 {
+		return true, false
+	}
+	for _, spec := range opts.paths {
+		if spec == "." {
+			return true, false
+		}
+		if strings.HasSuffix(spec, "/") {
+			matched = matched || strings.HasPrefix(path, spec)
 		} else {
-			objType, _ := getObjTypeAndSize(fmt.Sprintf("%x", hash))
-			fmt.Printf("%s %s %x\t%s\n", fileMode, objType, hash, name)
+			matched = matched || path == spec || strings.HasPrefix(path, spec+"/")
+		}
+		ancestor = ancestor || strings.HasPrefix(spec, path+"/")
+	}
+	if matched {
+		ancestor = false
+	}
+	return
+}
+
+func (opts *lsTreeOptions) formatEntry(entry *treeEntry, path string) string {
+	var output strings.Builder
+	format := opts.format
+	for len(format) > 0 {
+		switch {
+		case strings.HasPrefix(format, "%%"):
+			output.WriteByte('%')
+			format = format[2:]
+		case strings.HasPrefix(format, "%x") && len(format) >= 4 && isHexString(format[2:4]):
+			value, _ := strconv.ParseUint(format[2:4], 16, 8)
+			output.WriteByte(byte(value))
+			format = format[4:]
+		case strings.HasPrefix(format, "%("):
+			end := strings.IndexByte(format, ')')
+			if end < 0 {
+				fatal("fatal: bad ls-tree format: element '%s' does not end in ')'\n", format[1:])
+			}
+			output.WriteString(opts.expandPlaceholder(format[2:end], entry, path))
+			format = format[end+1:]
+		case format[0] == '%':
+			fatal("fatal: bad ls-tree format: element '%s' does not start with '('\n", format[1:])
+		default:
+			output.WriteByte(format[0])
+			format = format[1:]
+		}
+	}
+	return output.String()
+}
+
+func (opts *lsTreeOptions) expandPlaceholder(placeholder string, entry *treeEntry, path string) string {
+	objType := treeEntryType(entry.mode)
+	switch placeholder {
+	case "objectmode":
+		return fmt.Sprintf("%06s", entry.mode)
+	case "objecttype":
+		return objType
+	case "objectname":
+		if opts.abbrev > 0 {
+			return abbrevHash(entry.hash, opts.abbrev)
+		}
+		return fmt.Sprintf("%x", entry.hash)
+	case "objectsize", "objectsize:padded":
+		size := "-"
+		if objType == "blob" {
+			_, objSize, _ := readObject(entry.hash)
+			size = strconv.FormatUint(objSize, 10)
+		}
+		if placeholder == "objectsize:padded" {
+			return fmt.Sprintf("%7s", size)
+		}
+		return size
+	case "path":
+		if opts.terminator == "\000" {
+			return path
+		}
+		return quotePath(path)
+	}
+	fatal("fatal: bad ls-tree format: %%(%s)\n", placeholder)
+	return ""
+}
+
+// quotePath quotes a path the way git does when core.quotePath is enabled:
+// names with control characters, quotes, backslashes or non-ASCII bytes
+// are shown as C-style strings with octal escapes.
+func quotePath(path string) string {
+	needsQuote := false
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; c < 0x20 || c == '"' || c == '\\' || c >= 0x7f {
+			needsQuote = true
+			break
+		}
+	}
+	if !needsQuote {
+		return path
+	}
+
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '"', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case '\a':
+			quoted.WriteString("\\a")
+		case '\b':
+			quoted.WriteString("\\b")
+		case '\t':
+			quoted.WriteString("\\t")
+		case '\n':
+			quoted.WriteString("\\n")
+		case '\v':
+			quoted.WriteString("\\v")
+		case '\f':
+			quoted.WriteString("\\f")
+		case '\r':
+			quoted.WriteString("\\r")
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&quoted, "\\%03o", c)
+			} else {
+				quoted.WriteByte(c)
+			}
 		}
 	}
+	quoted.WriteByte('"')
+	return quoted.String()
 }
 
 func getObjTypeAndSize(objName string) (objType string, objSize int64) {
-	objPath := filepath.Join(".git", "objects", objName[:2], objName[2:])
+	objPath := filepath.Join(gitDir, "objects", objName[:2], objName[2:])
+
+	if hash, err := hex.DecodeString(objName); err == nil && !fileExists(objPath) {
+		objType, size, _ := readObject(hash)
+		return objType, int64(size)
+	}
 
 	file, err := os.Open(objPath)
 	if err != nil {
@@ -371,8 +689,7 @@ func gitWriteTree() {
 		printUsageAndExit("write-tree")
 	}
 
-	cwd, _ := os.Getwd()
-	fmt.Printf("%x\n", writeTree(cwd))
+	fmt.Printf("%x\n", writeTree(filepath.Dir(gitDir)))
 }
 
 type treeEntry struct {
@@ -418,19 +735,7 @@ func writeTree(path string) []byte {
 		treeEntries = append(treeEntries, te)
 	}
 
-	slices.SortFunc(treeEntries, func(a, b *treeEntry) int {
-		return cmp.Compare(a.name, b.name)
-	})
-
-	content := []byte{}
-	for _, entry := range treeEntries {
-		content = append(content, []byte(entry.mode)...)
-		content = append(content, ' ')
-		content = append(content, []byte(entry.name)...)
-		content = append(content, '\000')
-		content = append(content, entry.hash...)
-	}
-
+	content := encodeTree(treeEntries)
 	return hashObject(true, "tree", int64(len(content)), content)
 }
 
@@ -507,140 +812,226 @@ func getGitConfig(key string) string {
 }
 
 func gitClone() {
-	if len(os.Args) < 4 {
-		printUsageAndExit("clone <repo> <dir>")
+	usage := "clone [-q | --quiet] [--progress] [-l | --local | --no-local] [--no-hardlinks] [-s | --shared] <repo> <dir>"
+
+	var quiet, forceProgress, noLocal, noHardlinks, shared bool
+	args := []string{}
+	for _, arg := range os.Args[2:] {
+		switch arg {
+		case "-q", "--quiet":
+			quiet = true
+		case "--progress":
+			forceProgress = true
+		case "-l", "--local":
+			noLocal = false
+		case "--no-local":
+			noLocal = true
+		case "--no-hardlinks":
+			noHardlinks = true
+		case "-s", "--shared":
+			shared = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				printUsageAndExit(usage)
+			}
+			args = append(args, arg)
+		}
+	}
+	if len(args) != 2 {
+		printUsageAndExit(usage)
 	}
 
-	repoUrl := os.Args[2]
-	directory := os.Args[3]
+	repoUrl := args[0]
+	directory := args[1]
+	// a repository on disk is copied directly, unless --no-local
+	localDir := ""
+	if path, ok := localRepositoryPath(repoUrl); ok {
+		dir, err := findGitDir(path)
+		if err != nil {
+			fatal("fatal: repository '%s' does not exist\n", path)
+		}
+		repoUrl, _ = filepath.Abs(path)
+		if !noLocal {
+			localDir, _ = filepath.Abs(dir)
+		}
+	}
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Cloning into '%s'...\n", directory)
+	}
 
 	// TODO: refactor gitInit to accept parameter to new directory
 	// TEMP: make new directory and initialize .git
 	os.Mkdir(directory, 0755)
 	os.Chdir(directory)
-	gitInit()
+	initRepository()
 
-	packContent, head := fetchGitPack(repoUrl)
+	showProgress := progressEnabled(quiet, forceProgress)
+	var pack io.Reader
+	var refs []remoteRef
+	if localDir != "" {
+		refs = cloneLocalRepository(localDir, shared, !noHardlinks)
+	} else {
+		pack, refs = fetchGitPack(repoUrl, showProgress)
+	}
+	if pack != nil {
+		if err := unpackObjects(pack, showProgress); err != nil {
+			fatal(err.Error())
+		}
+	}
+
+	// remote branches are tracked under refs/remotes/origin, tags are kept
+	// as they are
+	var head remoteRef
+	for _, ref := range refs {
+		if ref.name == "HEAD" {
+			head = ref
+		} else if tracking, ok := cloneRefspec.mapName(ref.name); ok {
+			writeRef(tracking, ref.hash)
+		} else if strings.HasPrefix(ref.name, "refs/tags/") {
+			writeRef(ref.name, ref.hash)
+		}
+	}
 
-	os.MkdirAll(filepath.Join(".git", "refs", "heads"), 0755)
-	os.WriteFile(filepath.Join(".git", "refs", "heads", "master"), []byte(head), 0644)
+	setConfig("remote.origin.url", repoUrl)
+	setConfig("remote.origin.fetch", cloneRefspec.String())
+
+	branch := remoteHeadBranch(head, refs)
+	switch {
+	case head.hash == "":
+		if branch == "" {
+			branch = "master"
+		}
+		writeSymbolicRef("HEAD", "refs/heads/"+branch)
+		fmt.Fprintf(os.Stderr, "warning: You appear to have cloned an empty repository.\n")
+		return
+	case branch == "":
+		// the remote HEAD is detached, and so is the clone
+		writeRef("HEAD", head.hash)
+	default:
+		writeSymbolicRef("HEAD", "refs/heads/"+branch)
+		tracking, _ := cloneRefspec.mapName("refs/heads/" + branch)
+		writeSymbolicRef("refs/remotes/origin/HEAD", tracking)
+		writeRef("refs/heads/"+branch, head.hash)
+		setConfig("branch."+branch+".remote", "origin")
+		setConfig("branch."+branch+".merge", "refs/heads/"+branch)
+	}
 
-	unpackObjects(packContent)
 	// "checkout" files to workdir
-	headHash, _ := hex.DecodeString(string(head))
+	headHash, _ := hex.DecodeString(head.hash)
 	checkoutCommit(headHash)
 }
 
-func fetchGitPack(repoUrl string) (packContent []byte, head string) {
-	respGet, err := http.Get(repoUrl + "/info/refs?service=git-upload-pack")
+// cloneRefspec maps the remote branches to the remote-tracking refs of a
+// clone.
+var cloneRefspec = &refspec{force: true, glob: true, src: "refs/heads/*", dst: "refs/remotes/origin/*"}
+
+// remoteHeadBranch returns the name of the branch the remote HEAD points
+// to. Without the symref (older servers), it's guessed from the branches
+// at the same commit, preferring master.
+func remoteHeadBranch(head remoteRef, refs []remoteRef) string {
+	if branch, ok := strings.CutPrefix(head.symref, "refs/heads/"); ok {
+		return branch
+	}
+	guess := ""
+	for _, ref := range refs {
+		branch, ok := strings.CutPrefix(ref.name, "refs/heads/")
+		if !ok || ref.hash != head.hash || head.hash == "" {
+			continue
+		}
+		if branch == "master" {
+			return branch
+		}
+		if guess == "" {
+			guess = branch
+		}
+	}
+	return guess
+}
+
+// fetchGitPack returns the remote's HEAD, branches and tags and the pack
+// with all their objects, as it's received. The pack is nil for an empty
+// repository.
+func fetchGitPack(repoUrl string, showProgress bool) (pack io.Reader, refs []remoteRef) {
+	remote, err := connectRemote(repoUrl, "git-upload-pack")
 	if err != nil {
 		fatal(err.Error())
 	}
-	defer respGet.Body.Close()
 
-	if respGet.StatusCode != 200 {
-		fatal("could not fetch %q - status code: %d", repoUrl, respGet.StatusCode)
+	refs, err = remote.listRefs(append([]string{"HEAD", "refs/tags/"}, cloneRefspec.prefixes()...))
+	if err != nil {
+		fatal(err.Error())
 	}
-
-	contentType := respGet.Header.Get("Content-Type")
-	if contentType != "application/x-git-upload-pack-advertisement" {
-		fatal("unexpected content type: %q", contentType)
+	wants := []string{}
+	for _, ref := range refs {
+		trace("hash=%s ref=%s", ref.hash, ref.name)
+		if ref.hash != "" && !slices.Contains(wants, ref.hash) {
+			wants = append(wants, ref.hash)
+		}
+	}
+	if len(wants) == 0 {
+		remote.close()
+		return nil, refs
 	}
 
-	refs := map[string]string{}
-
-	// start parsing the pack response
-	sizeBuffer := make([]byte, 4)
-	for {
-		_, err := respGet.Body.Read(sizeBuffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			fatal(err.Error())
-		}
+	pack, err = remote.fetchPack(wants, nil, showProgress)
+	if err != nil {
+		fatal(err.Error())
+	}
+	return pack, refs
+}
 
-		size, err := strconv.ParseUint(string(sizeBuffer), 16, 32)
-		if err != nil {
+// cloneLocalRepository copies the objects of a repository on disk, hard
+// linking the files when possible, or with shared borrows them through
+// objects/info/alternates instead. It returns the refs of the repository.
+func cloneLocalRepository(dir string, shared, hardlinks bool) []remoteRef {
+	objectsDir := filepath.Join(dir, "objects")
+	if shared {
+		infoDir := filepath.Join(gitDir, "objects", "info")
+		if err := os.MkdirAll(infoDir, 0755); err != nil {
 			fatal(err.Error())
 		}
-
-		if size > 4 {
-			dataBuffer := make([]byte, size-4)
-			_, err = respGet.Body.Read(dataBuffer)
+		writeFileAtomic(filepath.Join(infoDir, "alternates"), []byte(objectsDir+"\n"))
+	} else {
+		err := filepath.WalkDir(objectsDir, func(path string, entry fs.DirEntry, err error) error {
 			if err != nil {
-				fatal(err.Error())
+				return err
 			}
-
-			fmt.Printf("size=%d data=%q\n", size, string(dataBuffer))
-
-			// strip newline
-			data := string(dataBuffer)
-			if data[len(data)-1] == '\n' {
-				data = data[:len(data)-1]
-			}
-
-			if data[0] == '#' {
-				if data != "# service=git-upload-pack" {
-					fatal("unexpected header: %q", data)
-				}
-			} else {
-				hash := data[:40]
-				// ignore whitespace
-				parts := strings.Split(data[41:], "\000")
-				ref := parts[0]
-				if len(parts) > 1 {
-					capabilities := strings.Split(parts[1], " ")
-					for _, capability := range capabilities {
-						fmt.Printf("capability: %s\n", capability)
-					}
-				}
-				fmt.Printf("hash=%s ref=%s\n", hash, ref)
-				refs[ref] = hash
+			relative, _ := filepath.Rel(objectsDir, path)
+			target := filepath.Join(gitDir, "objects", relative)
+			if entry.IsDir() {
+				return os.MkdirAll(target, 0755)
 			}
-		} else {
-			fmt.Printf("size=%d (terminator)\n", size)
+			return linkOrCopyFile(path, target, hardlinks)
+		})
+		if err != nil {
+			fatal("fatal: failed to copy objects: %s\n", err)
 		}
 	}
 
-	for ref, hash := range refs {
-		fmt.Println(ref, hash)
-	}
+	restore := useRepository(dir)
+	defer restore()
+	return advertisedRefs()
+}
 
-	var ok bool
-	if head, ok = refs["HEAD"]; !ok {
-		fatal("no HEAD reference found")
+// linkOrCopyFile creates a hard link of a file, or a copy when that's not
+// possible (e.g. across file systems) or not wanted.
+func linkOrCopyFile(source, target string, hardlink bool) error {
+	if hardlink {
+		err := os.Link(source, target)
+		if err == nil {
+			return nil
+		}
+		trace("copying %s: %s", source, err)
 	}
-
-	fmt.Println("====")
-
-	postHeader := "application/x-git-upload-pack-request"
-	postBody := fmt.Sprintf("0032want %s\n00000009done\n", refs["HEAD"])
-	respPost, err := http.Post(repoUrl+"/git-upload-pack", postHeader, strings.NewReader(postBody))
+	info, err := os.Stat(source)
 	if err != nil {
-		fatal(err.Error())
+		return err
 	}
-	defer respPost.Body.Close()
-
-	if respGet.StatusCode != 200 {
-		fatal("could not fetch %q - status code: %d", repoUrl, respGet.StatusCode)
-	}
-
-	nakExpected := []byte("0008NAK\n")
-	nakHeader := make([]byte, 8)
-	_, err = respPost.Body.Read(nakHeader)
+	content, err := os.ReadFile(source)
 	if err != nil {
-		fatal(err.Error())
-	}
-	if slices.Compare(nakExpected, nakHeader) != 0 {
-		fatal("unexpected header on response. got: %q - want: %q\n", nakHeader, nakExpected)
+		return err
 	}
-
-	packContent, err = io.ReadAll(respPost.Body)
-	if err != nil {
-		fatal(err.Error())
-	}
-	return
+	return os.WriteFile(target, content, info.Mode().Perm())
 }
 
 const OBJ_COMMIT = 1
@@ -650,247 +1041,139 @@ const OBJ_TAG = 4
 const OBJ_OFS_DELTA = 6
 const OBJ_REF_DELTA = 7
 
-type objDelta struct {
-	source  []byte
-	content []byte
-}
-
-func unpackObjects(packContent []byte) {
-	reader := bufio.NewReader(bytes.NewReader(packContent))
-
-	// begin reading the pack file now
-	packHeader := make([]byte, 12)
-	_, err := reader.Read(packHeader)
+// unpackObjects stores the objects of a pack as loose objects, as it's
+// received.
+func unpackObjects(pack io.Reader, showProgress bool) error {
+	// the pack reader inflates each entry up to the exact end of its zlib
+	// stream, checking sizes, and verifies the trailing checksum
+	stream, spooled, err := spoolPackStream(pack, newProgress(showProgress, "Receiving objects", 0))
 	if err != nil {
-		fatal(err.Error())
-	}
-	if slices.Compare(packHeader[:4], []byte("PACK")) != 0 {
-		fatal("invalid PACK header")
+		return err
 	}
-	version := bigEndianBytesToUint(packHeader[4:8])
-	objCount := bigEndianBytesToUint(packHeader[8:12])
-	fmt.Println(version, objCount)
-
-	// save deltas to apply after unpacking
-	savedObjDeltas := []objDelta{}
-
-	// extracting objects from pack file received
-
-	offset := uint64(12)
-	for index := 0; index < int(objCount); index++ {
-
-		var objRefDeltaHash []byte
-
-		value, err := reader.ReadByte()
-		lenghtBytesRead := uint64(1)
-		if err != nil {
-			fatal(err.Error())
-		}
-
-		objType := (value >> 4) & 0b00000111
-		informedSize := uint64(value & 0b00001111)
-		shift := 4
-		for value&0b10000000 != 0 {
-			value, err = reader.ReadByte()
-			lenghtBytesRead++
-			if err != nil {
-				fatal(err.Error())
-			}
-			informedSize = informedSize | uint64(value&0b01111111)<<shift
-			if value&0b10000000 == 0 {
-				break
-			}
-			shift += 7
-		}
+	defer spooled.Close()
+	trace("pack version %d with %d objects", stream.version, len(stream.entries))
 
-		fmt.Printf("index=%2d\ttype=%d\toffset=%5d\tsize=%5d", index, objType, offset, informedSize)
-		if objType == OBJ_OFS_DELTA {
-			fatal("OBJ_OFS_DELTA not implemented yet!")
-		} else if objType == OBJ_REF_DELTA {
-			objRefDeltaHash = make([]byte, 20)
-			reader.Read(objRefDeltaHash)
+	for index, entry := range stream.entries {
+		base := ""
+		if entry.header.objType == OBJ_OFS_DELTA {
+			base = fmt.Sprintf("\tbaseOffset=%d", entry.header.baseOffset)
+		} else if entry.header.objType == OBJ_REF_DELTA {
+			base = fmt.Sprintf("\tobjRefDelta=%x", entry.header.baseHash)
 		}
-		// NOTE: no idea why reported size is too small in some cases...
-		if informedSize < 1024 {
-			informedSize = 1024
-		}
-		compressedBuffer, err := reader.Peek(int(informedSize))
-		if err != nil && err != io.EOF {
-			fatal(err.Error())
-		}
-		bytesBuffer := bytes.NewReader(compressedBuffer)
-		zreader, err := zlib.NewReader(bytesBuffer)
-		if err != nil {
-			fatal(err.Error())
-		}
-		uncompressedBuffer := make([]byte, informedSize)
-		actualSize, err := zreader.Read(uncompressedBuffer)
-		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-			fatal(err.Error())
-		}
-
-		compressedBytesRead := uint64(bytesBuffer.Size() - int64(bytesBuffer.Len()))
-		fmt.Printf("\tactual_size=%5d\tcompressed_size=%5d", uint64(actualSize), +compressedBytesRead)
+		trace("index=%2d\ttype=%d\toffset=%5d\tsize=%5d\tcompressed_size=%5d\tcrc=%08x%s",
+			index, entry.header.objType, entry.offset, entry.header.size, entry.end-entry.header.dataOffset, entry.crc, base)
+	}
 
-		if objType == OBJ_REF_DELTA {
-			fmt.Printf("\tobjRefDelta=%x", objRefDeltaHash)
+	// deltas are resolved from their bases down, so they can be based on
+	// other deltas in any order, or on objects already in the repository
+	// (thin packs)
+	// reference: https://codewords.recurse.com/issues/three/unpacking-git-packfiles#applying-deltas
+	deltas := newProgress(showProgress && stream.deltaCount() > 0, "Resolving deltas", stream.deltaCount())
+	err = resolvePack(stream, spooled.File, packThreads(), loadObject, func(entry *packEntry, content []byte) error {
+		hash := hashObject(true, entry.objType, int64(len(content)), content)
+		if entry.objType == "tree" {
+			warnBadTree(hash, content)
 		}
-
-		fmt.Printf("\tcontent=%q\n", uncompressedBuffer[:actualSize])
-
-		// hash objects and write objects that were read from the pack file
-
-		switch objType {
-		case OBJ_BLOB:
-			hashObject(true, "blob", int64(actualSize), uncompressedBuffer[:actualSize])
-		case OBJ_TREE:
-			hashObject(true, "tree", int64(actualSize), uncompressedBuffer[:actualSize])
-		case OBJ_COMMIT:
-			hashObject(true, "commit", int64(actualSize), uncompressedBuffer[:actualSize])
-		case OBJ_TAG:
-			hashObject(true, "tag", int64(actualSize), uncompressedBuffer[:actualSize])
-		case OBJ_REF_DELTA:
-			savedObjDeltas = append(savedObjDeltas, objDelta{objRefDeltaHash, uncompressedBuffer[:actualSize]})
+		if entry.isDelta() {
+			deltas.increment()
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	deltas.done()
+	return nil
+}
 
-		reader.Discard(int(compressedBytesRead))
-		offset += uint64(lenghtBytesRead + compressedBytesRead)
+func readObject(hash []byte) (objType string, objSize uint64, content []byte) {
+	objType, content, err := loadObject(hash)
+	if err != nil {
+		fatal(err.Error())
 	}
+	return objType, uint64(len(content)), content
+}
 
-	// applying deltas
-	// reference: https://codewords.recurse.com/issues/three/unpacking-git-packfiles#applying-deltas
+var errObjectMissing = errors.New("object not found")
 
-	for _, savedObjDelta := range savedObjDeltas {
-		sourceHash, content := savedObjDelta.source, savedObjDelta.content
-		fmt.Printf("parent=%x\tcontent=%v\n", sourceHash, content)
-
-		i := 0
-		sourceSize := uint64(content[i]) & 0b01111111
-		shift := 7
-		for content[i]&0b10000000 != 0 {
-			i++
-			sourceSize |= uint64(content[i]&0b01111111) << shift
-			shift += 7
-		}
-		fmt.Printf("sourceSize=%d\t", sourceSize)
-		i++
-
-		targetSize := uint64(content[i]) & 0b01111111
-		shift = 7
-		for content[i]&0b10000000 != 0 {
-			i++
-			targetSize |= uint64(content[i]&0b01111111) << shift
-			shift += 7
-		}
-		fmt.Printf("targetSize=%d\n", targetSize)
-		i++
-
-		targetBuffer := make([]byte, targetSize)
-
-		sourceType, readSize, sourceBuffer := readObject(sourceHash)
-		// TODO: are other types allowed here?
-		if sourceSize != readSize {
-			fatal("unexpected source size for delta: got %d - want %d\n", readSize, sourceSize)
-		}
-
-		var sourceIndex, targetIndex uint32
-
-		// iterate on instructions (copy/insert)
-		for i < len(content) {
-			op := content[i] >> 7
-			if op == 1 { // copy operation
-
-				// decode which bytes to read that are non-zero from the copy instruction
-				lengthBitmap := content[i] >> 4 & 0b0000111
-				offsetBitmap := content[i] & 0b00001111
-				i++
-
-				offset, length := uint32(0), uint32(0)
-
-				if offsetBitmap&0b0001 != 0 {
-					offset |= uint32(content[i])
-					i++
-				}
-				if offsetBitmap&0b0010 != 0 {
-					offset |= uint32(content[i]) << 8
-					i++
-				}
-				if offsetBitmap&0b0100 != 0 {
-					offset |= uint32(content[i]) << 16
-					i++
-				}
-				if offsetBitmap&0b1000 != 0 {
-					offset |= uint32(content[i]) << 24
-					i++
-				}
-
-				if lengthBitmap&0b0001 != 0 {
-					length |= uint32(content[i])
-					i++
-				}
-				if lengthBitmap&0b0010 != 0 {
-					length |= uint32(content[i]) << 8
-					i++
-				}
-				if lengthBitmap&0b0100 != 0 {
-					length |= uint32(content[i]) << 16
-					i++
-				}
-
-				sourceIndex = offset
-				fmt.Printf("copying %d:%d into %d:%d\n", sourceIndex, sourceIndex+length, targetIndex, targetIndex+length)
-				copy(targetBuffer[targetIndex:targetIndex+length], sourceBuffer[sourceIndex:sourceIndex+length])
-				targetIndex += length
-			} else { // insert operation
-				length := uint32(content[i]) // length is on the operation itself 0-127
-				i++
-				fmt.Printf("inserting %d bytes into %d:%d\n", length, targetIndex, targetIndex+length)
-				copy(targetBuffer[targetIndex:targetIndex+length], content[i:i+int(length)])
-				targetIndex += length
-				i += int(length)
-			}
-		}
-
-		targetHash := hashObject(true, sourceType, int64(targetSize), targetBuffer)
-		fmt.Printf("delta applied source: %x target: %x\n", sourceHash, targetHash)
+// loadObject reads an object either from its loose file or from a pack.
+func loadObject(hash []byte) (objType string, content []byte, err error) {
+	objType, content, err = readLooseObject(hash)
+	if !errors.Is(err, os.ErrNotExist) {
+		return
 	}
+	if pack, offset, ok := findPackedObject(hash); ok {
+		return pack.readObjectAt(offset)
+	}
+	return "", nil, fmt.Errorf("%w: %x", errObjectMissing, hash)
 }
 
-func bigEndianBytesToUint(b []byte) uint {
-	return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
-}
+// quarantineDir, when set, is where new objects are written instead of the
+// object directory (see receive-pack).
+var quarantineDir string
 
-func readObject(hash []byte) (objType string, objSize uint64, content []byte) {
+func looseObjectPath(hash []byte) string {
+	dir := filepath.Join(gitDir, "objects")
+	if quarantineDir != "" {
+		dir = quarantineDir
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x", hash[:1]), fmt.Sprintf("%x", hash[1:]))
+}
 
-	objPath := filepath.Join(".git", "objects", fmt.Sprintf("%x", hash[:1]), fmt.Sprintf("%x", hash[1:]))
+func readLooseObject(hash []byte) (objType string, content []byte, err error) {
+	objPath := findLooseObject(hash)
 	file, err := os.Open(objPath)
 	if err != nil {
-		fatal(err.Error())
+		return
 	}
 	defer file.Close()
 
 	zipReader, err := zlib.NewReader(file)
 	if err != nil {
-		fatal(err.Error())
+		return "", nil, fmt.Errorf("%s: %w", objPath, err)
 	}
 
 	reader := bufio.NewReader(zipReader)
-	objType, _ = reader.ReadString(' ')
-	objType = objType[:len(objType)-1]
-
-	lengthStr, err := reader.ReadString(0)
-	lengthStr = lengthStr[:len(lengthStr)-1]
+	header, err := reader.ReadString(0)
 	if err != nil {
-		fatal(err.Error())
+		return "", nil, fmt.Errorf("%s: invalid object header: %w", objPath, err)
+	}
+	objType, lengthStr, ok := strings.Cut(header[:len(header)-1], " ")
+	objSize, sizeErr := strconv.ParseUint(lengthStr, 10, 64)
+	if !ok || sizeErr != nil {
+		return "", nil, fmt.Errorf("%s: invalid object header %q", objPath, header)
 	}
-	objSize, _ = strconv.ParseUint(lengthStr, 10, 64)
 
 	content = make([]byte, objSize)
-	_, err = reader.Read(content)
-	if err != nil && err != io.EOF {
-		fatal(err.Error())
+	if _, err = io.ReadFull(reader, content); err != nil {
+		return "", nil, fmt.Errorf("%s: %w", objPath, err)
 	}
-	return
+	return objType, content, nil
+}
+
+// findLooseObject returns the path of a loose object, in the repository or
+// an alternate object directory, or the path it would have in the
+// repository if it's not there.
+func findLooseObject(hash []byte) string {
+	objPath := looseObjectPath(hash)
+	if fileExists(objPath) {
+		return objPath
+	}
+	for _, dir := range objectDirs()[1:] {
+		alternatePath := filepath.Join(dir, fmt.Sprintf("%x", hash[:1]), fmt.Sprintf("%x", hash[1:]))
+		if fileExists(alternatePath) {
+			return alternatePath
+		}
+	}
+	return objPath
+}
+
+func hasObject(hash []byte) bool {
+	if fileExists(findLooseObject(hash)) {
+		return true
+	}
+	_, _, ok := findPackedObject(hash)
+	return ok
 }
 
 func checkoutCommit(head []byte) {
@@ -912,7 +1195,7 @@ func checkoutCommit(head []byte) {
 }
 
 func checkoutTree(tree []byte, path string) {
-	fmt.Printf("dir: %s\n", path)
+	trace("dir: %s", path)
 
 	os.MkdirAll(path, 0755)
 
@@ -951,13 +1234,13 @@ func checkoutTree(tree []byte, path string) {
 		case "040000":
 			checkoutTree(hash, filepath.Join(path, name))
 		default:
-			fmt.Printf("unknown file mode: %s skipping: %s (%x)\n", fileMode, name, hash)
+			fmt.Fprintf(os.Stderr, "warning: unknown file mode: %s skipping: %s (%x)\n", fileMode, name, hash)
 		}
 	}
 }
 
 func checkoutFile(hash []byte, path string) {
-	fmt.Printf("file: %s\n", path)
+	trace("file: %s", path)
 
 	objType, _, content := readObject(hash)
 	if objType != "blob" {
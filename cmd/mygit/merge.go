@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Three-way merge of trees, as git's "resolve" strategy: each path is
+// compared between the merge base and both sides, and files changed on both
+// sides are merged line by line.
+
+type commitInfo struct {
+	tree    []byte
+	parents [][]byte
+	author  string // "<name> <<email>> <timestamp> <timezone>"
+	message string
+}
+
+func readCommit(hash []byte) *commitInfo {
+	objType, _, content := readObject(peelObject(hash, "commit"))
+	if objType != "commit" {
+		fatal("fatal: %x is not a commit\n", hash)
+	}
+	commit := &commitInfo{}
+	headers, message, _ := bytes.Cut(content, []byte("\n\n"))
+	commit.message = string(message)
+	for _, line := range strings.Split(string(headers), "\n") {
+		if value, ok := strings.CutPrefix(line, "tree "); ok {
+			commit.tree, _ = hex.DecodeString(value)
+		} else if value, ok := strings.CutPrefix(line, "parent "); ok {
+			parent, _ := hex.DecodeString(value)
+			commit.parents = append(commit.parents, parent)
+		} else if value, ok := strings.CutPrefix(line, "author "); ok {
+			commit.author = value
+		}
+	}
+	return commit
+}
+
+// commitIdent returns the identity for the author or committer of a new
+// commit, from GIT_<kind>_NAME, GIT_<kind>_EMAIL and GIT_<kind>_DATE or
+// user.name and user.email.
+func commitIdent(kind string) string {
+	name, email := os.Getenv("GIT_"+kind+"_NAME"), os.Getenv("GIT_"+kind+"_EMAIL")
+	if name == "" {
+		name, _ = getConfig("user.name")
+	}
+	if email == "" {
+		email, _ = getConfig("user.email")
+	}
+	if name == "" || email == "" {
+		fatal("fatal: unable to auto-detect email address (please set user.name and user.email)\n")
+	}
+	if date := os.Getenv("GIT_" + kind + "_DATE"); date != "" {
+		return fmt.Sprintf("%s <%s> %s", name, email, strings.TrimPrefix(date, "@"))
+	}
+	now := time.Now()
+	_, tzOffset := now.Zone()
+	timezone := tzOffset/3600*100 + tzOffset/60%60
+	return fmt.Sprintf("%s <%s> %d %+05d", name, email, now.Unix(), timezone)
+}
+
+// writeCommit creates a commit object. An empty author means the committer.
+func writeCommit(tree []byte, parents [][]byte, author, message string) []byte {
+	committer := commitIdent("COMMITTER")
+	if author == "" {
+		author = commitIdent("AUTHOR")
+	}
+	var content strings.Builder
+	fmt.Fprintf(&content, "tree %x\n", tree)
+	for _, parent := range parents {
+		fmt.Fprintf(&content, "parent %x\n", parent)
+	}
+	fmt.Fprintf(&content, "author %s\ncommitter %s\n\n%s", author, committer, message)
+	return hashObject(true, "commit", int64(content.Len()), []byte(content.String()))
+}
+
+// mergeBase finds a best common ancestor of two commits: one that isn't an
+// ancestor of another common ancestor. It returns nil for unrelated
+// histories.
+func mergeBase(a, b []byte) []byte {
+	ancestorsOfA := map[string]bool{}
+	pending := []string{hex.EncodeToString(a)}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if ancestorsOfA[current] {
+			continue
+		}
+		ancestorsOfA[current] = true
+		if commit := loadHaveCommit(current); commit != nil {
+			pending = append(pending, commit.parents...)
+		}
+	}
+
+	// walk from b, stopping at the first common commits found
+	candidates := []*haveCommit{}
+	seen := map[string]bool{}
+	pending = []string{hex.EncodeToString(b)}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+		commit := loadHaveCommit(current)
+		if commit == nil {
+			continue
+		}
+		if ancestorsOfA[current] {
+			candidates = append(candidates, commit)
+			continue
+		}
+		pending = append(pending, commit.parents...)
+	}
+
+	// the most recent candidate that isn't an ancestor of another one
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].time > candidates[j].time })
+	for _, candidate := range candidates {
+		hash, _ := hex.DecodeString(candidate.hash)
+		redundant := false
+		for _, other := range candidates {
+			otherHash, _ := hex.DecodeString(other.hash)
+			if other != candidate && isAncestor(hash, otherHash) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			return hash
+		}
+	}
+	return nil
+}
+
+// flattenTree lists all the files of a tree (blobs, symbolic links and
+// submodules) by path.
+func flattenTree(tree []byte) map[string]*treeEntry {
+	files := map[string]*treeEntry{}
+	if tree != nil {
+		flattenTreeInto(tree, "", files)
+	}
+	return files
+}
+
+func flattenTreeInto(tree []byte, base string, files map[string]*treeEntry) {
+	_, content, err := loadObject(tree)
+	if err != nil {
+		fatal("fatal: unable to read tree %x\n", tree)
+	}
+	entries, err := parseTree(content)
+	if err != nil {
+		fatal("fatal: unable to read tree %x: %s\n", tree, err)
+	}
+	for _, entry := range entries {
+		name := path.Join(base, entry.name)
+		if treeEntryType(entry.mode) == "tree" {
+			flattenTreeInto(entry.hash, name, files)
+		} else {
+			files[name] = entry
+		}
+	}
+}
+
+// buildTree writes the tree objects for a list of files by path, returning
+// the root tree.
+func buildTree(files map[string]*treeEntry) ([]byte, error) {
+	dirs := map[string][]*treeEntry{"": {}}
+	paths := sortedKeys(files)
+	for _, name := range paths {
+		if _, ok := dirs[name]; ok {
+			return nil, fmt.Errorf("CONFLICT (file/directory): %s", name)
+		}
+		// register the parent directories, deepest first
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := files[dir]; ok {
+				return nil, fmt.Errorf("CONFLICT (file/directory): %s", dir)
+			}
+			if _, ok := dirs[dir]; ok {
+				break
+			}
+			dirs[dir] = []*treeEntry{}
+		}
+	}
+	for _, name := range paths {
+		entry := files[name]
+		dir := parentDir(name)
+		dirs[dir] = append(dirs[dir], &treeEntry{name: path.Base(name), mode: entry.mode, hash: entry.hash})
+	}
+
+	// deepest directories first, so subtrees are written before their parent
+	dirNames := sortedKeys(dirs)
+	sort.SliceStable(dirNames, func(i, j int) bool {
+		return strings.Count(dirNames[i], "/") > strings.Count(dirNames[j], "/")
+	})
+	hashes := map[string][]byte{}
+	for _, dir := range dirNames {
+		if dir == "" {
+			continue
+		}
+		content := encodeTree(dirs[dir])
+		hashes[dir] = hashObject(true, "tree", int64(len(content)), content)
+		parent := parentDir(dir)
+		dirs[parent] = append(dirs[parent], &treeEntry{name: path.Base(dir), mode: "40000", hash: hashes[dir]})
+	}
+	content := encodeTree(dirs[""])
+	return hashObject(true, "tree", int64(len(content)), content), nil
+}
+
+// parentDir is the directory of a path, empty at the top.
+func parentDir(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+func sameTreeEntry(a, b *treeEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.mode == b.mode && bytes.Equal(a.hash, b.hash)
+}
+
+// mergeTrees merges the changes from base to theirs into ours, returning
+// the merged tree and the conflicts found, if any (in which case the tree
+// is nil).
+func mergeTrees(base, ours, theirs []byte) ([]byte, []string) {
+	baseFiles, ourFiles, theirFiles := flattenTree(base), flattenTree(ours), flattenTree(theirs)
+	paths := map[string]bool{}
+	for _, files := range []map[string]*treeEntry{baseFiles, ourFiles, theirFiles} {
+		for name := range files {
+			paths[name] = true
+		}
+	}
+
+	merged := map[string]*treeEntry{}
+	conflicts := []string{}
+	for _, name := range sortedKeys(paths) {
+		b, o, t := baseFiles[name], ourFiles[name], theirFiles[name]
+		var result *treeEntry
+		switch {
+		case sameTreeEntry(o, t), sameTreeEntry(b, t):
+			result = o
+		case sameTreeEntry(b, o):
+			result = t
+		case o == nil || t == nil:
+			conflicts = append(conflicts, "CONFLICT (modify/delete): "+name)
+			continue
+		default:
+			entry, err := mergeFileEntries(b, o, t)
+			if err != nil {
+				conflicts = append(conflicts, err.Error()+name)
+				continue
+			}
+			trace("Auto-merging %s", name)
+			result = entry
+		}
+		if result != nil {
+			merged[name] = result
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, conflicts
+	}
+
+	tree, err := buildTree(merged)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	return tree, nil
+}
+
+// mergeFileEntries merges a file changed on both sides. The error is the
+// beginning of the conflict message.
+func mergeFileEntries(base, ours, theirs *treeEntry) (*treeEntry, error) {
+	mode := ours.mode
+	switch {
+	case base != nil && ours.mode == base.mode:
+		mode = theirs.mode
+	case (base == nil || theirs.mode != base.mode) && theirs.mode != ours.mode:
+		return nil, fmt.Errorf("CONFLICT (mode): ")
+	}
+	if treeEntryType(ours.mode) != "blob" || treeEntryType(theirs.mode) != "blob" || ours.mode == "120000" {
+		return nil, fmt.Errorf("CONFLICT (content): Merge conflict in ")
+	}
+
+	var baseContent []byte
+	if base != nil && treeEntryType(base.mode) == "blob" {
+		_, _, baseContent = readObject(base.hash)
+	}
+	_, _, ourContent := readObject(ours.hash)
+	_, _, theirContent := readObject(theirs.hash)
+	merged, ok := mergeFile(baseContent, ourContent, theirContent)
+	if !ok {
+		if base == nil {
+			return nil, fmt.Errorf("CONFLICT (add/add): Merge conflict in ")
+		}
+		return nil, fmt.Errorf("CONFLICT (content): Merge conflict in ")
+	}
+	hash := hashObject(true, "blob", int64(len(merged)), merged)
+	return &treeEntry{mode: mode, hash: hash}, nil
+}
+
+// mergeFile merges two versions of a text file, changed from a common base,
+// with the diff3 algorithm: the regions between lines unchanged in both
+// versions are taken from the side that changed them, and it's a conflict
+// if both did differently.
+func mergeFile(base, ours, theirs []byte) ([]byte, bool) {
+	if isBinaryContent(base) || isBinaryContent(ours) || isBinaryContent(theirs) {
+		return nil, false
+	}
+	baseLines, ourLines, theirLines := splitLines(base), splitLines(ours), splitLines(theirs)
+	ourMatches, ok := matchLines(baseLines, ourLines)
+	if !ok {
+		return nil, false
+	}
+	theirMatches, ok := matchLines(baseLines, theirLines)
+	if !ok {
+		return nil, false
+	}
+
+	var merged []byte
+	i, j, k := 0, 0, 0 // next line of base, ours and theirs
+	for {
+		// next base line kept in both versions, or the end
+		next := i
+		for next < len(baseLines) && (ourMatches[next] < 0 || theirMatches[next] < 0) {
+			next++
+		}
+		nextOurs, nextTheirs := len(ourLines), len(theirLines)
+		if next < len(baseLines) {
+			nextOurs, nextTheirs = ourMatches[next], theirMatches[next]
+		}
+
+		baseChunk, ourChunk, theirChunk := baseLines[i:next], ourLines[j:nextOurs], theirLines[k:nextTheirs]
+		switch {
+		case equalLines(ourChunk, baseChunk), equalLines(ourChunk, theirChunk):
+			merged = appendLines(merged, theirChunk)
+		case equalLines(theirChunk, baseChunk):
+			merged = appendLines(merged, ourChunk)
+		default:
+			return nil, false
+		}
+
+		if next == len(baseLines) {
+			return merged, true
+		}
+		merged = append(merged, baseLines[next]...)
+		i, j, k = next+1, nextOurs+1, nextTheirs+1
+	}
+}
+
+func splitLines(content []byte) [][]byte {
+	lines := [][]byte{}
+	for len(content) > 0 {
+		end := bytes.IndexByte(content, '\n') + 1
+		if end == 0 {
+			end = len(content)
+		}
+		lines = append(lines, content[:end])
+		content = content[end:]
+	}
+	return lines
+}
+
+func equalLines(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func appendLines(content []byte, lines [][]byte) []byte {
+	for _, line := range lines {
+		content = append(content, line...)
+	}
+	return content
+}
+
+// matchLines finds a longest common subsequence of lines, returning for
+// each line of a the index of the matching line of b, or -1. The common
+// prefix and suffix are matched first, so only the changed middle goes
+// through the quadratic search, which gives up when too large.
+func matchLines(a, b [][]byte) ([]int, bool) {
+	matches := make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && bytes.Equal(a[prefix], b[prefix]) {
+		matches[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && bytes.Equal(a[len(a)-1-suffix], b[len(b)-1-suffix]) {
+		matches[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	n, m := len(middleA), len(middleB)
+	if n == 0 || m == 0 {
+		return matches, true
+	}
+	if n*m > 16<<20 {
+		return nil, false
+	}
+
+	// lengths[x][y] is the LCS length of middleA[x:] and middleB[y:]
+	lengths := make([][]uint16, n+1)
+	for x := range lengths {
+		lengths[x] = make([]uint16, m+1)
+	}
+	for x := n - 1; x >= 0; x-- {
+		for y := m - 1; y >= 0; y-- {
+			if bytes.Equal(middleA[x], middleB[y]) {
+				lengths[x][y] = lengths[x+1][y+1] + 1
+			} else if lengths[x+1][y] >= lengths[x][y+1] {
+				lengths[x][y] = lengths[x+1][y]
+			} else {
+				lengths[x][y] = lengths[x][y+1]
+			}
+		}
+	}
+	for x, y := 0, 0; x < n && y < m; {
+		switch {
+		case bytes.Equal(middleA[x], middleB[y]):
+			matches[prefix+x] = prefix + y
+			x++
+			y++
+		case lengths[x+1][y] >= lengths[x][y+1]:
+			x++
+		default:
+			y++
+		}
+	}
+	return matches, true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func gitMakeTree() {
+	var nulTerminated, allowMissing bool
+	for _, arg := range os.Args[2:] {
+		switch arg {
+		case "-z":
+			nulTerminated = true
+		case "--missing":
+			allowMissing = true
+		default:
+			printUsageAndExit("mktree [-z] [--missing]")
+		}
+	}
+
+	delimiter := byte('\n')
+	if nulTerminated {
+		delimiter = 0
+	}
+
+	entries := []*treeEntry{}
+	seen := map[string]bool{}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadString(delimiter)
+		if err != nil && err != io.EOF {
+			fatal(err.Error())
+		}
+		line = strings.TrimSuffix(line, string(delimiter))
+		if line != "" {
+			entry := parseMakeTreeLine(line, nulTerminated, allowMissing)
+			if seen[entry.name] {
+				fatal("fatal: duplicate entry in input: %s\n", entry.name)
+			}
+			seen[entry.name] = true
+			entries = append(entries, entry)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	content := encodeTree(entries)
+	fmt.Printf("%x\n", hashObject(true, "tree", int64(len(content)), content))
+}
+
+// parseMakeTreeLine parses one line of "ls-tree" output:
+// "<mode> SP <type> SP <object> [SP <size>] TAB <path>"
+func parseMakeTreeLine(line string, nulTerminated, allowMissing bool) *treeEntry {
+	info, path, ok := strings.Cut(line, "\t")
+	fields := strings.Fields(info)
+	if !ok || len(fields) < 3 || len(fields) > 4 {
+		fatal("fatal: input format error: %s\n", line)
+	}
+
+	mode, err := canonicalTreeMode(fields[0])
+	if err != nil {
+		fatal("fatal: %s: %s\n", err, line)
+	}
+	objType := fields[1]
+	if objType != treeEntryType(mode) {
+		fatal("fatal: entry '%s' object type (%s) doesn't match mode type (%s)\n", path, objType, treeEntryType(mode))
+	}
+	hash, err := hex.DecodeString(fields[2])
+	if err != nil || len(hash) != 20 {
+		fatal("fatal: input format error: %s\n", line)
+	}
+
+	if !nulTerminated && strings.HasPrefix(path, `"`) {
+		path, err = strconv.Unquote(path)
+		if err != nil {
+			fatal("fatal: invalid quoting: %s\n", line)
+		}
+	}
+	if path == "" || path == "." || path == ".." || strings.Contains(path, "/") {
+		fatal("fatal: path %q contains slash or is not a valid name\n", path)
+	}
+
+	// submodule commits are not expected to exist in this repository
+	if objType != "commit" {
+		if !hasObject(hash) {
+			if !allowMissing {
+				fatal("fatal: entry '%s' object %x is unavailable\n", path, hash)
+			}
+		} else if actualType, _ := getObjTypeAndSize(fields[2]); actualType != objType {
+			fatal("fatal: entry '%s' object %x is a %s but specified type was (%s)\n", path, hash, actualType, objType)
+		}
+	}
+
+	return &treeEntry{name: path, mode: mode, hash: hash}
+}
+
+// canonicalTreeMode normalizes a file mode into one of the modes git stores
+// in trees (100644, 100755, 120000, 40000 or 160000).
+func canonicalTreeMode(mode string) (string, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid mode %q", mode)
+	}
+	switch value & 0170000 {
+	case 0100000:
+		if value&0111 != 0 {
+			return "100755", nil
+		}
+		return "100644", nil
+	case 0040000:
+		return "40000", nil
+	case 0120000:
+		return "120000", nil
+	case 0160000:
+		return "160000", nil
+	}
+	return "", fmt.Errorf("invalid mode %q", mode)
+}
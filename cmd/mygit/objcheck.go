@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Object syntax checks, following the ones done by "git fsck". Each problem
+// has an identifier (e.g. "treeNotSorted") and a severity: errors make an
+// object invalid, warnings only flag unusual content.
+// reference: https://git-scm.com/docs/git-fsck#_fsck_messages
+
+type fsckProblem struct {
+	severity string // "error" or "warning"
+	id       string
+	message  string
+}
+
+func (problem fsckProblem) String() string {
+	return problem.id + ": " + problem.message
+}
+
+// checkObjectFormat checks that an object's content can be parsed as the
+// given type, returning the first error found (warnings are ignored).
+func checkObjectFormat(objType string, content []byte) error {
+	for _, problem := range checkObject(objType, content) {
+		if problem.severity == "error" {
+			return fmt.Errorf("%s", problem)
+		}
+	}
+	return nil
+}
+
+// checkObject returns all the problems found in an object's content.
+func checkObject(objType string, content []byte) []fsckProblem {
+	switch objType {
+	case "blob":
+		return nil
+	case "tree":
+		return checkTree(content)
+	case "commit":
+		return checkCommit(content)
+	case "tag":
+		return checkTag(content)
+	}
+	return []fsckProblem{{"error", "badType", fmt.Sprintf("invalid object type %q", objType)}}
+}
+
+func checkTree(content []byte) []fsckProblem {
+	entries, err := parseTree(content)
+	if err != nil {
+		return []fsckProblem{{"error", "badTree", "cannot be parsed as a tree: " + err.Error()}}
+	}
+
+	// each kind of problem is reported once per tree, like git does
+	found := map[string]bool{}
+	problems := []fsckProblem{}
+	report := func(severity, id, message string) {
+		if !found[id] {
+			found[id] = true
+			problems = append(problems, fsckProblem{severity, id, message})
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, entry := range entries {
+		switch {
+		case entry.name == "":
+			report("warning", "emptyName", "contains empty pathname")
+		case entry.name == ".":
+			report("warning", "hasDot", "contains '.'")
+		case entry.name == "..":
+			report("warning", "hasDotdot", "contains '..'")
+		case strings.EqualFold(entry.name, ".git"):
+			report("warning", "hasDotgit", "contains '.git'")
+		case strings.Contains(entry.name, "/"):
+			report("warning", "fullPathname", "contains full pathnames")
+		}
+
+		if strings.HasPrefix(entry.mode, "0") {
+			report("warning", "zeroPaddedFilemode", "contains zero-padded file modes")
+		}
+		switch strings.TrimLeft(entry.mode, "0") {
+		case "100644", "100755", "120000", "40000", "160000":
+		default:
+			report("warning", "badFilemode", "contains bad file modes")
+		}
+
+		if seen[entry.name] {
+			report("error", "duplicateEntries", "contains duplicate file entries")
+		}
+		seen[entry.name] = true
+		if i > 0 && compareTreeEntries(entries[i-1], entry) > 0 {
+			report("error", "treeNotSorted", "not properly sorted")
+		}
+	}
+	return problems
+}
+
+// objectHeaders splits the header lines of a commit or tag (everything
+// before the first empty line).
+func objectHeaders(content []byte) []string {
+	headers, _, _ := bytes.Cut(content, []byte("\n\n"))
+	return strings.Split(string(headers), "\n")
+}
+
+func checkCommit(content []byte) []fsckProblem {
+	lines := objectHeaders(content)
+
+	value, ok := strings.CutPrefix(lines[0], "tree ")
+	if !ok {
+		return []fsckProblem{{"error", "missingTree", "invalid format - expected 'tree' line"}}
+	}
+	if !isHexHash([]byte(value)) {
+		return []fsckProblem{{"error", "badTreeSha1", "invalid 'tree' line format - bad sha1"}}
+	}
+	lines = lines[1:]
+
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "parent ") {
+		if !isHexHash([]byte(lines[0][len("parent "):])) {
+			return []fsckProblem{{"error", "badParentSha1", "invalid 'parent' line format - bad sha1"}}
+		}
+		lines = lines[1:]
+	}
+
+	authors := 0
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "author ") {
+		if problem := checkIdent(lines[0][len("author "):]); problem != nil {
+			return []fsckProblem{*problem}
+		}
+		authors++
+		lines = lines[1:]
+	}
+	if authors == 0 {
+		return []fsckProblem{{"error", "missingAuthor", "invalid format - expected 'author' line"}}
+	}
+	if authors > 1 {
+		return []fsckProblem{{"error", "multipleAuthors", "invalid format - multiple 'author' lines"}}
+	}
+
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "committer ") {
+		return []fsckProblem{{"error", "missingCommitter", "invalid format - expected 'committer' line"}}
+	}
+	if problem := checkIdent(lines[0][len("committer "):]); problem != nil {
+		return []fsckProblem{*problem}
+	}
+	return nil
+}
+
+func checkTag(content []byte) []fsckProblem {
+	lines := objectHeaders(content)
+
+	value, ok := strings.CutPrefix(lines[0], "object ")
+	if !ok {
+		return []fsckProblem{{"error", "missingObject", "invalid format - expected 'object' line"}}
+	}
+	if !isHexHash([]byte(value)) {
+		return []fsckProblem{{"error", "badObjectSha1", "invalid 'object' line format - bad sha1"}}
+	}
+
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], "type ") {
+		return []fsckProblem{{"error", "missingTypeEntry", "invalid format - expected 'type' line"}}
+	}
+	if !isKnownObjectType(lines[1][len("type "):]) {
+		return []fsckProblem{{"error", "badType", "invalid 'type' value"}}
+	}
+
+	if len(lines) < 3 || !strings.HasPrefix(lines[2], "tag ") {
+		return []fsckProblem{{"error", "missingTagEntry", "invalid format - expected 'tag' line"}}
+	}
+	problems := []fsckProblem{}
+	if name := lines[2][len("tag "):]; name == "" || strings.ContainsAny(name, " ~^:?*[\\") {
+		problems = append(problems, fsckProblem{"warning", "badTagName", fmt.Sprintf("invalid 'tag' name: %s", name)})
+	}
+
+	if len(lines) < 4 || !strings.HasPrefix(lines[3], "tagger ") {
+		problems = append(problems, fsckProblem{"warning", "missingTaggerEntry", "invalid format - expected 'tagger' line"})
+	} else if problem := checkIdent(lines[3][len("tagger "):]); problem != nil {
+		problems = append(problems, *problem)
+	}
+	return problems
+}
+
+// checkIdent validates an author/committer/tagger value:
+// "Name <email> <timestamp> <+-hhmm>"
+func checkIdent(ident string) *fsckProblem {
+	bad := func(id, message string) *fsckProblem {
+		return &fsckProblem{"error", id, "invalid author/committer line - " + message}
+	}
+
+	if strings.HasPrefix(ident, "<") {
+		return bad("missingNameBeforeEmail", "missing space before email")
+	}
+	start := strings.IndexAny(ident, "<>")
+	if start < 0 {
+		return bad("missingEmail", "missing email")
+	}
+	if ident[start] == '>' {
+		return bad("badName", "bad name")
+	}
+	if ident[start-1] != ' ' {
+		return bad("missingSpaceBeforeEmail", "missing space before email")
+	}
+	rest := ident[start+1:]
+	end := strings.IndexAny(rest, "<>")
+	if end < 0 || rest[end] != '>' {
+		return bad("badEmail", "bad email")
+	}
+	rest = rest[end+1:]
+
+	rest, ok := strings.CutPrefix(rest, " ")
+	if !ok {
+		return bad("missingSpaceBeforeDate", "missing space before date")
+	}
+	date, timezone, ok := strings.Cut(rest, " ")
+	if len(date) > 1 && date[0] == '0' {
+		return bad("zeroPaddedDate", "zero-padded date")
+	}
+	if date == "" || strings.Trim(date, "0123456789") != "" || !ok {
+		return bad("badDate", "bad date")
+	}
+	if _, err := strconv.ParseInt(date, 10, 64); err != nil {
+		return bad("badDateOverflow", "date causes integer overflow")
+	}
+	if len(timezone) != 5 || (timezone[0] != '+' && timezone[0] != '-') || strings.Trim(timezone[1:], "0123456789") != "" {
+		return bad("badTimezone", "bad time zone")
+	}
+	return nil
+}
+
+func isHexHash(b []byte) bool {
+	if len(b) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(string(b))
+	return err == nil && strings.ToLower(string(b)) == string(b)
+}
+
+// warnBadTree reports trees received from a remote that don't follow git's
+// canonical format, like unsorted or duplicate entries.
+func warnBadTree(hash []byte, content []byte) {
+	for _, problem := range checkTree(content) {
+		if problem.severity == "error" {
+			fmt.Fprintf(os.Stderr, "warning: object %x: %s\n", hash, problem)
+		}
+	}
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Creation of pack files, with objects stored as deltas against similar
+// objects when that saves space.
+// reference: https://git-scm.com/docs/pack-format
+// reference: https://git-scm.com/docs/pack-heuristics
+
+type packObject struct {
+	hash     []byte
+	objType  string
+	content  []byte
+	nameHash uint32 // derived from the path the object was found at
+
+	base  *packObject // delta base, if stored as a delta
+	delta []byte
+	depth int // length of the delta chain up to this object
+
+	written bool
+	offset  int64 // position in the pack, once written
+	crc     uint32
+}
+
+type packOptions struct {
+	window   int  // how many previous objects are tried as delta bases
+	depth    int  // maximum length of delta chains
+	ofsDelta bool // refer to bases by offset (OBJ_OFS_DELTA) instead of by name
+	quiet    bool
+}
+
+var defaultPackOptions = packOptions{window: 10, depth: 50}
+
+func gitPackObjects() {
+	usage := "pack-objects [-q] [--stdout] [--window=<n>] [--depth=<n>] [--delta-base-offset] [--revs] [--all] [<base-name>] < <object-list>"
+
+	opts := defaultPackOptions
+	var toStdout, revs, all bool
+	var baseName string
+	for _, arg := range os.Args[2:] {
+		switch {
+		case arg == "-q":
+			opts.quiet = true
+		case arg == "--stdout":
+			toStdout = true
+		case arg == "--delta-base-offset":
+			opts.ofsDelta = true
+		case arg == "--revs":
+			revs = true
+		case arg == "--all":
+			all = true
+		case strings.HasPrefix(arg, "--window="):
+			opts.window = parseIntOption(arg, usage)
+		case strings.HasPrefix(arg, "--depth="):
+			opts.depth = parseIntOption(arg, usage)
+		case strings.HasPrefix(arg, "-"):
+			printUsageAndExit(usage)
+		case baseName == "":
+			baseName = arg
+		default:
+			printUsageAndExit(usage)
+		}
+	}
+	if toStdout == (baseName != "") {
+		printUsageAndExit(usage)
+	}
+
+	var objects []*packObject
+	scanner := bufio.NewScanner(os.Stdin)
+	if revs {
+		// revisions to include, or to exclude when prefixed with "^"
+		include, exclude := [][]byte{}, [][]byte{}
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			if name, ok := strings.CutPrefix(line, "^"); ok {
+				exclude = append(exclude, resolveRevision(name))
+			} else {
+				include = append(include, resolveRevision(line))
+			}
+		}
+		if all {
+			for _, value := range listRefs() {
+				if hash, err := hex.DecodeString(value); err == nil {
+					include = append(include, hash)
+				}
+			}
+		}
+		objects = collectObjects(include, exclude)
+	} else {
+		seen := map[string]bool{}
+		for scanner.Scan() {
+			objName, path, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+			if objName == "" || seen[objName] {
+				continue
+			}
+			seen[objName] = true
+			hash, err := hex.DecodeString(objName)
+			if err != nil || len(hash) != 20 {
+				fatal("fatal: expected object ID, got garbage:\n %s\n", objName)
+			}
+			objects = append(objects, loadPackObject(hash, path))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fatal(err.Error())
+	}
+
+	if toStdout {
+		writer := bufio.NewWriter(os.Stdout)
+		if _, err := writePack(writer, objects, opts); err != nil {
+			fatal(err.Error())
+		}
+		if err := writer.Flush(); err != nil {
+			fatal(err.Error())
+		}
+		return
+	}
+
+	checksum := writePackFiles(baseName, objects, opts)
+	fmt.Printf("%x\n", checksum)
+}
+
+func parseIntOption(arg, usage string) int {
+	_, value, _ := strings.Cut(arg, "=")
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		printUsageAndExit(usage)
+	}
+	return number
+}
+
+func loadPackObject(hash []byte, path string) *packObject {
+	objType, _, content := readObject(hash)
+	return &packObject{hash: hash, objType: objType, content: content, nameHash: packNameHash(path)}
+}
+
+// collectObjects lists all objects reachable from the tips that are not
+// reachable from the excluded commits, with commits first, then tags,
+// trees and blobs, as git orders them.
+func collectObjects(tips, exclude [][]byte) []*packObject {
+	excluded := walkObjects(hashesToLinks(exclude), nil)
+
+	seen := map[string]bool{}
+	byType := map[string][]*packObject{}
+
+	type pending struct {
+		hash []byte
+		path string
+	}
+	queue := []pending{}
+	for _, tip := range tips {
+		queue = append(queue, pending{hash: tip})
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		objName := hex.EncodeToString(current.hash)
+		if _, ok := excluded[objName]; ok || seen[objName] {
+			continue
+		}
+		seen[objName] = true
+
+		object := loadPackObject(current.hash, current.path)
+		byType[object.objType] = append(byType[object.objType], object)
+
+		if object.objType == "tree" {
+			entries, _ := parseTree(object.content)
+			for _, entry := range entries {
+				if treeEntryType(entry.mode) != "commit" {
+					queue = append(queue, pending{entry.hash, pathJoin(current.path, entry.name)})
+				}
+			}
+			continue
+		}
+		for _, link := range objectLinks(object.objType, object.content) {
+			queue = append(queue, pending{hash: link.hash})
+		}
+	}
+
+	objects := []*packObject{}
+	for _, objType := range []string{"commit", "tag", "tree", "blob"} {
+		objects = append(objects, byType[objType]...)
+	}
+	return objects
+}
+
+func hashesToLinks(hashes [][]byte) []objectLink {
+	links := []objectLink{}
+	for _, hash := range hashes {
+		links = append(links, objectLink{hash: hash})
+	}
+	return links
+}
+
+func pathJoin(base, name string) string {
+	if base == "" {
+		return name
+	}
+	return base + "/" + name
+}
+
+// packNameHash is git's hash of a path used to sort delta candidates: it
+// mostly depends on the last characters, so files with the same name or
+// extension end up close to each other.
+func packNameHash(path string) uint32 {
+	hash := uint32(0)
+	for _, c := range []byte(path) {
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			continue
+		}
+		hash = (hash >> 2) + (uint32(c) << 24)
+	}
+	return hash
+}
+
+// findDeltas chooses a delta base for each object, trying the previous
+// objects of a sliding window over the candidates sorted by type, name
+// and decreasing size.
+func findDeltas(objects []*packObject, opts packOptions) {
+	if opts.window == 0 || opts.depth == 0 {
+		return
+	}
+
+	candidates := []*packObject{}
+	for _, object := range objects {
+		if len(object.content) >= 50 {
+			candidates = append(candidates, object)
+		}
+	}
+	typeOrder := map[string]int{"commit": 0, "tree": 1, "blob": 2, "tag": 3}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.objType != b.objType {
+			return typeOrder[a.objType] < typeOrder[b.objType]
+		}
+		if a.nameHash != b.nameHash {
+			return a.nameHash < b.nameHash
+		}
+		return len(a.content) > len(b.content)
+	})
+
+	indexes := map[*packObject]*deltaIndex{}
+	for i, target := range candidates {
+		var bestBase *packObject
+		var bestDelta []byte
+		for j := i - 1; j >= 0 && j >= i-opts.window; j-- {
+			base := candidates[j]
+			if base.objType != target.objType {
+				break
+			}
+			if base.depth >= opts.depth || len(target.content) < len(base.content)/32 {
+				continue
+			}
+			maxSize := len(target.content)/2 - 20
+			if bestDelta != nil {
+				maxSize = len(bestDelta) - 1
+			}
+			if maxSize <= 0 {
+				continue
+			}
+			if indexes[base] == nil {
+				indexes[base] = newDeltaIndex(base.content)
+			}
+			if delta := createDelta(indexes[base], target.content, maxSize); delta != nil {
+				bestBase, bestDelta = base, delta
+			}
+		}
+		if bestBase != nil {
+			target.base, target.delta, target.depth = bestBase, bestDelta, bestBase.depth+1
+		}
+		if i-opts.window >= 0 {
+			delete(indexes, candidates[i-opts.window])
+		}
+	}
+}
+
+// writePack writes a pack with the objects, computing deltas first, and
+// returns the pack checksum (its trailer).
+func writePack(w io.Writer, objects []*packObject, opts packOptions) ([]byte, error) {
+	findDeltas(objects, opts)
+
+	checksum := sha1.New()
+	out := &countingWriter{writer: io.MultiWriter(w, checksum)}
+
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(objects)))
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+
+	inPack := map[*packObject]bool{}
+	for _, object := range objects {
+		inPack[object] = true
+	}
+
+	deltas := 0
+	var writeObject func(object *packObject) error
+	writeObject = func(object *packObject) error {
+		if object.written {
+			return nil
+		}
+		// bases must come first, so they can be referred by offset
+		if object.base != nil && inPack[object.base] {
+			if err := writeObject(object.base); err != nil {
+				return err
+			}
+		}
+		object.written = true
+		object.offset = out.count
+		entry := encodePackEntry(object, opts.ofsDelta)
+		object.crc = crc32.ChecksumIEEE(entry)
+		if object.base != nil {
+			deltas++
+		}
+		_, err := out.Write(entry)
+		return err
+	}
+	for _, object := range objects {
+		if err := writeObject(object); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := checksum.Sum(nil)
+	if _, err := w.Write(sum); err != nil {
+		return nil, err
+	}
+	if !opts.quiet {
+		fmt.Fprintf(os.Stderr, "Total %d (delta %d), reused 0 (delta 0), pack-reused 0\n", len(objects), deltas)
+	}
+	return sum, nil
+}
+
+// encodePackEntry returns the header and the compressed data of an entry.
+func encodePackEntry(object *packObject, ofsDelta bool) []byte {
+	objType, data := packTypeCodes[object.objType], object.content
+	if object.base != nil {
+		data = object.delta
+		if ofsDelta && object.base.written {
+			objType = OBJ_OFS_DELTA
+		} else {
+			objType = OBJ_REF_DELTA
+		}
+	}
+
+	entry := []byte{}
+	size := uint64(len(data))
+	value := byte(objType<<4) | byte(size&0b1111)
+	size >>= 4
+	for size != 0 {
+		entry = append(entry, value|0b10000000)
+		value = byte(size & 0b01111111)
+		size >>= 7
+	}
+	entry = append(entry, value)
+
+	switch objType {
+	case OBJ_OFS_DELTA:
+		distance := object.offset - object.base.offset
+		encoded := []byte{byte(distance & 0b01111111)}
+		for distance >>= 7; distance != 0; distance >>= 7 {
+			distance--
+			encoded = append([]byte{byte(distance&0b01111111) | 0b10000000}, encoded...)
+		}
+		entry = append(entry, encoded...)
+	case OBJ_REF_DELTA:
+		entry = append(entry, object.base.hash...)
+	}
+
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	writer.Write(data)
+	writer.Close()
+	return append(entry, compressed.Bytes()...)
+}
+
+var packTypeCodes = map[string]int{
+	"commit": OBJ_COMMIT,
+	"tree":   OBJ_TREE,
+	"blob":   OBJ_BLOB,
+	"tag":    OBJ_TAG,
+}
+
+// writePackIndex writes a version 2 index for the (already written)
+// objects of a pack.
+func writePackIndex(w io.Writer, objects []*packObject, packChecksum []byte) error {
+	sorted := append([]*packObject{}, objects...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].hash, sorted[j].hash) < 0
+	})
+
+	checksum := sha1.New()
+	out := bufio.NewWriter(io.MultiWriter(w, checksum))
+	out.Write([]byte("\377tOc"))
+	binary.Write(out, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, object := range sorted {
+		fanout[object.hash[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(out, binary.BigEndian, fanout)
+
+	for _, object := range sorted {
+		out.Write(object.hash)
+	}
+	for _, object := range sorted {
+		binary.Write(out, binary.BigEndian, object.crc)
+	}
+	largeOffsets := []uint64{}
+	for _, object := range sorted {
+		if object.offset < 0x80000000 {
+			binary.Write(out, binary.BigEndian, uint32(object.offset))
+		} else {
+			binary.Write(out, binary.BigEndian, uint32(0x80000000|len(largeOffsets)))
+			largeOffsets = append(largeOffsets, uint64(object.offset))
+		}
+	}
+	binary.Write(out, binary.BigEndian, largeOffsets)
+	out.Write(packChecksum)
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(checksum.Sum(nil))
+	return err
+}
+
+// writePackFiles writes "<baseName>-<checksum>.pack" and its ".idx",
+// returning the pack checksum.
+func writePackFiles(baseName string, objects []*packObject, opts packOptions) []byte {
+	dir := filepath.Dir(baseName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fatal(err.Error())
+	}
+
+	packFile, err := os.CreateTemp(dir, "tmp_pack_")
+	if err != nil {
+		fatal(err.Error())
+	}
+	defer os.Remove(packFile.Name())
+	writer := bufio.NewWriter(packFile)
+	checksum, err := writePack(writer, objects, opts)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = packFile.Close()
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	indexFile, err := os.CreateTemp(dir, "tmp_idx_")
+	if err != nil {
+		fatal(err.Error())
+	}
+	defer os.Remove(indexFile.Name())
+	err = writePackIndex(indexFile, objects, checksum)
+	if err == nil {
+		err = indexFile.Close()
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	finalName := fmt.Sprintf("%s-%x", baseName, checksum)
+	for _, file := range []struct{ from, to string }{
+		{packFile.Name(), finalName + ".pack"},
+		{indexFile.Name(), finalName + ".idx"},
+	} {
+		os.Chmod(file.from, 0444)
+		if err := os.Rename(file.from, file.to); err != nil {
+			fatal(err.Error())
+		}
+	}
+	return checksum
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// Delta encoding: the source is indexed in blocks of 16 bytes, and the
+// target is scanned looking for blocks that exist in the source, which
+// are extended as much as possible and turned into copy instructions.
+// Everything else is sent as insert instructions.
+
+const deltaBlockSize = 16
+const maxCopySize = 0x10000
+
+type deltaIndex struct {
+	source []byte
+	blocks map[uint32][]int
+}
+
+func newDeltaIndex(source []byte) *deltaIndex {
+	index := &deltaIndex{source: source, blocks: map[uint32][]int{}}
+	for i := 0; i+deltaBlockSize <= len(source); i += deltaBlockSize {
+		hash := deltaBlockHash(source[i : i+deltaBlockSize])
+		// limit the candidates of very repetitive content
+		if len(index.blocks[hash]) < 64 {
+			index.blocks[hash] = append(index.blocks[hash], i)
+		}
+	}
+	return index
+}
+
+func deltaBlockHash(block []byte) uint32 {
+	hash := uint32(2166136261)
+	for _, c := range block {
+		hash = (hash ^ uint32(c)) * 16777619
+	}
+	return hash
+}
+
+// createDelta returns the delta that rebuilds target from the indexed
+// source, or nil if it would be bigger than maxSize.
+func createDelta(index *deltaIndex, target []byte, maxSize int) []byte {
+	source := index.source
+	delta := appendDeltaSize(nil, len(source))
+	delta = appendDeltaSize(delta, len(target))
+
+	insertStart := 0
+	flushInsert := func(end int) {
+		for insertStart < end {
+			length := end - insertStart
+			if length > 127 {
+				length = 127
+			}
+			delta = append(delta, byte(length))
+			delta = append(delta, target[insertStart:insertStart+length]...)
+			insertStart += length
+		}
+	}
+
+	i := 0
+	for i+deltaBlockSize <= len(target) {
+		bestOffset, bestLength := 0, 0
+		for _, offset := range index.blocks[deltaBlockHash(target[i:i+deltaBlockSize])] {
+			length := 0
+			for offset+length < len(source) && i+length < len(target) && source[offset+length] == target[i+length] {
+				length++
+			}
+			if length > bestLength {
+				bestOffset, bestLength = offset, length
+			}
+		}
+		if bestLength < deltaBlockSize {
+			i++
+			continue
+		}
+
+		// the match may also extend backwards over data not sent yet
+		for bestOffset > 0 && i > insertStart && source[bestOffset-1] == target[i-1] {
+			bestOffset--
+			bestLength++
+			i--
+		}
+
+		flushInsert(i)
+		for copied := 0; copied < bestLength; {
+			length := bestLength - copied
+			if length > maxCopySize {
+				length = maxCopySize
+			}
+			delta = appendCopyInstruction(delta, bestOffset+copied, length)
+			copied += length
+		}
+		i += bestLength
+		insertStart = i
+
+		if len(delta) > maxSize {
+			return nil
+		}
+	}
+	flushInsert(len(target))
+
+	if len(delta) > maxSize {
+		return nil
+	}
+	return delta
+}
+
+func appendDeltaSize(delta []byte, size int) []byte {
+	for size >= 0b10000000 {
+		delta = append(delta, byte(size&0b01111111)|0b10000000)
+		size >>= 7
+	}
+	return append(delta, byte(size))
+}
+
+func appendCopyInstruction(delta []byte, offset, length int) []byte {
+	op := byte(0b10000000)
+	args := []byte{}
+	for i := 0; i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			op |= 1 << i
+			args = append(args, b)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if b := byte(length >> (8 * i)); b != 0 {
+			op |= 0b00010000 << i
+			args = append(args, b)
+		}
+	}
+	return append(append(delta, op), args...)
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Read access to objects stored in pack files (.git/objects/pack), located
+// through their version 2 .idx files.
+// reference: https://git-scm.com/docs/pack-format
+
+var packTypeNames = map[int]string{
+	OBJ_COMMIT: "commit",
+	OBJ_TREE:   "tree",
+	OBJ_BLOB:   "blob",
+	OBJ_TAG:    "tag",
+}
+
+type packFile struct {
+	path  string // path to the .pack file
+	file  *os.File
+	index *packIndex
+}
+
+type packIndex struct {
+	fanout       [256]uint32
+	names        []byte // sorted object names, 20 bytes each
+	crcs         []byte
+	offsets      []byte
+	largeOffsets []byte
+	packChecksum []byte
+	checksum     []byte
+}
+
+var loadedPacks []*packFile
+var packsLoaded bool
+var loadedObjectDirs []string
+
+// getPacks opens (once) all the packs in the repository, and the ones of
+// alternate object directories.
+func getPacks() []*packFile {
+	if packsLoaded {
+		return loadedPacks
+	}
+	packsLoaded = true
+
+	for _, dir := range objectDirs() {
+		indexes, _ := filepath.Glob(filepath.Join(dir, "pack", "pack-*.idx"))
+		sort.Strings(indexes)
+		for _, indexPath := range indexes {
+			pack, err := openPack(strings.TrimSuffix(indexPath, ".idx") + ".pack")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: ignoring pack %s: %s\n", indexPath, err)
+				continue
+			}
+			loadedPacks = append(loadedPacks, pack)
+		}
+	}
+	return loadedPacks
+}
+
+// reloadPacks forgets about the open packs and alternates, so packs that
+// were added or removed are seen by the next lookup.
+func reloadPacks() {
+	for _, pack := range loadedPacks {
+		pack.file.Close()
+	}
+	loadedPacks, packsLoaded, loadedObjectDirs = nil, false, nil
+}
+
+// objectDirs returns the object directory of the repository, followed by
+// the alternates it borrows objects from: the directories listed in
+// objects/info/alternates (relative to the object directory), recursively.
+// A quarantine directory comes first.
+// reference: https://git-scm.com/docs/gitrepository-layout#Documentation/gitrepository-layout.txt-objectsinfoalternates
+func objectDirs() []string {
+	if loadedObjectDirs != nil {
+		return loadedObjectDirs
+	}
+	loadedObjectDirs = []string{filepath.Join(gitDir, "objects")}
+	for i := 0; i < len(loadedObjectDirs) && i < 5; i++ {
+		content, err := os.ReadFile(filepath.Join(loadedObjectDirs[i], "info", "alternates"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			dir := strings.TrimSpace(line)
+			if dir == "" || dir[0] == '#' {
+				continue
+			}
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(loadedObjectDirs[i], dir)
+			}
+			if !slices.Contains(loadedObjectDirs, dir) {
+				loadedObjectDirs = append(loadedObjectDirs, dir)
+			}
+		}
+	}
+	if quarantineDir != "" {
+		loadedObjectDirs = append([]string{quarantineDir}, loadedObjectDirs...)
+	}
+	return loadedObjectDirs
+}
+
+func openPack(packPath string) (*packFile, error) {
+	indexContent, err := os.ReadFile(strings.TrimSuffix(packPath, ".pack") + ".idx")
+	if err != nil {
+		return nil, err
+	}
+	index, err := parsePackIndex(indexContent)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(packPath)
+	if err != nil {
+		return nil, err
+	}
+	return &packFile{path: packPath, file: file, index: index}, nil
+}
+
+func parsePackIndex(content []byte) (*packIndex, error) {
+	if len(content) < 8+256*4+40 || !bytes.Equal(content[:4], []byte("\377tOc")) {
+		return nil, errors.New("unsupported pack index (only version 2 is supported)")
+	}
+	if version := binary.BigEndian.Uint32(content[4:8]); version != 2 {
+		return nil, fmt.Errorf("unsupported pack index version %d", version)
+	}
+
+	index := &packIndex{}
+	for i := 0; i < 256; i++ {
+		index.fanout[i] = binary.BigEndian.Uint32(content[8+i*4:])
+	}
+	count := int(index.fanout[255])
+
+	pos := 8 + 256*4
+	if len(content) < pos+count*(20+4+4)+40 {
+		return nil, errors.New("pack index is truncated")
+	}
+	index.names = content[pos : pos+count*20]
+	pos += count * 20
+	index.crcs = content[pos : pos+count*4]
+	pos += count * 4
+	index.offsets = content[pos : pos+count*4]
+	pos += count * 4
+	index.largeOffsets = content[pos : len(content)-40]
+	index.packChecksum = content[len(content)-40 : len(content)-20]
+	index.checksum = content[len(content)-20:]
+	return index, nil
+}
+
+func (index *packIndex) count() int {
+	return int(index.fanout[255])
+}
+
+func (index *packIndex) name(i int) []byte {
+	return index.names[i*20 : i*20+20]
+}
+
+func (index *packIndex) crc(i int) uint32 {
+	return binary.BigEndian.Uint32(index.crcs[i*4:])
+}
+
+func (index *packIndex) offset(i int) int64 {
+	offset := binary.BigEndian.Uint32(index.offsets[i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset)
+	}
+	large := int(offset&0x7fffffff) * 8
+	return int64(binary.BigEndian.Uint64(index.largeOffsets[large:]))
+}
+
+// findPrefix returns the range of positions of the names starting with a
+// (lowercase) hex prefix.
+func (index *packIndex) findPrefix(prefix string) (int, int) {
+	if len(prefix) > 40 {
+		return 0, 0
+	}
+	low, err := hex.DecodeString(prefix + strings.Repeat("0", 40-len(prefix)))
+	if err != nil {
+		return 0, 0
+	}
+	start := sort.Search(index.count(), func(i int) bool {
+		return bytes.Compare(index.name(i), low) >= 0
+	})
+	end := start
+	for end < index.count() && strings.HasPrefix(hex.EncodeToString(index.name(end)), prefix) {
+		end++
+	}
+	return start, end
+}
+
+// find returns the position of the hash in the index, or -1.
+func (index *packIndex) find(hash []byte) int {
+	low := 0
+	if hash[0] > 0 {
+		low = int(index.fanout[hash[0]-1])
+	}
+	high := int(index.fanout[hash[0]])
+	for low < high {
+		mid := (low + high) / 2
+		switch bytes.Compare(index.name(mid), hash) {
+		case 0:
+			return mid
+		case -1:
+			low = mid + 1
+		default:
+			high = mid
+		}
+	}
+	return -1
+}
+
+// findPackedObject looks for an object in all packs.
+func findPackedObject(hash []byte) (*packFile, int64, bool) {
+	for _, pack := range getPacks() {
+		if i := pack.index.find(hash); i >= 0 {
+			return pack, pack.index.offset(i), true
+		}
+	}
+	return nil, 0, false
+}
+
+// packEntryHeader is the decoded header of an entry in a pack file.
+type packEntryHeader struct {
+	objType    int
+	size       uint64
+	baseOffset int64  // for OBJ_OFS_DELTA
+	baseHash   []byte // for OBJ_REF_DELTA
+	dataOffset int64  // where the compressed data starts
+}
+
+func (pack *packFile) readEntryHeader(offset int64) (*packEntryHeader, error) {
+	return parseEntryHeader(bufio.NewReaderSize(io.NewSectionReader(pack.file, offset, 32), 32), offset)
+}
+
+// parseEntryHeader decodes the header of the entry at the given offset:
+// type and size, followed by the base of deltas.
+func parseEntryHeader(reader io.ByteReader, offset int64) (*packEntryHeader, error) {
+	header := &packEntryHeader{}
+
+	value, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	headerLength := int64(1)
+	header.objType = int(value>>4) & 0b0111
+	header.size = uint64(value & 0b1111)
+	for shift := 4; value&0b10000000 != 0; shift += 7 {
+		if value, err = reader.ReadByte(); err != nil {
+			return nil, err
+		}
+		if shift > 57 {
+			return nil, fmt.Errorf("object size too large at offset %d", offset)
+		}
+		headerLength++
+		header.size |= uint64(value&0b01111111) << shift
+	}
+
+	switch header.objType {
+	case OBJ_OFS_DELTA:
+		value, err = reader.ReadByte()
+		headerLength++
+		distance := int64(value & 0b01111111)
+		for err == nil && value&0b10000000 != 0 {
+			value, err = reader.ReadByte()
+			headerLength++
+			distance = ((distance + 1) << 7) | int64(value&0b01111111)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if distance <= 0 || distance > offset {
+			return nil, fmt.Errorf("invalid delta base offset at %d", offset)
+		}
+		header.baseOffset = offset - distance
+	case OBJ_REF_DELTA:
+		header.baseHash = make([]byte, 20)
+		for i := range header.baseHash {
+			if header.baseHash[i], err = reader.ReadByte(); err != nil {
+				return nil, err
+			}
+		}
+		headerLength += 20
+	case OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG:
+	default:
+		return nil, fmt.Errorf("invalid object type %d at offset %d", header.objType, offset)
+	}
+
+	header.dataOffset = offset + headerLength
+	return header, nil
+}
+
+// inflateEntry decompresses the data of a pack entry, which must match the
+// size in its header.
+func (pack *packFile) inflateEntry(header *packEntryHeader) ([]byte, error) {
+	zreader, err := zlib.NewReader(bufio.NewReader(io.NewSectionReader(pack.file, header.dataOffset, 1<<62)))
+	if err != nil {
+		return nil, err
+	}
+	defer zreader.Close()
+
+	content := make([]byte, header.size)
+	if _, err = io.ReadFull(zreader, content); err != nil {
+		return nil, fmt.Errorf("inflate of entry at %d failed: %w", header.dataOffset, err)
+	}
+	return content, nil
+}
+
+// readObjectAt returns the type and content of the entry at the offset,
+// resolving deltas against their bases.
+func (pack *packFile) readObjectAt(offset int64) (string, []byte, error) {
+	return pack.readObjectAtDepth(offset, 0)
+}
+
+func (pack *packFile) readObjectAtDepth(offset int64, depth int) (string, []byte, error) {
+	if depth > 10000 {
+		return "", nil, fmt.Errorf("delta chain too deep at offset %d", offset)
+	}
+	if cached, ok := cachedDeltaBase(packCacheKey{pack, offset}); ok {
+		return cached.objType, cached.content, nil
+	}
+
+	header, err := pack.readEntryHeader(offset)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := pack.inflateEntry(header)
+	if err != nil {
+		return "", nil, err
+	}
+	if header.objType != OBJ_OFS_DELTA && header.objType != OBJ_REF_DELTA {
+		return packTypeNames[header.objType], data, nil
+	}
+
+	var baseType string
+	var base []byte
+	if header.objType == OBJ_OFS_DELTA {
+		baseType, base, err = pack.readObjectAtDepth(header.baseOffset, depth+1)
+	} else if i := pack.index.find(header.baseHash); i >= 0 {
+		baseType, base, err = pack.readObjectAtDepth(pack.index.offset(i), depth+1)
+	} else {
+		baseType, base, err = loadObject(header.baseHash)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	content, err := applyDelta(base, data)
+	if err != nil {
+		return "", nil, fmt.Errorf("delta at offset %d: %w", offset, err)
+	}
+	cacheDeltaBase(packCacheKey{pack, offset}, baseType, content)
+	return baseType, content, nil
+}
+
+// Small cache of objects rebuilt from deltas, since the same bases are
+// usually needed again by other objects in the chain. Objects are read by
+// concurrent workers while resolving packs, hence the mutex.
+
+type packCacheKey struct {
+	pack   *packFile
+	offset int64
+}
+
+type cachedObject struct {
+	objType string
+	content []byte
+}
+
+const deltaBaseCacheLimit = 16 << 20
+
+var deltaBaseCache = map[packCacheKey]cachedObject{}
+var deltaBaseCacheSize = 0
+var deltaBaseCacheMutex sync.Mutex
+
+func cachedDeltaBase(key packCacheKey) (cachedObject, bool) {
+	deltaBaseCacheMutex.Lock()
+	defer deltaBaseCacheMutex.Unlock()
+	cached, ok := deltaBaseCache[key]
+	return cached, ok
+}
+
+func cacheDeltaBase(key packCacheKey, objType string, content []byte) {
+	if len(content) > deltaBaseCacheLimit/4 {
+		return
+	}
+	deltaBaseCacheMutex.Lock()
+	defer deltaBaseCacheMutex.Unlock()
+	if deltaBaseCacheSize+len(content) > deltaBaseCacheLimit {
+		deltaBaseCache = map[packCacheKey]cachedObject{}
+		deltaBaseCacheSize = 0
+	}
+	deltaBaseCache[key] = cachedObject{objType, content}
+	deltaBaseCacheSize += len(content)
+}
+
+// verifyChecksum checks the SHA-1 trailer of the pack file and that the
+// index belongs to it.
+func (pack *packFile) verifyChecksum() error {
+	info, err := pack.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < 12+20 {
+		return errors.New("pack file is truncated")
+	}
+	s := sha1.New()
+	if _, err = io.Copy(s, io.NewSectionReader(pack.file, 0, info.Size()-20)); err != nil {
+		return err
+	}
+	trailer := make([]byte, 20)
+	if _, err = pack.file.ReadAt(trailer, info.Size()-20); err != nil {
+		return err
+	}
+	if !bytes.Equal(s.Sum(nil), trailer) {
+		return errors.New("pack checksum mismatch")
+	}
+	if !bytes.Equal(trailer, pack.index.packChecksum) {
+		return errors.New("pack checksum does not match its index")
+	}
+	return nil
+}
+
+// applyDelta rebuilds an object from its base and a delta made of "copy"
+// and "insert" instructions.
+// reference: https://git-scm.com/docs/pack-format#_deltified_representation
+func applyDelta(base, delta []byte) ([]byte, error) {
+	i := 0
+	readSize := func() (uint64, error) {
+		size, shift := uint64(0), 0
+		for {
+			if i >= len(delta) {
+				return 0, errors.New("truncated delta header")
+			}
+			value := delta[i]
+			i++
+			size |= uint64(value&0b01111111) << shift
+			if value&0b10000000 == 0 {
+				return size, nil
+			}
+			shift += 7
+		}
+	}
+
+	sourceSize, err := readSize()
+	if err != nil {
+		return nil, err
+	}
+	if sourceSize != uint64(len(base)) {
+		return nil, fmt.Errorf("unexpected source size for delta: got %d - want %d", len(base), sourceSize)
+	}
+	targetSize, err := readSize()
+	if err != nil {
+		return nil, err
+	}
+	// each instruction byte produces at most 0x10000 bytes
+	if targetSize > uint64(len(delta))*0x10000 {
+		return nil, fmt.Errorf("delta target size %d is too large for a %d bytes delta", targetSize, len(delta))
+	}
+
+	target := make([]byte, 0, targetSize)
+	for i < len(delta) {
+		op := delta[i]
+		i++
+		if op&0b10000000 != 0 { // copy operation
+			var offset, length uint64
+			for bit := 0; bit < 7; bit++ {
+				if op&(1<<bit) == 0 {
+					continue
+				}
+				if i >= len(delta) {
+					return nil, errors.New("truncated copy instruction")
+				}
+				if bit < 4 {
+					offset |= uint64(delta[i]) << (8 * bit)
+				} else {
+					length |= uint64(delta[i]) << (8 * (bit - 4))
+				}
+				i++
+			}
+			if length == 0 {
+				length = 0x10000
+			}
+			if offset+length > uint64(len(base)) {
+				return nil, fmt.Errorf("copy instruction out of bounds: %d+%d > %d", offset, length, len(base))
+			}
+			target = append(target, base[offset:offset+length]...)
+		} else if op != 0 { // insert operation
+			length := int(op)
+			if i+length > len(delta) {
+				return nil, errors.New("truncated insert instruction")
+			}
+			target = append(target, delta[i:i+length]...)
+			i += length
+		} else {
+			return nil, errors.New("invalid delta opcode 0")
+		}
+		if uint64(len(target)) > targetSize {
+			return nil, errors.New("delta produces more data than expected")
+		}
+	}
+
+	if uint64(len(target)) != targetSize {
+		return nil, fmt.Errorf("delta target size mismatch: got %d - want %d", len(target), targetSize)
+	}
+	return target, nil
+}
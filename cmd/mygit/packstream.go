@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// Sequential reading of a pack stream, as received from a remote or read
+// from stdin, when there is no index to locate the entries. Each entry is
+// inflated from a reader that counts the bytes consumed, so the exact
+// boundaries of the compressed data are known. The inflated data isn't
+// kept: it's read again from the pack file when resolving deltas.
+// reference: https://git-scm.com/docs/pack-format
+
+// packEntry is an entry read from a pack stream. The hash, type and depth
+// are only known once deltas are resolved.
+type packEntry struct {
+	header *packEntryHeader
+	offset int64
+	end    int64  // offset of the next entry
+	crc    uint32 // of the raw entry data, header included
+	data   []byte // content of bases outside the pack
+
+	hash    []byte
+	objType string
+	depth   int        // length of the delta chain
+	base    *packEntry // delta base, with offset -1 if it's not in the pack
+}
+
+func (entry *packEntry) isDelta() bool {
+	return entry.header.objType == OBJ_OFS_DELTA || entry.header.objType == OBJ_REF_DELTA
+}
+
+type packStream struct {
+	version  uint32
+	entries  []*packEntry
+	checksum []byte
+}
+
+// packReader counts, checksums and optionally copies everything read
+// through it. It's an io.ByteReader, so the zlib reader doesn't consume
+// more than the compressed data of each entry.
+type packReader struct {
+	reader   *bufio.Reader
+	offset   int64
+	checksum hash.Hash
+	crc      hash.Hash32
+	copyTo   io.Writer
+	pending  []byte // read but not yet added to the checksums
+}
+
+func (r *packReader) ReadByte() (byte, error) {
+	c, err := r.reader.ReadByte()
+	if err == nil {
+		r.pending = append(r.pending, c)
+		r.offset++
+		if len(r.pending) >= 1<<16 {
+			r.flush()
+		}
+	}
+	return c, err
+}
+
+func (r *packReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.pending = append(r.pending, p[:n]...)
+	r.offset += int64(n)
+	if len(r.pending) >= 1<<16 {
+		r.flush()
+	}
+	return n, err
+}
+
+func (r *packReader) flush() error {
+	r.checksum.Write(r.pending)
+	r.crc.Write(r.pending)
+	var err error
+	if r.copyTo != nil {
+		_, err = r.copyTo.Write(r.pending)
+	}
+	r.pending = r.pending[:0]
+	return err
+}
+
+// readPackStream reads all the entries of a pack and checks its trailing
+// checksum. When copyTo is set, the pack data is also written to it.
+func readPackStream(input io.Reader, copyTo io.Writer, progress *progress) (*packStream, error) {
+	r := &packReader{reader: bufio.NewReaderSize(input, 1<<16), checksum: sha1.New(), crc: crc32.NewIEEE(), copyTo: copyTo}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("pack header: %w", err)
+	}
+	if string(header[:4]) != "PACK" {
+		return nil, errors.New("pack signature mismatch")
+	}
+	pack := &packStream{version: binary.BigEndian.Uint32(header[4:8])}
+	if pack.version != 2 && pack.version != 3 {
+		return nil, fmt.Errorf("pack version %d unsupported", pack.version)
+	}
+	count := binary.BigEndian.Uint32(header[8:12])
+	progress.setTotal(int(count))
+
+	for i := uint32(0); i < count; i++ {
+		if err := r.flush(); err != nil {
+			return nil, err
+		}
+		r.crc.Reset()
+		entry, err := readPackEntry(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.flush(); err != nil {
+			return nil, err
+		}
+		entry.crc = r.crc.Sum32()
+		pack.entries = append(pack.entries, entry)
+		progress.update(len(pack.entries), r.offset)
+	}
+
+	if err := r.flush(); err != nil {
+		return nil, err
+	}
+	pack.checksum = r.checksum.Sum(nil)
+	trailer := make([]byte, 20)
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return nil, fmt.Errorf("pack is truncated: %w", err)
+	}
+	if err := r.flush(); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer, pack.checksum) {
+		return nil, errors.New("pack is corrupted (SHA1 mismatch)")
+	}
+	progress.update(len(pack.entries), r.offset)
+	progress.done()
+	return pack, nil
+}
+
+func readPackEntry(r *packReader) (*packEntry, error) {
+	offset := r.offset
+	header, err := parseEntryHeader(r, offset)
+	if err != nil {
+		return nil, fmt.Errorf("pack entry at offset %d: %w", offset, err)
+	}
+
+	zreader, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("inflate of entry at offset %d: %w", offset, err)
+	}
+	// reading to the end of the zlib stream also checks its checksum
+	size, err := io.Copy(io.Discard, io.LimitReader(zreader, int64(header.size)+1))
+	if err != nil {
+		return nil, fmt.Errorf("inflate of entry at offset %d: %w", offset, err)
+	}
+	if uint64(size) != header.size {
+		return nil, fmt.Errorf("inflated size mismatch at offset %d: expected %d", offset, header.size)
+	}
+	return &packEntry{header: header, offset: offset, end: r.offset}, nil
+}
+
+// spoolPackStream reads a pack stream that can't be read again (from a
+// remote or stdin), keeping a copy in a temporary file for resolvePack. The
+// file is removed at once where open files can be, so nothing is left
+// behind by fatal errors, or else when closed.
+func spoolPackStream(input io.Reader, progress *progress) (*packStream, *tempPackFile, error) {
+	file, err := os.CreateTemp(filepath.Join(gitDir, "objects"), "tmp_pack_")
+	if err != nil {
+		return nil, nil, err
+	}
+	os.Remove(file.Name())
+	spooled := &tempPackFile{file}
+	stream, err := readPackStream(input, file, progress)
+	if err != nil {
+		spooled.Close()
+		return nil, nil, err
+	}
+	return stream, spooled, nil
+}
+
+// tempPackFile is a temporary copy of a pack, removed when closed.
+type tempPackFile struct {
+	*os.File
+}
+
+func (f *tempPackFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+func (pack *packStream) deltaCount() int {
+	count := 0
+	for _, entry := range pack.entries {
+		if entry.isDelta() {
+			count++
+		}
+	}
+	return count
+}
+
+// packThreads is the number of workers used to resolve deltas: pack.threads,
+// or one per CPU when it's 0 or not set.
+func packThreads() int {
+	threads := getConfigInt("pack.threads", 0)
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	return threads
+}
+
+// deltaResolver holds the state shared by the workers resolving the deltas
+// of a pack. Each non-delta entry is the root of a tree of deltas, and
+// separate trees are resolved concurrently.
+type deltaResolver struct {
+	source      *packFile // to read the entry data
+	loadBase    func(hash []byte) (string, []byte, error)
+	onObject    func(entry *packEntry, content []byte) error
+	ofsChildren map[int64][]*packEntry
+	refChildren map[string][]*packEntry
+
+	mutex   sync.Mutex
+	claimed map[string]bool    // hashes whose REF_DELTA children were taken
+	pending map[*packEntry]int // children left to rebuild from a cached base
+	// contents of bases with children left to rebuild; once over the limit,
+	// bases are read again from the pack and rebuilt from their own bases
+	// instead, so the limit bounds the memory used
+	cache      map[*packEntry][]byte
+	cacheSize  int
+	cacheLimit int
+	err        error
+}
+
+// resolvePack computes the type and hash of every entry, applying deltas
+// from their bases down to their children, using up to threads workers.
+// The entry data is read from source, the file of the pack. Bases of
+// REF_DELTA entries that aren't in the pack (thin packs) are read with
+// loadBase, if set. Once an entry is resolved, onObject receives its
+// content; it may be called concurrently.
+func resolvePack(pack *packStream, source *os.File, threads int, loadBase func(hash []byte) (string, []byte, error), onObject func(entry *packEntry, content []byte) error) error {
+	r := &deltaResolver{
+		source:      &packFile{path: source.Name(), file: source},
+		loadBase:    loadBase,
+		onObject:    onObject,
+		ofsChildren: map[int64][]*packEntry{},
+		refChildren: map[string][]*packEntry{},
+		claimed:     map[string]bool{},
+		pending:     map[*packEntry]int{},
+		cache:       map[*packEntry][]byte{},
+		cacheLimit:  getConfigInt("core.deltaBaseCacheLimit", 96<<20),
+	}
+	roots := []*packEntry{}
+	for _, entry := range pack.entries {
+		switch entry.header.objType {
+		case OBJ_OFS_DELTA:
+			r.ofsChildren[entry.header.baseOffset] = append(r.ofsChildren[entry.header.baseOffset], entry)
+		case OBJ_REF_DELTA:
+			key := string(entry.header.baseHash)
+			r.refChildren[key] = append(r.refChildren[key], entry)
+		default:
+			entry.objType = packTypeNames[entry.header.objType]
+			roots = append(roots, entry)
+		}
+	}
+	// loaded before starting the workers, which may look for objects
+	getPacks()
+	if err := r.resolveTrees(roots, threads); err != nil {
+		return err
+	}
+
+	// what's left are deltas against objects outside the pack
+	if loadBase != nil {
+		external := []*packEntry{}
+		for _, key := range sortedKeys(r.refChildren) {
+			if r.claimed[key] {
+				continue
+			}
+			baseType, base, err := loadBase([]byte(key))
+			if err != nil {
+				continue
+			}
+			external = append(external, &packEntry{offset: -1, hash: []byte(key), objType: baseType, data: base})
+		}
+		if err := r.resolveTrees(external, threads); err != nil {
+			return err
+		}
+	}
+
+	unresolved := 0
+	for _, entry := range pack.entries {
+		if entry.hash == nil {
+			unresolved++
+		}
+	}
+	if unresolved == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("pack has %d unresolved deltas", unresolved)
+	if unresolved == 1 {
+		message = "pack has 1 unresolved delta"
+	}
+	for _, key := range sortedKeys(r.refChildren) {
+		if !r.claimed[key] {
+			message += fmt.Sprintf(" (missing base object %x)", key)
+			break
+		}
+	}
+	return errors.New(message)
+}
+
+// resolveTrees hands the roots to a pool of workers, stopping at the first
+// error.
+func (r *deltaResolver) resolveTrees(roots []*packEntry, threads int) error {
+	if threads < 1 {
+		threads = 1
+	}
+	work := make(chan *packEntry)
+	var workers sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for root := range work {
+				if err := r.resolveTree(root); err != nil {
+					r.mutex.Lock()
+					if r.err == nil {
+						r.err = err
+					}
+					r.mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, root := range roots {
+		r.mutex.Lock()
+		failed := r.err != nil
+		r.mutex.Unlock()
+		if failed {
+			break
+		}
+		work <- root
+	}
+	close(work)
+	workers.Wait()
+	return r.err
+}
+
+// resolveTree resolves root and all the deltas depending on it, depth
+// first. Roots outside the pack (offset -1) are not reported.
+func (r *deltaResolver) resolveTree(root *packEntry) error {
+	stack := []*packEntry{root}
+	for len(stack) > 0 {
+		entry := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		content, err := r.content(entry)
+		if err != nil {
+			return err
+		}
+		if entry.base != nil {
+			r.release(entry.base)
+		}
+		if entry.hash == nil {
+			entry.hash = hashObject(false, entry.objType, int64(len(content)), content)
+		}
+		if r.onObject != nil && entry.offset >= 0 {
+			if err := r.onObject(entry, content); err != nil {
+				return err
+			}
+		}
+
+		children := r.children(entry)
+		if len(children) == 0 {
+			continue
+		}
+		r.mutex.Lock()
+		r.pending[entry] = len(children)
+		if r.cacheSize+len(content) <= r.cacheLimit {
+			r.cache[entry] = content
+			r.cacheSize += len(content)
+		}
+		r.mutex.Unlock()
+		// pushed in reverse so they are resolved in pack order
+		for i := len(children) - 1; i >= 0; i-- {
+			child := children[i]
+			child.objType = entry.objType
+			child.depth = entry.depth + 1
+			child.base = entry
+			stack = append(stack, child)
+		}
+	}
+	return nil
+}
+
+// children returns the deltas based on an entry. Children by hash are only
+// returned once, in case the same object is in the pack more than once.
+func (r *deltaResolver) children(entry *packEntry) []*packEntry {
+	children := []*packEntry{}
+	if entry.offset >= 0 {
+		children = append(children, r.ofsChildren[entry.offset]...)
+	}
+	key := string(entry.hash)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.claimed[key] {
+		r.claimed[key] = true
+		children = append(children, r.refChildren[key]...)
+	}
+	return children
+}
+
+// content returns the content of an entry, rebuilding it from its base
+// unless it's cached.
+func (r *deltaResolver) content(entry *packEntry) ([]byte, error) {
+	r.mutex.Lock()
+	content, ok := r.cache[entry]
+	r.mutex.Unlock()
+	if ok {
+		return content, nil
+	}
+	if entry.offset < 0 {
+		return entry.data, nil
+	}
+	data, err := r.source.inflateEntry(entry.header)
+	if err != nil {
+		return nil, fmt.Errorf("pack entry at offset %d: %w", entry.offset, err)
+	}
+	if entry.base == nil {
+		return data, nil
+	}
+
+	base, err := r.content(entry.base)
+	if err != nil {
+		return nil, err
+	}
+	content, err = applyDelta(base, data)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt delta at offset %d (base %x): %w", entry.offset, entry.base.hash, err)
+	}
+	return content, nil
+}
+
+// release drops a cached base once all its children have been rebuilt.
+func (r *deltaResolver) release(base *packEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pending[base]--
+	if r.pending[base] > 0 {
+		return
+	}
+	delete(r.pending, base)
+	if content, ok := r.cache[base]; ok {
+		r.cacheSize -= len(content)
+		delete(r.cache, base)
+	}
+}
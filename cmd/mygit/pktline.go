@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// pkt-line framing used by all the git protocols: each packet starts with
+// its length (including the 4 bytes of the length itself) in hexadecimal.
+// The lengths 0000 (flush), 0001 (delimiter) and 0002 (response end) are
+// special packets without data.
+// reference: https://git-scm.com/docs/protocol-common#_pkt_line_format
+
+const (
+	pktMaxLength = 65520
+	pktMaxData   = pktMaxLength - 4
+)
+
+// kinds of packets
+const (
+	pktData = iota
+	pktFlush
+	pktDelim
+	pktResponseEnd
+)
+
+var errPktUnexpected = errors.New("protocol error: unexpected packet")
+
+type pktReader struct {
+	reader io.Reader
+	header [4]byte
+}
+
+// newPktReader reads packets from r. Reads are exact, so whatever follows
+// the packets (e.g. a pack) can be read from r afterwards.
+func newPktReader(r io.Reader) *pktReader {
+	return &pktReader{reader: r}
+}
+
+// readPacket returns the kind of the next packet and its data.
+func (r *pktReader) readPacket() (int, []byte, error) {
+	if _, err := io.ReadFull(r.reader, r.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("protocol error: truncated packet length")
+		}
+		return 0, nil, err
+	}
+	length, err := strconv.ParseUint(string(r.header[:]), 16, 16)
+	if err != nil {
+		return 0, nil, fmt.Errorf("protocol error: bad line length character: %q", r.header[:])
+	}
+
+	switch {
+	case length == 0:
+		tracePacket(false, []byte("0000"))
+		return pktFlush, nil, nil
+	case length == 1:
+		tracePacket(false, []byte("0001"))
+		return pktDelim, nil, nil
+	case length == 2:
+		tracePacket(false, []byte("0002"))
+		return pktResponseEnd, nil, nil
+	case length < 4 || length > pktMaxLength:
+		return 0, nil, fmt.Errorf("protocol error: bad line length %d", length)
+	}
+
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		return 0, nil, fmt.Errorf("protocol error: truncated packet: %w", err)
+	}
+	tracePacket(false, data)
+	return pktData, data, nil
+}
+
+// readLine reads a data packet as text, without its trailing newline. It
+// returns io.EOF at a flush packet.
+func (r *pktReader) readLine() (string, error) {
+	kind, data, err := r.readPacket()
+	if err != nil {
+		return "", err
+	}
+	if kind == pktFlush {
+		return "", io.EOF
+	}
+	if kind != pktData {
+		return "", errPktUnexpected
+	}
+	if len(data) > 0 && data[len(data)-1] == '\n' {
+		data = data[:len(data)-1]
+	}
+	return string(data), nil
+}
+
+// readSection reads text packets until a flush, delimiter or response end,
+// returning the lines and the kind of packet that ended the section.
+func (r *pktReader) readSection() ([]string, int, error) {
+	lines := []string{}
+	for {
+		kind, data, err := r.readPacket()
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind != pktData {
+			return lines, kind, nil
+		}
+		if len(data) > 0 && data[len(data)-1] == '\n' {
+			data = data[:len(data)-1]
+		}
+		lines = append(lines, string(data))
+	}
+}
+
+type pktWriter struct {
+	writer io.Writer
+}
+
+func newPktWriter(w io.Writer) *pktWriter {
+	return &pktWriter{writer: w}
+}
+
+func (w *pktWriter) writePacket(data []byte) error {
+	if len(data) > pktMaxData {
+		return fmt.Errorf("packet too long: %d bytes", len(data))
+	}
+	tracePacket(true, data)
+	packet := make([]byte, 0, len(data)+4)
+	packet = fmt.Appendf(packet, "%04x", len(data)+4)
+	packet = append(packet, data...)
+	_, err := w.writer.Write(packet)
+	return err
+}
+
+// writeLine writes a text packet, adding the trailing newline.
+func (w *pktWriter) writeLine(format string, args ...any) error {
+	return w.writePacket([]byte(fmt.Sprintf(format, args...) + "\n"))
+}
+
+func (w *pktWriter) writeSpecial(packet string) error {
+	tracePacket(true, []byte(packet))
+	_, err := io.WriteString(w.writer, packet)
+	return err
+}
+
+func (w *pktWriter) flush() error {
+	return w.writeSpecial("0000")
+}
+
+func (w *pktWriter) delim() error {
+	return w.writeSpecial("0001")
+}
+
+func (w *pktWriter) responseEnd() error {
+	return w.writeSpecial("0002")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progress displays the progress of a long operation on stderr, like git:
+// "Receiving objects:  45% (450/1000), 1.20 MiB | 3.00 MiB/s". All methods
+// are no-ops on a nil progress, which is what newProgress returns when
+// progress is disabled.
+type progress struct {
+	mutex       sync.Mutex
+	title       string
+	total       int
+	count       int
+	bytes       int64 // for the throughput, when counting bytes
+	start       time.Time
+	lastUpdate  time.Time
+	lastPercent int
+	lastLength  int
+}
+
+// progressEnabled decides whether to show progress: --quiet disables it,
+// --progress forces it, otherwise it's shown when stderr is a terminal.
+func progressEnabled(quiet, force bool) bool {
+	if quiet {
+		return false
+	}
+	if force {
+		return true
+	}
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgress(enabled bool, title string, total int) *progress {
+	if !enabled {
+		return nil
+	}
+	return &progress{title: title, total: total, start: time.Now(), lastPercent: -1}
+}
+
+// update sets the number of items done so far, and the bytes read when
+// showing a throughput.
+func (p *progress) update(count int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.count, p.bytes = count, bytes
+	p.display(false)
+}
+
+// increment adds one to the items done.
+func (p *progress) increment() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.count++
+	p.display(false)
+}
+
+func (p *progress) setTotal(total int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.total = total
+	p.mutex.Unlock()
+}
+
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.display(true)
+}
+
+// display redraws the line at most every 100ms, when the percentage changes
+// or every second otherwise, and when done.
+func (p *progress) display(done bool) {
+	now := time.Now()
+	percent := -1
+	if p.total > 0 {
+		percent = p.count * 100 / p.total
+	}
+	if !done {
+		elapsed := now.Sub(p.lastUpdate)
+		if elapsed < 100*time.Millisecond || (percent == p.lastPercent && elapsed < time.Second) {
+			return
+		}
+	}
+	p.lastUpdate, p.lastPercent = now, percent
+
+	line := fmt.Sprintf("%s: %d", p.title, p.count)
+	if p.total > 0 {
+		line = fmt.Sprintf("%s: %3d%% (%d/%d)", p.title, percent, p.count, p.total)
+	}
+	if p.bytes > 0 {
+		line += ", " + humanizeBytes(p.bytes)
+		if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+			line += " | " + humanizeBytes(int64(float64(p.bytes)/elapsed)) + "/s"
+		}
+	}
+	if done {
+		line += ", done."
+	}
+	// spaces clear what's left of a longer previous line
+	padding := ""
+	if len(line) < p.lastLength {
+		padding = strings.Repeat(" ", p.lastLength-len(line))
+	}
+	p.lastLength = len(line)
+	if done {
+		fmt.Fprintf(os.Stderr, "\r%s%s\n", line, padding)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%s%s", line, padding)
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Client side of the git wire protocol, versions 0 and 2. Version 2 is
+// asked for (protocol.version, default 2) and version 0 is used when the
+// server doesn't support it.
+// reference: https://git-scm.com/docs/pack-protocol
+// reference: https://git-scm.com/docs/protocol-v2
+
+const agent = "mygit/1.0"
+
+type remoteRef struct {
+	name   string
+	hash   string
+	peeled string // object an annotated tag points to
+	symref string // target of a symbolic ref, e.g. HEAD
+}
+
+type remoteSession struct {
+	transport    transport
+	service      string
+	version      int
+	capabilities map[string]string
+	refs         []remoteRef // advertised refs (version 0 only)
+	wantsSent    bool
+}
+
+// connectRemote starts a service on the remote and reads its advertisement.
+func connectRemote(url, service string) (*remoteSession, error) {
+	t, err := newTransport(url)
+	if err != nil {
+		return nil, err
+	}
+	session := &remoteSession{transport: t, service: service, capabilities: map[string]string{}}
+	version := getConfigInt("protocol.version", 2)
+	// version 2 has no push, receive-pack always speaks version 0
+	if service == "git-receive-pack" && version == 2 {
+		version = 0
+	}
+	advertisement, err := t.advertise(service, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.readAdvertisement(newPktReader(advertisement)); err != nil {
+		return nil, err
+	}
+	trace("%s speaks protocol version %d", url, session.version)
+	return session, nil
+}
+
+func (s *remoteSession) close() error {
+	return s.transport.close()
+}
+
+func (s *remoteSession) readAdvertisement(reader *pktReader) error {
+	line, err := reader.readLine()
+	// smart HTTP starts version 0 with the name of the service
+	if err == nil && strings.HasPrefix(line, "# service=") {
+		if kind, _, err := reader.readPacket(); err != nil || kind != pktFlush {
+			return errors.New("protocol error: expected flush after service header")
+		}
+		line, err = reader.readLine()
+	}
+	if err == io.EOF {
+		// an empty repository, without any ref or capability
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if msg, ok := strings.CutPrefix(line, "ERR "); ok {
+		return fmt.Errorf("remote error: %s", msg)
+	}
+
+	if line == "version 2" {
+		s.version = 2
+		lines, _, err := reader.readSection()
+		if err != nil {
+			return err
+		}
+		for _, capability := range lines {
+			name, value, _ := strings.Cut(capability, "=")
+			s.capabilities[name] = value
+		}
+		return nil
+	}
+	if line == "version 1" {
+		if line, err = reader.readLine(); err != nil {
+			return err
+		}
+	}
+
+	// version 0: one ref per line, with the capabilities after the first
+	for {
+		ref, capabilities, hasCapabilities := strings.Cut(line, "\000")
+		if hasCapabilities {
+			s.parseCapabilities(capabilities)
+		}
+		hash, name, ok := strings.Cut(ref, " ")
+		if !ok || len(hash) != 40 {
+			return fmt.Errorf("protocol error: invalid ref advertisement: %q", ref)
+		}
+		if peeledName, ok := strings.CutSuffix(name, "^{}"); ok && len(s.refs) > 0 && s.refs[len(s.refs)-1].name == peeledName {
+			s.refs[len(s.refs)-1].peeled = hash
+		} else if name != "capabilities^{}" {
+			s.refs = append(s.refs, remoteRef{name: name, hash: hash})
+		}
+
+		if line, err = reader.readLine(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// symbolic refs are only advertised as capabilities
+	for _, value := range strings.Fields(s.capabilities["symref"]) {
+		name, target, _ := strings.Cut(value, ":")
+		for i := range s.refs {
+			if s.refs[i].name == name {
+				s.refs[i].symref = target
+			}
+		}
+	}
+	return nil
+}
+
+func (s *remoteSession) parseCapabilities(capabilities string) {
+	for _, capability := range strings.Fields(capabilities) {
+		trace("capability: %s", capability)
+		name, value, _ := strings.Cut(capability, "=")
+		// symref can appear more than once
+		if previous, ok := s.capabilities[name]; ok && name == "symref" {
+			value = previous + " " + value
+		}
+		s.capabilities[name] = value
+	}
+}
+
+func (s *remoteSession) hasCapability(name string) bool {
+	_, ok := s.capabilities[name]
+	return ok
+}
+
+// commandHasFeature checks a version 2 command capability, like
+// "fetch=shallow wait-for-done".
+func (s *remoteSession) commandHasFeature(command, feature string) bool {
+	for _, value := range strings.Fields(s.capabilities[command]) {
+		if value == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// listRefs returns the remote refs starting with any of the prefixes (all
+// of them when there are no prefixes).
+func (s *remoteSession) listRefs(prefixes []string) ([]remoteRef, error) {
+	matches := func(name string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return len(prefixes) == 0
+	}
+
+	if s.version != 2 {
+		refs := []remoteRef{}
+		for _, ref := range s.refs {
+			if matches(ref.name) {
+				refs = append(refs, ref)
+			}
+		}
+		return refs, nil
+	}
+
+	var request bytes.Buffer
+	writer := newPktWriter(&request)
+	writer.writeLine("command=ls-refs")
+	writer.writeLine("agent=%s", agent)
+	writer.delim()
+	writer.writeLine("symrefs")
+	writer.writeLine("peel")
+	if s.commandHasFeature("ls-refs", "unborn") {
+		writer.writeLine("unborn")
+	}
+	for _, prefix := range prefixes {
+		writer.writeLine("ref-prefix %s", prefix)
+	}
+	writer.flush()
+
+	response, err := s.transport.request(s.service, request.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	lines, _, err := newPktReader(response).readSection()
+	if err != nil {
+		return nil, err
+	}
+
+	// "<hash> <name> [symref-target:<target>] [peeled:<hash>]", where the
+	// hash of an unborn HEAD is "unborn"
+	refs := []remoteRef{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("protocol error: invalid ls-refs response: %q", line)
+		}
+		ref := remoteRef{hash: fields[0], name: fields[1]}
+		if ref.hash == "unborn" {
+			ref.hash = ""
+		}
+		for _, attribute := range fields[2:] {
+			if value, ok := strings.CutPrefix(attribute, "symref-target:"); ok {
+				ref.symref = value
+			} else if value, ok := strings.CutPrefix(attribute, "peeled:"); ok {
+				ref.peeled = value
+			}
+		}
+		if matches(ref.name) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// fetchPack asks for a pack with the wanted objects, returning the pack
+// data as it's received. Progress messages from the remote are shown on
+// stderr when showProgress is set.
+//
+// When haves is given, the commits it walks are offered to the remote in
+// growing batches until it's ready to send a pack (or there's nothing more
+// to offer), so objects reachable from the common commits are left out.
+func (s *remoteSession) fetchPack(wants []string, haves *haveWalker, showProgress bool) (io.Reader, error) {
+	common := []string{}
+	if haves != nil && (s.version == 2 || s.hasCapability("multi_ack_detailed")) {
+		batch := 16
+		inVain := 0
+		for {
+			sent := haves.next(batch)
+			if len(sent) == 0 {
+				break
+			}
+			acks, ready, pack, err := s.fetchRound(wants, append(common, sent...), false, showProgress)
+			if err != nil || pack != nil {
+				return pack, err
+			}
+
+			found := false
+			for _, ack := range acks {
+				if !slices.Contains(common, ack) {
+					common = append(common, ack)
+					haves.markCommon(ack)
+					found = true
+				}
+			}
+			trace("negotiation: %d haves sent, %d in common", len(sent), len(common))
+			if ready {
+				break
+			}
+			// give up after too many haves the remote doesn't know
+			if found {
+				inVain = 0
+			} else if len(common) > 0 {
+				inVain += len(sent)
+				if inVain >= 256 {
+					break
+				}
+			}
+			if batch < 1024 {
+				batch *= 2
+			}
+		}
+	}
+
+	// the common commits are repeated with the final request, as stateless
+	// servers don't remember them
+	if s.version != 2 && !s.transport.stateless() {
+		common = nil
+	}
+	_, _, pack, err := s.fetchRound(wants, common, true, showProgress)
+	if err == nil && pack == nil {
+		err = errors.New("protocol error: no pack in fetch response")
+	}
+	return pack, err
+}
+
+// fetchRound sends one round of the negotiation, returning the commits
+// acknowledged as common, whether the remote is ready to send the pack and
+// the pack, if it came with the response (always after "done").
+func (s *remoteSession) fetchRound(wants, haves []string, done, showProgress bool) ([]string, bool, io.Reader, error) {
+	if s.version == 2 {
+		return s.fetchRoundV2(wants, haves, done, showProgress)
+	}
+
+	// capabilities requested with the first want, among the ones supported
+	// by both sides
+	capabilities := []string{}
+	for _, capability := range []string{"multi_ack_detailed", "side-band-64k", "thin-pack", "ofs-delta", "include-tag"} {
+		if s.hasCapability(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	sideband := s.hasCapability("side-band-64k") || s.hasCapability("side-band")
+	if !s.hasCapability("side-band-64k") && s.hasCapability("side-band") {
+		capabilities = append(capabilities, "side-band")
+	}
+	if !showProgress && s.hasCapability("no-progress") {
+		capabilities = append(capabilities, "no-progress")
+	}
+	capabilities = append(capabilities, "agent="+agent)
+
+	// wants are only sent once on a stateful connection
+	var request bytes.Buffer
+	writer := newPktWriter(&request)
+	if s.transport.stateless() || !s.wantsSent {
+		for i, want := range wants {
+			if i == 0 {
+				writer.writeLine("want %s %s", want, strings.Join(capabilities, " "))
+			} else {
+				writer.writeLine("want %s", want)
+			}
+		}
+		writer.flush()
+		s.wantsSent = true
+	}
+	for _, have := range haves {
+		writer.writeLine("have %s", have)
+	}
+	if done {
+		writer.writeLine("done")
+	} else {
+		writer.flush()
+	}
+
+	response, err := s.transport.request(s.service, request.Bytes())
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	// with multi_ack_detailed, each have the remote also has gets an
+	// "ACK <hash> common" and a round ends with a NAK. After "done", the
+	// pack follows a NAK or a final "ACK <hash>".
+	reader := newPktReader(response)
+	acks := []string{}
+	ready := false
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			return nil, false, nil, err
+		}
+		if msg, ok := strings.CutPrefix(line, "ERR "); ok {
+			return nil, false, nil, fmt.Errorf("remote error: %s", msg)
+		}
+		fields := strings.Fields(line)
+		switch {
+		case line == "NAK" && !done:
+			return acks, ready, nil, nil
+		case line == "NAK" || len(fields) == 2 && fields[0] == "ACK":
+			if sideband {
+				return acks, ready, newSidebandReader(reader, os.Stderr), nil
+			}
+			return acks, ready, response, nil
+		case len(fields) == 3 && fields[0] == "ACK" && fields[2] == "common":
+			acks = append(acks, fields[1])
+		case len(fields) == 3 && fields[0] == "ACK" && fields[2] == "ready":
+			ready = true
+		default:
+			return nil, false, nil, fmt.Errorf("protocol error: unexpected acknowledgment: %q", line)
+		}
+	}
+}
+
+func (s *remoteSession) fetchRoundV2(wants, haves []string, done, showProgress bool) ([]string, bool, io.Reader, error) {
+	var request bytes.Buffer
+	writer := newPktWriter(&request)
+	writer.writeLine("command=fetch")
+	writer.writeLine("agent=%s", agent)
+	writer.delim()
+	writer.writeLine("thin-pack")
+	writer.writeLine("ofs-delta")
+	writer.writeLine("include-tag")
+	if !showProgress {
+		writer.writeLine("no-progress")
+	}
+	for _, want := range wants {
+		writer.writeLine("want %s", want)
+	}
+	for _, have := range haves {
+		writer.writeLine("have %s", have)
+	}
+	if done {
+		writer.writeLine("done")
+	}
+	writer.flush()
+
+	response, err := s.transport.request(s.service, request.Bytes())
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	// the response is made of sections separated by delimiters, the last
+	// one being the pack, always multiplexed. Without "done", it ends after
+	// the acknowledgments unless the remote is ready.
+	reader := newPktReader(response)
+	acks := []string{}
+	ready := false
+	for {
+		header, err := reader.readLine()
+		if err != nil {
+			return nil, false, nil, err
+		}
+		if msg, ok := strings.CutPrefix(header, "ERR "); ok {
+			return nil, false, nil, fmt.Errorf("remote error: %s", msg)
+		}
+		if header == "packfile" {
+			return acks, true, newSidebandReader(reader, os.Stderr), nil
+		}
+
+		// shallow-info and wanted-refs aren't used yet
+		lines, end, err := reader.readSection()
+		if err != nil {
+			return nil, false, nil, err
+		}
+		trace("section %s: %q", header, lines)
+		if header == "acknowledgments" {
+			for _, line := range lines {
+				if hash, ok := strings.CutPrefix(line, "ACK "); ok {
+					acks = append(acks, hash)
+				} else if line == "ready" {
+					ready = true
+				}
+			}
+		}
+		if end == pktFlush && !done && !ready {
+			return acks, false, nil, nil
+		}
+		if end != pktDelim {
+			return nil, false, nil, fmt.Errorf("protocol error: no pack in fetch response (after %s)", header)
+		}
+	}
+}
+
+// pushCommand is a ref update sent to receive-pack.
+type pushCommand struct {
+	name             string
+	oldHash, newHash string // zeroHash when creating or deleting the ref
+}
+
+// sendPack sends ref updates to receive-pack, followed by a pack with the
+// objects (unless all the refs are deleted). It returns the status of each
+// ref reported by the remote, "ok" or the reason it was rejected, or nil
+// if the remote doesn't report statuses. Messages from the remote are
+// shown on stderr unless quiet.
+// reference: https://git-scm.com/docs/pack-protocol#_pushing_data_to_a_server
+func (s *remoteSession) sendPack(commands []*pushCommand, objects []*packObject, atomic, quiet bool) (map[string]string, error) {
+	capabilities := []string{}
+	for _, capability := range []string{"report-status", "side-band-64k"} {
+		if s.hasCapability(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	if atomic {
+		if !s.hasCapability("atomic") {
+			return nil, errors.New("the receiving end does not support --atomic push")
+		}
+		capabilities = append(capabilities, "atomic")
+	}
+	if quiet && s.hasCapability("quiet") {
+		capabilities = append(capabilities, "quiet")
+	}
+	capabilities = append(capabilities, "agent="+agent)
+
+	var request bytes.Buffer
+	writer := newPktWriter(&request)
+	sendPack := false
+	for i, command := range commands {
+		line := fmt.Sprintf("%s %s %s", command.oldHash, command.newHash, command.name)
+		if i == 0 {
+			line += "\000" + strings.Join(capabilities, " ")
+		}
+		writer.writeLine("%s", line)
+		sendPack = sendPack || command.newHash != zeroHash
+	}
+	writer.flush()
+	if sendPack {
+		opts := defaultPackOptions
+		opts.ofsDelta = s.hasCapability("ofs-delta")
+		opts.quiet = quiet
+		if _, err := writePack(&request, objects, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := s.transport.request(s.service, request.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if !s.hasCapability("report-status") {
+		return nil, nil
+	}
+
+	// "unpack ok" (or the error), then "ok <ref>" or "ng <ref> <reason>"
+	// for each ref
+	reader := newPktReader(response)
+	if s.hasCapability("side-band-64k") {
+		var progress io.Writer = os.Stderr
+		if quiet {
+			progress = nil
+		}
+		reader = newPktReader(newSidebandReader(reader, progress))
+	}
+	lines, _, err := reader.readSection()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "unpack ") {
+		return nil, errors.New("protocol error: no unpack status")
+	}
+	statuses := map[string]string{}
+	for _, line := range lines[1:] {
+		if name, ok := strings.CutPrefix(line, "ok "); ok {
+			statuses[name] = "ok"
+		} else if rest, ok := strings.CutPrefix(line, "ng "); ok {
+			name, reason, _ := strings.Cut(rest, " ")
+			statuses[name] = reason
+		} else {
+			return nil, fmt.Errorf("protocol error: invalid status: %q", line)
+		}
+	}
+	if status := strings.TrimPrefix(lines[0], "unpack "); status != "ok" {
+		return statuses, fmt.Errorf("remote unpack failed: %s", status)
+	}
+	return statuses, nil
+}
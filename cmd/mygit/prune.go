@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func gitPrune() {
+	usage := "prune [-n | --dry-run] [-v | --verbose] [--expire <date>]"
+
+	var dryRun, verbose bool
+	// unlike git, recent objects are kept unless asked otherwise
+	expireValue, ok := getConfig("gc.pruneExpire")
+	if !ok {
+		expireValue = "2.weeks.ago"
+	}
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-n" || arg == "--dry-run":
+			dryRun = true
+		case arg == "-v" || arg == "--verbose":
+			verbose = true
+		case arg == "--expire" && i+1 < len(args):
+			i++
+			expireValue = args[i]
+		case strings.HasPrefix(arg, "--expire="):
+			expireValue = arg[len("--expire="):]
+		default:
+			printUsageAndExit(usage)
+		}
+	}
+
+	expire, err := parseExpiryDate(expireValue, time.Now())
+	if err != nil {
+		fatal("fatal: malformed expiration date '%s'\n", expireValue)
+	}
+
+	pruneUnreachable(expire, dryRun, verbose)
+	if dryRun {
+		for _, path := range packedLooseObjects() {
+			fmt.Printf("rm -f %s\n", path)
+		}
+	} else {
+		prunePackedObjects()
+	}
+}
+
+// pruneUnreachable removes the loose objects that aren't needed and are
+// older than the expiry date, along with stale temporary files.
+//
+// Objects written after the expiry date are kept, and so is everything they
+// reference: a concurrent command may be about to make them reachable (e.g.
+// a commit whose tree is already written but the branch is not updated yet).
+func pruneUnreachable(expire time.Time, dryRun, verbose bool) {
+	if expire.IsZero() {
+		return
+	}
+
+	keep := reachableFromRoots()
+	recent := []objectLink{}
+	for _, hash := range listLooseObjects(filepath.Join(gitDir, "objects")) {
+		if _, ok := keep[hex.EncodeToString(hash)]; ok {
+			continue
+		}
+		if info, err := os.Stat(looseObjectPath(hash)); err == nil && !info.ModTime().Before(expire) {
+			recent = append(recent, objectLink{hash: hash})
+		}
+	}
+	for objName, objType := range walkObjects(recent, nil) {
+		keep[objName] = objType
+	}
+
+	for _, hash := range listLooseObjects(filepath.Join(gitDir, "objects")) {
+		objName := hex.EncodeToString(hash)
+		if _, ok := keep[objName]; ok {
+			continue
+		}
+		objPath := looseObjectPath(hash)
+		if dryRun || verbose {
+			objType, _, err := loadObject(hash)
+			if err != nil {
+				objType = "unknown"
+			}
+			fmt.Printf("%s %s\n", objName, objType)
+		}
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(objPath); err != nil {
+			fmt.Fprintf(os.Stderr, "error: unable to remove %s: %s\n", objPath, err)
+		}
+		// remove the directory once empty
+		os.Remove(filepath.Dir(objPath))
+	}
+
+	pruneTemporaryFiles(expire, dryRun)
+}
+
+// pruneTemporaryFiles removes the "tmp_*" files left behind by interrupted
+// object and pack writes.
+func pruneTemporaryFiles(expire time.Time, dryRun bool) {
+	objectsDir := filepath.Join(gitDir, "objects")
+	dirs := []string{objectsDir, filepath.Join(objectsDir, "pack")}
+	entries, _ := os.ReadDir(objectsDir)
+	for _, entry := range entries {
+		if entry.IsDir() && len(entry.Name()) == 2 {
+			dirs = append(dirs, filepath.Join(objectsDir, entry.Name()))
+		}
+	}
+
+	for _, dir := range dirs {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), "tmp_") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || !info.ModTime().Before(expire) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if dryRun {
+				fmt.Printf("Removing stale temporary file %s\n", path)
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				fmt.Fprintf(os.Stderr, "error: unable to remove %s: %s\n", path, err)
+			}
+		}
+	}
+}
+
+// reachableFromRoots walks all the objects that must be kept: the ones
+// reachable from references, HEAD, reflogs and the index.
+func reachableFromRoots() map[string]string {
+	return walkObjects(hashesToLinks(rootHashes()), nil)
+}
+
+// rootHashes lists the existing objects referenced by refs, HEAD, reflogs
+// and the index.
+func rootHashes() [][]byte {
+	roots := [][]byte{}
+	addRoot := func(value string) {
+		if hash, err := hex.DecodeString(value); err == nil && len(hash) == 20 && hasObject(hash) {
+			roots = append(roots, hash)
+		}
+	}
+	for _, value := range listRefs() {
+		addRoot(value)
+	}
+	addRoot(readRef("HEAD"))
+	for _, values := range readReflogs() {
+		for _, value := range values {
+			addRoot(value)
+		}
+	}
+
+	entries, trees, err := readIndex()
+	if err != nil {
+		fatal("fatal: %s\n", err)
+	}
+	for _, entry := range entries {
+		// submodule commits live in another repository
+		if entry.mode != 0160000 {
+			addRoot(hex.EncodeToString(entry.hash))
+		}
+	}
+	for _, tree := range trees {
+		addRoot(hex.EncodeToString(tree))
+	}
+	return roots
+}
+
+// packedLooseObjects lists the paths of loose objects that also exist in a
+// pack.
+func packedLooseObjects() []string {
+	paths := []string{}
+	for _, hash := range listLooseObjects(filepath.Join(gitDir, "objects")) {
+		if _, _, ok := findPackedObject(hash); ok {
+			paths = append(paths, looseObjectPath(hash))
+		}
+	}
+	return paths
+}
+
+// prunePackedObjects removes loose objects that also exist in a pack.
+func prunePackedObjects() {
+	for _, objPath := range packedLooseObjects() {
+		if err := os.Remove(objPath); err != nil {
+			fmt.Fprintf(os.Stderr, "error: unable to remove %s: %s\n", objPath, err)
+		}
+		os.Remove(filepath.Dir(objPath))
+	}
+}
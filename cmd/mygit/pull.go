@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func gitPull() {
+	usage := "pull [-q | --quiet] [-v | --verbose] [--progress] [--ff | --no-ff | --ff-only] [-r | --rebase | --no-rebase] [<remote> [<branch>...]]"
+
+	// like git pull, which updates the branch itself
+	opts := fetchOptions{updateHeadOK: true}
+	// unset unless given as option or in config
+	var rebase, ffMode string
+	if _, ok := getConfig("pull.rebase"); ok {
+		rebase = strconv.FormatBool(getConfigBool("pull.rebase", false))
+	}
+	if value, ok := getConfig("pull.ff"); ok {
+		ffMode = "only"
+		if strings.ToLower(value) != "only" {
+			ffMode = strconv.FormatBool(getConfigBool("pull.ff", true))
+		}
+	}
+
+	args := []string{}
+	for _, arg := range os.Args[2:] {
+		switch arg {
+		case "-q", "--quiet":
+			opts.quiet = true
+		case "-v", "--verbose":
+			opts.verbose = true
+		case "--progress":
+			opts.forceProgress = true
+		case "--ff":
+			ffMode = "true"
+		case "--no-ff":
+			ffMode = "false"
+		case "--ff-only":
+			ffMode = "only"
+		case "-r", "--rebase":
+			rebase = "true"
+		case "--no-rebase":
+			rebase = "false"
+		default:
+			if strings.HasPrefix(arg, "-") {
+				printUsageAndExit(usage)
+			}
+			args = append(args, arg)
+		}
+	}
+
+	branchRef := readSymbolicRef("HEAD")
+	if !strings.HasPrefix(branchRef, "refs/heads/") {
+		fatal("You are not currently on a branch.\nPlease specify which branch you want to merge with.\n")
+	}
+	branch := strings.TrimPrefix(branchRef, "refs/heads/")
+	remoteName := defaultRemote()
+	if len(args) > 0 {
+		remoteName = args[0]
+	} else if _, ok := getConfig("branch." + branch + ".merge"); !ok {
+		fatal("There is no tracking information for the current branch.\nPlease specify which branch you want to merge with.\n")
+	}
+	var refspecArgs []string
+	if len(args) > 1 {
+		refspecArgs = args[1:]
+	}
+	before := readRef("HEAD")
+	if !fetchRemote(remoteName, refspecArgs, opts) {
+		os.Exit(1)
+	}
+	// like git, the working tree follows when the fetch updated the branch
+	if after := readRef("HEAD"); before != "" && after != before {
+		fmt.Fprintf(os.Stderr, "warning: fetch updated the current branch head.\nwarning: fast-forwarding your working tree from\nwarning: commit %s.\n", before)
+		from, _ := hex.DecodeString(before)
+		to, _ := hex.DecodeString(after)
+		switchWorktree(readCommit(from).tree, readCommit(to).tree, "merge")
+	}
+
+	// the refs to merge are the ones fetched for merging
+	mergeHeads := []string{}
+	var mergeDescription string
+	content, _ := os.ReadFile(filepath.Join(gitDir, "FETCH_HEAD"))
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) == 3 && fields[1] == "" {
+			mergeHeads = append(mergeHeads, fields[0])
+			mergeDescription = fields[2]
+		}
+	}
+	switch {
+	case len(mergeHeads) == 0:
+		fatal("There is no candidate for merging among the refs that you just fetched.\n")
+	case len(mergeHeads) > 1:
+		fatal("fatal: merging more than one branch is not supported\n")
+	}
+	upstream, _ := hex.DecodeString(mergeHeads[0])
+
+	current := readRef("HEAD")
+	if current == "" {
+		// nothing to merge into
+		switchWorktree(nil, readCommit(upstream).tree, "merge")
+		writeRef(branchRef, mergeHeads[0])
+		return
+	}
+	head, _ := hex.DecodeString(current)
+	writeRef("ORIG_HEAD", current)
+
+	switch {
+	case isAncestor(upstream, head):
+		message := "Already up to date."
+		if rebase == "true" {
+			message = fmt.Sprintf("Current branch %s is up to date.", branch)
+		}
+		if !opts.quiet {
+			fmt.Println(message)
+		}
+	case isAncestor(head, upstream) && (ffMode != "false" || rebase == "true"):
+		if !opts.quiet {
+			fmt.Printf("Updating %s..%s\nFast-forward\n", abbrevHash(head, 7), abbrevHash(upstream, 7))
+		}
+		switchWorktree(readCommit(head).tree, readCommit(upstream).tree, "merge")
+		writeRef(branchRef, mergeHeads[0])
+	case rebase == "true":
+		if !worktreeClean(flattenTree(readCommit(head).tree)) {
+			fatal("error: cannot pull with rebase: You have unstaged changes.\nerror: please commit or stash them.\n")
+		}
+		tip := rebaseCommits(head, upstream)
+		switchWorktree(readCommit(head).tree, readCommit(tip).tree, "rebase")
+		writeRef(branchRef, hex.EncodeToString(tip))
+		if !opts.quiet {
+			fmt.Fprintf(os.Stderr, "Successfully rebased and updated %s.\n", branchRef)
+		}
+	case ffMode == "only":
+		fatal("fatal: Not possible to fast-forward, aborting.\n")
+	case rebase == "" && ffMode == "":
+		fatal("hint: You have divergent branches and need to specify how to reconcile them.\n" +
+			"hint: You can do so by running one of the following commands sometime before\n" +
+			"hint: your next pull:\n" +
+			"hint:\n" +
+			"hint:   git config pull.rebase false  # merge\n" +
+			"hint:   git config pull.rebase true   # rebase\n" +
+			"hint:   git config pull.ff only       # fast-forward only\n" +
+			"fatal: Need to specify how to reconcile divergent branches.\n")
+	default:
+		tip := mergeCommits(head, upstream, "Merge "+mergeDescription+"\n")
+		switchWorktree(readCommit(head).tree, readCommit(tip).tree, "merge")
+		writeRef(branchRef, hex.EncodeToString(tip))
+		if !opts.quiet {
+			fmt.Println("Merge made by the 'resolve' strategy.")
+		}
+	}
+}
+
+// switchWorktree updates the working tree from one tree to another, unless
+// local changes would be lost.
+func switchWorktree(from, to []byte, operation string) {
+	fromFiles, toFiles := flattenTree(from), flattenTree(to)
+	if err := checkWorktree(fromFiles, toFiles, operation); err != nil {
+		fatal("error: %s\n", err)
+	}
+	updateWorktree(fromFiles, toFiles)
+}
+
+// mergeCommits creates a merge commit of head and another commit. Conflicts
+// can't be recorded without an index, so nothing is changed then.
+func mergeCommits(head, other []byte, message string) []byte {
+	base := mergeBase(head, other)
+	if base == nil {
+		fatal("fatal: refusing to merge unrelated histories\n")
+	}
+	tree, conflicts := mergeTrees(readCommit(base).tree, readCommit(head).tree, readCommit(other).tree)
+	if len(conflicts) > 0 {
+		fmt.Println(strings.Join(conflicts, "\n"))
+		fatal("Automatic merge failed; resolving conflicts is not supported yet, nothing was changed.\n")
+	}
+	return writeCommit(tree, [][]byte{head, other}, "", message)
+}
+
+// rebaseCommits replays the commits of head that are not in upstream on top
+// of it, returning the new tip. Only the first parent of merges is followed
+// and merge commits themselves are dropped, like git rebase does by
+// default, and so are commits whose changes are already in upstream.
+func rebaseCommits(head, upstream []byte) []byte {
+	commits := [][]byte{}
+	for current := head; current != nil && !isAncestor(current, upstream); {
+		commit := readCommit(current)
+		if len(commit.parents) <= 1 {
+			commits = append([][]byte{current}, commits...)
+		}
+		current = nil
+		if len(commit.parents) > 0 {
+			current = commit.parents[0]
+		}
+	}
+
+	tip := upstream
+	for _, hash := range commits {
+		commit := readCommit(hash)
+		var parentTree []byte
+		if len(commit.parents) > 0 {
+			parentTree = readCommit(commit.parents[0]).tree
+		}
+		tipTree := readCommit(tip).tree
+		tree, conflicts := mergeTrees(parentTree, tipTree, commit.tree)
+		if len(conflicts) > 0 {
+			subject, _, _ := strings.Cut(commit.message, "\n")
+			fmt.Println(strings.Join(conflicts, "\n"))
+			fatal("error: could not apply %s... %s\nResolving conflicts is not supported yet, nothing was changed.\n", abbrevHash(hash, 7), subject)
+		}
+		if bytes.Equal(tree, tipTree) {
+			trace("dropping %x, its changes are already upstream", hash)
+			continue
+		}
+		tip = writeCommit(tree, [][]byte{tip}, commit.author, commit.message)
+	}
+	return tip
+}
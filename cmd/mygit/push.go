@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+func gitPush() {
+	usage := "push [-q | --quiet] [-v | --verbose] [-f | --force] [-d | --delete] [--atomic] [--force-with-lease[=<refname>[:<expect>]]] [<remote> [<refspec>...]]"
+
+	opts := pushOptions{leases: map[string]string{}}
+	args := []string{}
+	for _, arg := range os.Args[2:] {
+		switch {
+		case arg == "-q" || arg == "--quiet":
+			opts.quiet = true
+		case arg == "-v" || arg == "--verbose":
+			opts.verbose = true
+		case arg == "-f" || arg == "--force":
+			opts.force = true
+		case arg == "-d" || arg == "--delete":
+			opts.delete = true
+		case arg == "--atomic":
+			opts.atomic = true
+		case arg == "--force-with-lease":
+			opts.leaseAll = true
+		case strings.HasPrefix(arg, "--force-with-lease="):
+			name, expect, _ := strings.Cut(strings.TrimPrefix(arg, "--force-with-lease="), ":")
+			opts.leases[name] = expect
+		case strings.HasPrefix(arg, "-"):
+			printUsageAndExit(usage)
+		default:
+			args = append(args, arg)
+		}
+	}
+
+	remoteName := defaultRemote()
+	if len(args) > 0 {
+		remoteName = args[0]
+	}
+	var refspecArgs []string
+	if len(args) > 1 {
+		refspecArgs = args[1:]
+	}
+	if opts.delete {
+		if len(refspecArgs) == 0 {
+			fatal("fatal: --delete doesn't make sense without any refs\n")
+		}
+		for i, arg := range refspecArgs {
+			if strings.Contains(arg, ":") {
+				fatal("fatal: --delete only accepts plain target ref names\n")
+			}
+			refspecArgs[i] = ":" + arg
+		}
+	}
+	if !pushRemote(remoteName, refspecArgs, opts) {
+		os.Exit(1)
+	}
+}
+
+type pushOptions struct {
+	quiet, verbose        bool
+	force, delete, atomic bool
+	leaseAll              bool              // --force-with-lease for all refs
+	leases                map[string]string // --force-with-lease=<ref>[:<expect>]
+}
+
+// pushUpdate is a remote ref to update, with the result shown for it.
+type pushUpdate struct {
+	src, dst         string
+	oldHash, newHash string // zeroHash for a new or deleted ref
+	force            bool
+	flag             byte // '!' when rejected, '=' when up to date
+	summary, reason  string
+}
+
+// pushRemote pushes to a remote (or url) the local refs matching
+// refspecArgs, or the configured refspecs, or else the current branch. It
+// returns false if any ref was rejected.
+func pushRemote(remoteName string, refspecArgs []string, opts pushOptions) bool {
+	url := remoteURL(remoteName)
+	branchRef := readSymbolicRef("HEAD")
+
+	refspecs := remoteRefspecs(remoteName, "push")
+	if len(refspecArgs) > 0 {
+		refspecs = nil
+		for _, arg := range refspecArgs {
+			spec, err := parseRefspec(arg, true)
+			if err != nil {
+				fatal("fatal: %s\n", err)
+			}
+			refspecs = append(refspecs, spec)
+		}
+	}
+	if len(refspecs) == 0 {
+		// the current branch goes to its upstream on that remote, or to the
+		// branch with the same name
+		branch, ok := strings.CutPrefix(branchRef, "refs/heads/")
+		if !ok {
+			fatal("fatal: You are not currently on a branch.\nTo push the history leading to the current (detached HEAD)\nstate now, use\n\n    git push %s HEAD:<name-of-remote-branch>\n\n", remoteName)
+		}
+		dst := branchRef
+		if remote, _ := getConfig("branch." + branch + ".remote"); remote == remoteName {
+			if merge, ok := getConfig("branch." + branch + ".merge"); ok {
+				dst = merge
+			}
+		}
+		refspecs = append(refspecs, &refspec{src: branchRef, dst: dst})
+	}
+	// HEAD stands for the current branch
+	for _, spec := range refspecs {
+		if spec.src == "HEAD" && strings.HasPrefix(branchRef, "refs/heads/") {
+			spec.src = branchRef
+		}
+	}
+
+	remote, err := connectRemote(url, "git-receive-pack")
+	if err != nil {
+		fatal("fatal: %s\n", err)
+	}
+	defer remote.close()
+	if opts.atomic && !remote.hasCapability("atomic") {
+		fatal("fatal: the receiving end does not support --atomic push\n")
+	}
+	remoteRefs, err := remote.listRefs(nil)
+	if err != nil {
+		fatal("fatal: %s\n", err)
+	}
+	remoteHashes := map[string]string{}
+	remoteNames := []string{}
+	for _, ref := range remoteRefs {
+		remoteHashes[ref.name] = ref.hash
+		remoteNames = append(remoteNames, ref.name)
+	}
+	localRefs := listRefs()
+	if head := readRef("HEAD"); head != "" {
+		localRefs["HEAD"] = head
+	}
+	mappings, err := mapRefs(refspecs, sortedKeys(localRefs), remoteNames, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\nerror: failed to push some refs to '%s'\n", err, url)
+		return false
+	}
+
+	updates := []*pushUpdate{}
+	for _, mapping := range mappings {
+		update := &pushUpdate{src: mapping.src, dst: mapping.dst, oldHash: zeroHash, newHash: zeroHash, force: mapping.force || opts.force}
+		if hash, ok := remoteHashes[mapping.dst]; ok {
+			update.oldHash = hash
+		}
+		if hash, ok := localRefs[mapping.src]; ok {
+			update.newHash = hash
+		} else if mapping.src != "" {
+			update.newHash = mapping.src
+		}
+		checkPushUpdate(update, remoteName, opts)
+		if update.newHash == zeroHash && update.flag != '!' && !remote.hasCapability("delete-refs") {
+			update.flag, update.summary, update.reason = '!', "[rejected]", "remote does not support deleting refs"
+		}
+		updates = append(updates, update)
+	}
+	toSend := func(update *pushUpdate) bool {
+		return update.flag != '!' && update.flag != '='
+	}
+
+	// with --atomic, nothing is updated if anything is rejected
+	if opts.atomic && slices.ContainsFunc(updates, func(update *pushUpdate) bool { return update.flag == '!' }) {
+		for _, update := range updates {
+			if toSend(update) {
+				update.flag, update.summary, update.reason = '!', "[rejected]", "atomic push failed"
+			}
+		}
+	}
+
+	commands := []*pushCommand{}
+	tips := [][]byte{}
+	for _, update := range updates {
+		if toSend(update) {
+			commands = append(commands, &pushCommand{name: update.dst, oldHash: update.oldHash, newHash: update.newHash})
+			if hash, _ := hex.DecodeString(update.newHash); update.newHash != zeroHash {
+				tips = append(tips, hash)
+			}
+		}
+	}
+	if len(commands) > 0 {
+		// objects reachable from the remote refs are already there
+		exclude := [][]byte{}
+		for _, value := range remoteHashes {
+			if hash, _ := hex.DecodeString(value); hasObject(hash) {
+				exclude = append(exclude, hash)
+			}
+		}
+		statuses, err := remote.sendPack(commands, collectObjects(tips, exclude), opts.atomic, opts.quiet)
+		if err != nil && statuses == nil {
+			fatal("fatal: %s\n", err)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		}
+		for _, update := range updates {
+			if !toSend(update) {
+				continue
+			}
+			if status := statuses[update.dst]; statuses != nil && status != "ok" {
+				if status == "" {
+					status = "no status reported"
+				}
+				update.flag, update.summary, update.reason = '!', "[remote rejected]", status
+			} else if tracking := trackingRef(remoteName, update.dst); tracking != "" {
+				if update.newHash == zeroHash {
+					deleteRef(tracking)
+				} else {
+					writeRef(tracking, update.newHash)
+				}
+			}
+		}
+	}
+
+	return reportPush(updates, url, len(commands) > 0, opts)
+}
+
+// checkPushUpdate decides how a remote ref is updated, rejecting updates
+// that are not fast-forwards unless forced, changes to existing tags and,
+// with --force-with-lease, refs that are not at the expected value.
+func checkPushUpdate(update *pushUpdate, remoteName string, opts pushOptions) {
+	oldHash, _ := hex.DecodeString(update.oldHash)
+	newHash, _ := hex.DecodeString(update.newHash)
+	expect, hasLease := opts.lease(remoteName, update.dst)
+	isTag := strings.HasPrefix(update.dst, "refs/tags/")
+	switch {
+	case update.oldHash == update.newHash:
+		update.flag, update.summary = '=', "[up to date]"
+	case hasLease && expect != update.oldHash:
+		update.flag, update.summary, update.reason = '!', "[rejected]", "stale info"
+	case update.newHash == zeroHash:
+		update.flag, update.summary = '-', "[deleted]"
+	case update.oldHash == zeroHash:
+		update.flag, update.summary = '*', "[new reference]"
+		if isTag {
+			update.summary = "[new tag]"
+		} else if strings.HasPrefix(update.dst, "refs/heads/") {
+			update.summary = "[new branch]"
+		}
+	case (update.force || hasLease) && (isTag || !hasObject(oldHash) || !isAncestor(oldHash, newHash)):
+		update.flag, update.summary, update.reason = '+', abbrevHash(oldHash, 7)+"..."+abbrevHash(newHash, 7), "forced update"
+	case isTag:
+		update.flag, update.summary, update.reason = '!', "[rejected]", "already exists"
+	case !hasObject(oldHash):
+		update.flag, update.summary, update.reason = '!', "[rejected]", "fetch first"
+	case !isAncestor(oldHash, newHash):
+		update.flag, update.summary, update.reason = '!', "[rejected]", "non-fast-forward"
+	default:
+		update.flag, update.summary = ' ', abbrevHash(oldHash, 7)+".."+abbrevHash(newHash, 7)
+	}
+}
+
+// lease returns the value a remote ref is expected to have with
+// --force-with-lease: the one given, or the one of its remote-tracking ref
+// (zeroHash, i.e. no ref, without one).
+func (opts pushOptions) lease(remoteName, name string) (string, bool) {
+	expect, ok := "", opts.leaseAll
+	for lease, value := range opts.leases {
+		if slices.Contains(expandRefName(lease), name) {
+			expect, ok = value, true
+		}
+	}
+	switch {
+	case !ok:
+		return "", false
+	case expect != "":
+		return hex.EncodeToString(resolveRevision(expect)), true
+	}
+	if tracking := trackingRef(remoteName, name); tracking != "" {
+		if hash := readRef(tracking); hash != "" {
+			return hash, true
+		}
+	}
+	return zeroHash, true
+}
+
+// trackingRef returns the remote-tracking ref of a remote ref, mapped by the
+// fetch refspecs of the remote, or an empty string.
+func trackingRef(remoteName, name string) string {
+	refspecs := remoteRefspecs(remoteName, "fetch")
+	for _, spec := range refspecs {
+		if spec.negative && spec.matches(name) {
+			return ""
+		}
+	}
+	for _, spec := range refspecs {
+		if tracking, ok := spec.mapName(name); ok && !spec.negative && tracking != "" {
+			return tracking
+		}
+	}
+	return ""
+}
+
+// pushHints explain the reasons updates are rejected, as git does.
+var pushHints = map[string]string{
+	"non-fast-forward": "hint: Updates were rejected because a pushed branch tip is behind its remote\n" +
+		"hint: counterpart. Integrate the remote changes (e.g.\n" +
+		"hint: 'git pull ...') before pushing again.\n" +
+		"hint: See the 'Note about fast-forwards' in 'git push --help' for details.\n",
+	"fetch first": "hint: Updates were rejected because the remote contains work that you do\n" +
+		"hint: not have locally. This is usually caused by another repository pushing\n" +
+		"hint: to the same ref. You may want to first integrate the remote changes\n" +
+		"hint: (e.g., 'git pull ...') before pushing again.\n" +
+		"hint: See the 'Note about fast-forwards' in 'git push --help' for details.\n",
+	"already exists": "hint: Updates were rejected because the tag already exists in the remote.\n",
+}
+
+// reportPush shows the result of each update like git does, returning false
+// if any was rejected.
+func reportPush(updates []*pushUpdate, url string, pushed bool, opts pushOptions) bool {
+	ok := true
+	header := false
+	hints := []string{}
+	for _, update := range updates {
+		if update.flag == '!' {
+			ok = false
+			if hint, found := pushHints[update.reason]; found && !slices.Contains(hints, hint) {
+				hints = append(hints, hint)
+			}
+		}
+		if update.flag == '=' && !opts.verbose || opts.quiet && update.flag != '!' {
+			continue
+		}
+		if !header {
+			fmt.Fprintf(os.Stderr, "To %s\n", url)
+			header = true
+		}
+		line := fmt.Sprintf(" %c %-17s ", update.flag, update.summary)
+		switch hash, err := hex.DecodeString(update.src); {
+		case update.src == "":
+			line += shortRefName(update.dst)
+		case err == nil && len(hash) == 20:
+			// an object pushed by name, not a ref
+			line += abbrevHash(hash, 7) + " -> " + shortRefName(update.dst)
+		default:
+			line += shortRefName(update.src) + " -> " + shortRefName(update.dst)
+		}
+		if update.reason != "" {
+			line += " (" + update.reason + ")"
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+
+	if !ok {
+		fmt.Fprintf(os.Stderr, "error: failed to push some refs to '%s'\n", url)
+		for _, hint := range hints {
+			fmt.Fprint(os.Stderr, hint)
+		}
+	} else if !pushed && !opts.quiet {
+		fmt.Fprintln(os.Stderr, "Everything up-to-date")
+	}
+	return ok
+}
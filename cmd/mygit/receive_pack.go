@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Server side of git-receive-pack: the refs are advertised, then the
+// client sends ref update commands followed by a pack with the objects
+// they need, and gets the result of each update (report-status). The
+// repository served is the current one (gitDir).
+// reference: https://git-scm.com/docs/pack-protocol#_pushing_data_to_a_server
+
+func gitReceivePack() {
+	runServiceCommand("git-receive-pack", "receive-pack [--stateless-rpc] [--advertise-refs] <directory>")
+}
+
+// receivePack serves git-receive-pack, reading the requests from in and
+// writing the responses to out. There's no version 2 of it.
+func receivePack(in io.Reader, out io.Writer, opts serveOptions) error {
+	reader, writer := newPktReader(in), newPktWriter(out)
+	if opts.advertiseRefs || !opts.statelessRPC {
+		refs := []remoteRef{}
+		for _, ref := range advertisedRefs() {
+			if ref.name != "HEAD" {
+				ref.peeled = ""
+				refs = append(refs, ref)
+			}
+		}
+		capabilities := []string{"report-status", "delete-refs", "side-band-64k", "quiet", "atomic", "ofs-delta", "agent=" + agent}
+		if err := writeAdvertisement(writer, refs, capabilities); err != nil {
+			return err
+		}
+	}
+	if opts.advertiseRefs {
+		return nil
+	}
+
+	// "<old> <new> <ref>", with the capabilities after the first one
+	commands := []*pushCommand{}
+	var capabilities []string
+	for {
+		line, err := reader.readLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		line, rest, hasCapabilities := strings.Cut(line, "\000")
+		if hasCapabilities {
+			capabilities = strings.Fields(rest)
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !isHexString(fields[0]) || !isHexString(fields[1]) || len(fields[0]) != 40 || len(fields[1]) != 40 {
+			return fmt.Errorf("protocol error: invalid command %q", line)
+		}
+		commands = append(commands, &pushCommand{name: fields[2], oldHash: fields[0], newHash: fields[1]})
+	}
+	if len(commands) == 0 {
+		// the client only wanted the refs
+		return nil
+	}
+
+	// the pack follows the commands, unless all refs are deleted. Its
+	// objects stay in quarantine until a ref can use them, so a rejected
+	// push leaves nothing behind
+	var unpackErr error
+	var quarantine *objectQuarantine
+	if slices.ContainsFunc(commands, func(command *pushCommand) bool { return command.newHash != zeroHash }) {
+		if quarantine, unpackErr = startQuarantine(); unpackErr == nil {
+			defer quarantine.discard()
+			unpackErr = unpackObjects(in, false)
+		}
+	}
+
+	// the refs are checked and updated holding their locks, so concurrent
+	// pushes can't update them in between
+	statuses := map[string]string{}
+	locks := map[string]*refLock{}
+	var complete map[string]string
+	for _, command := range commands {
+		if command.newHash != zeroHash && unpackErr == nil && complete == nil {
+			complete = completeObjects()
+		}
+		switch {
+		case unpackErr != nil:
+			statuses[command.name] = "unpacker error"
+		case !strings.HasPrefix(command.name, "refs/") || !validRefName(command.name):
+			statuses[command.name] = "funny refname"
+		case command.newHash != zeroHash && !connected(command.newHash, complete):
+			statuses[command.name] = "missing necessary objects"
+		default:
+			lock, err := lockRef(command.name)
+			if err != nil {
+				statuses[command.name] = "failed to lock"
+				continue
+			}
+			locks[command.name] = lock
+			statuses[command.name] = checkReceiveCommand(command)
+		}
+	}
+	// with atomic, either all refs are updated or none
+	failed := slices.ContainsFunc(commands, func(command *pushCommand) bool { return statuses[command.name] != "ok" })
+	if failed && slices.Contains(capabilities, "atomic") {
+		for _, command := range commands {
+			if statuses[command.name] == "ok" {
+				statuses[command.name] = "atomic transaction failed"
+			}
+		}
+	}
+	// the objects are moved in before the refs point to them
+	if quarantine != nil && slices.ContainsFunc(commands, func(command *pushCommand) bool { return statuses[command.name] == "ok" }) {
+		if err := quarantine.migrate(); err != nil {
+			for _, command := range commands {
+				if statuses[command.name] == "ok" {
+					statuses[command.name] = "unable to migrate objects to permanent storage"
+				}
+			}
+		}
+	}
+	for _, command := range commands {
+		lock := locks[command.name]
+		if lock == nil {
+			continue
+		}
+		delete(locks, command.name)
+		if statuses[command.name] != "ok" {
+			lock.unlock()
+			continue
+		}
+		trace("receive-pack: %s %s -> %s", command.name, command.oldHash, command.newHash)
+		if err := lock.commit(command.newHash); err != nil {
+			statuses[command.name] = "failed to update ref"
+		}
+	}
+
+	if !slices.Contains(capabilities, "report-status") {
+		return unpackErr
+	}
+	report := writer
+	if slices.Contains(capabilities, "side-band-64k") {
+		report = newPktWriter(newSidebandWriter(writer, sidebandData, pktMaxData-1))
+	}
+	if unpackErr != nil {
+		report.writeLine("unpack %s", unpackErr)
+	} else {
+		report.writeLine("unpack ok")
+	}
+	for _, command := range commands {
+		if status := statuses[command.name]; status == "ok" {
+			report.writeLine("ok %s", command.name)
+		} else {
+			report.writeLine("ng %s %s", command.name, status)
+		}
+	}
+	report.flush()
+	if report != writer {
+		writer.flush()
+	}
+	return unpackErr
+}
+
+// checkReceiveCommand returns "ok" if a locked ref can be updated, or the
+// reason it's refused: its value is not the old one of the command any more
+// ("stale info") or, like git, the checked out branch of a repository with a
+// working tree can't be updated and the current branch can't be deleted,
+// and receive.denyNonFastForwards and receive.denyDeletes are honored.
+func checkReceiveCommand(command *pushCommand) string {
+	oldHash, _ := hex.DecodeString(command.oldHash)
+	newHash, _ := hex.DecodeString(command.newHash)
+	current := readRef(command.name)
+	if current == "" {
+		current = zeroHash
+	}
+	isCurrent := readSymbolicRef("HEAD") == command.name
+	switch {
+	case command.newHash != zeroHash && !hasObject(newHash):
+		return "missing necessary objects"
+	case current != command.oldHash:
+		return "stale info"
+	case command.newHash == zeroHash && isCurrent:
+		return "deletion of the current branch prohibited"
+	case command.newHash == zeroHash && getConfigBool("receive.denyDeletes", false):
+		return "deletion prohibited by config"
+	case isCurrent && !isBareRepository():
+		return "branch is currently checked out"
+	case command.oldHash != zeroHash && command.newHash != zeroHash && strings.HasPrefix(command.name, "refs/heads/") &&
+		getConfigBool("receive.denyNonFastForwards", false) && !isAncestor(oldHash, newHash):
+		return "non-fast-forward"
+	}
+	return "ok"
+}
+
+// completeObjects returns the objects a connectivity check can stop at:
+// everything reachable from the refs is in the repository, so their tips
+// and the content of their trees.
+func completeObjects() map[string]string {
+	complete := map[string]string{}
+	trees := []objectLink{}
+	for _, value := range listRefs() {
+		hash, err := hex.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		objType, content, err := loadObject(hash)
+		if err != nil {
+			continue
+		}
+		complete[value] = objType
+		if objType == "commit" {
+			for _, link := range objectLinks(objType, content) {
+				if link.objType == "tree" {
+					trees = append(trees, link)
+				}
+			}
+		}
+	}
+	walkObjectsFrom(trees, complete, nil)
+	return complete
+}
+
+// connected checks that all the objects reachable from a new ref value are
+// in the repository, walking down to complete objects.
+func connected(value string, complete map[string]string) bool {
+	hash, err := hex.DecodeString(value)
+	if err != nil {
+		return false
+	}
+	reached := make(map[string]string, len(complete))
+	for objName, objType := range complete {
+		reached[objName] = objType
+	}
+	missing := false
+	walkObjectsFrom([]objectLink{{hash: hash}}, reached, func(objectLink, []byte, string) {
+		missing = true
+	})
+	return !missing
+}
+
+// objectQuarantine is a temporary object directory where the objects
+// received are written, and read from first, until they are moved into the
+// object directory (or discarded).
+// reference: https://git-scm.com/docs/git-receive-pack#_quarantine_environment
+type objectQuarantine struct {
+	dir string
+}
+
+func startQuarantine() (*objectQuarantine, error) {
+	dir, err := os.MkdirTemp(filepath.Join(gitDir, "objects"), "incoming-")
+	if err != nil {
+		return nil, err
+	}
+	quarantineDir = dir
+	reloadPacks()
+	return &objectQuarantine{dir: dir}, nil
+}
+
+// end writes objects to the object directory again.
+func (q *objectQuarantine) end() {
+	if quarantineDir == q.dir {
+		quarantineDir = ""
+		reloadPacks()
+	}
+}
+
+// migrate moves the objects into the object directory, keeping the ones
+// already there.
+func (q *objectQuarantine) migrate() error {
+	q.end()
+	objectsDir := filepath.Join(gitDir, "objects")
+	err := filepath.WalkDir(q.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relative, err := filepath.Rel(q.dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(objectsDir, relative)
+		if fileExists(target) {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Rename(path, target)
+	})
+	os.RemoveAll(q.dir)
+	return err
+}
+
+// discard removes the quarantine with the objects left in it.
+func (q *objectQuarantine) discard() {
+	q.end()
+	os.RemoveAll(q.dir)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// readRef returns the hash a reference points to, following symbolic
+// references (e.g. HEAD) and falling back to .git/packed-refs. An empty
+// string is returned if the reference doesn't exist.
+func readRef(name string) string {
+	for depth := 0; depth < 5; depth++ {
+		path := filepath.Join(gitDir, filepath.FromSlash(name))
+		content, err := os.ReadFile(path)
+		if err != nil {
+			// a directory of refs (e.g. refs/remotes/origin) isn't a ref
+			// either
+			if info, statErr := os.Stat(path); !os.IsNotExist(err) && (statErr != nil || !info.IsDir()) {
+				fatal(err.Error())
+			}
+			return readPackedRefs()[name]
+		}
+		value := strings.TrimSpace(string(content))
+		if !strings.HasPrefix(value, "ref: ") {
+			return value
+		}
+		name = value[len("ref: "):]
+	}
+	fatal("fatal: reference nesting too deep: %s\n", name)
+	return ""
+}
+
+// readSymbolicRef returns the name of the reference a symbolic reference
+// points to, or an empty string if it isn't a symbolic reference.
+func readSymbolicRef(name string) string {
+	content, err := os.ReadFile(filepath.Join(gitDir, filepath.FromSlash(name)))
+	if err != nil {
+		return ""
+	}
+	target, ok := strings.CutPrefix(strings.TrimSpace(string(content)), "ref: ")
+	if !ok {
+		return ""
+	}
+	return target
+}
+
+// readPackedRefs parses .git/packed-refs into a map of ref name to hash.
+// Peeled lines ("^<hash>") are ignored.
+func readPackedRefs() map[string]string {
+	refs := map[string]string{}
+	file, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fatal(err.Error())
+		}
+		return refs
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		hash, name, ok := strings.Cut(line, " ")
+		if ok {
+			refs[name] = hash
+		}
+	}
+	return refs
+}
+
+// resolveRevision turns a revision name (full or abbreviated hash, ref
+// name, branch, tag...) into an object hash. Suffixes "^{tree}",
+// "^{commit}" and "^{}" peel the object to the requested type.
+func resolveRevision(name string) []byte {
+	hash, err := lookupRevision(name)
+	if err != nil {
+		fatal("fatal: %s\n", err)
+	}
+	return hash
+}
+
+// lookupRevision is resolveRevision returning an error when the name
+// doesn't resolve to an object.
+func lookupRevision(name string) ([]byte, error) {
+	for _, suffix := range []struct{ suffix, kind string }{{"^{}", ""}, {"^{tree}", "tree"}, {"^{commit}", "commit"}} {
+		if base, ok := strings.CutSuffix(name, suffix.suffix); ok {
+			hash, err := lookupRevision(base)
+			if err != nil {
+				return nil, err
+			}
+			return peelObject(hash, suffix.kind), nil
+		}
+	}
+
+	if len(name) == 40 {
+		if hash, err := hex.DecodeString(name); err == nil {
+			return hash, nil
+		}
+	}
+
+	for _, candidate := range expandRefName(name) {
+		if value := readRef(candidate); value != "" {
+			hash, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid reference %s: %q", candidate, value)
+			}
+			return hash, nil
+		}
+	}
+
+	if len(name) >= 4 && len(name) < 40 {
+		if _, err := hex.DecodeString(name + strings.Repeat("0", len(name)%2)); err == nil {
+			matches := findObjectsByPrefix(strings.ToLower(name))
+			if len(matches) > 1 {
+				return nil, fmt.Errorf("short object ID %s is ambiguous", name)
+			}
+			if len(matches) == 1 {
+				return matches[0], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("Not a valid object name %s", name)
+}
+
+// findObjectsByPrefix lists the loose and packed objects whose hex name
+// starts with the given prefix.
+func findObjectsByPrefix(prefix string) [][]byte {
+	var dirs []string
+	if len(prefix) >= 2 {
+		dirs = []string{prefix[:2]}
+	} else {
+		entries, _ := os.ReadDir(filepath.Join(gitDir, "objects"))
+		for _, entry := range entries {
+			if len(entry.Name()) == 2 && strings.HasPrefix(entry.Name(), prefix) {
+				dirs = append(dirs, entry.Name())
+			}
+		}
+	}
+
+	matches := [][]byte{}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(filepath.Join(gitDir, "objects", dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			objName := dir + entry.Name()
+			if len(objName) != 40 || !strings.HasPrefix(objName, prefix) {
+				continue
+			}
+			if hash, err := hex.DecodeString(objName); err == nil {
+				matches = append(matches, hash)
+			}
+		}
+	}
+
+	for _, pack := range getPacks() {
+		start, end := pack.index.findPrefix(prefix)
+		for i := start; i < end; i++ {
+			hash := pack.index.name(i)
+			if !slices.ContainsFunc(matches, func(h []byte) bool { return bytes.Equal(h, hash) }) {
+				matches = append(matches, hash)
+			}
+		}
+	}
+	return matches
+}
+
+// abbrevHash returns the shortest unique prefix of the hash with at least
+// minLength hex digits: one digit longer than the longest prefix it shares
+// with another object.
+func abbrevHash(hash []byte, minLength int) string {
+	objName := hex.EncodeToString(hash)
+	if minLength < 4 {
+		minLength = 4
+	}
+	if minLength >= len(objName) {
+		return objName
+	}
+	length := minLength
+	for _, other := range findObjectsByPrefix(objName[:minLength]) {
+		otherName := hex.EncodeToString(other)
+		common := 0
+		for common < len(objName) && objName[common] == otherName[common] {
+			common++
+		}
+		if common < len(objName) && common >= length {
+			length = common + 1
+		}
+	}
+	return objName[:length]
+}
+
+// peelObject follows tags (and commits, when a tree is wanted) until an
+// object of the wanted type is found. An empty type peels tags only.
+func peelObject(hash []byte, wantType string) []byte {
+	for {
+		objType, _, content := readObject(hash)
+		if objType == wantType || (wantType == "" && objType != "tag") {
+			return hash
+		}
+
+		var header string
+		switch {
+		case objType == "tag":
+			header = "object "
+		case objType == "commit" && wantType == "tree":
+			header = "tree "
+		default:
+			fatal("fatal: object %x is a %s, not a %s\n", hash, objType, wantType)
+		}
+
+		line, _, _ := strings.Cut(string(content), "\n")
+		value, ok := strings.CutPrefix(line, header)
+		if !ok {
+			fatal("fatal: invalid %s object %x\n", objType, hash)
+		}
+		peeled, err := hex.DecodeString(value)
+		if err != nil || len(peeled) != 20 {
+			fatal("fatal: invalid %s object %x\n", objType, hash)
+		}
+		hash = peeled
+	}
+}
+
+// listRefs returns all references under refs/ (loose and packed) with the
+// hash they point to. Symbolic references are resolved.
+func listRefs() map[string]string {
+	refs := readPackedRefs()
+	refsDir := filepath.Join(gitDir, "refs")
+	filepath.WalkDir(refsDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		relative, _ := filepath.Rel(gitDir, path)
+		name := filepath.ToSlash(relative)
+		if value := readRef(name); value != "" {
+			refs[name] = value
+		}
+		return nil
+	})
+	return refs
+}
+
+// readReflogs returns, for each reference with a log in .git/logs, all the
+// object names recorded in it (old and new values of each update).
+func readReflogs() map[string][]string {
+	reflogs := map[string][]string{}
+	logsDir := filepath.Join(gitDir, "logs")
+	filepath.WalkDir(logsDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		relative, _ := filepath.Rel(logsDir, path)
+		name := filepath.ToSlash(relative)
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) < 3 {
+				continue
+			}
+			for _, value := range fields[:2] {
+				if value != zeroHash {
+					reflogs[name] = append(reflogs[name], value)
+				}
+			}
+		}
+		return nil
+	})
+	return reflogs
+}
+
+const zeroHash = "0000000000000000000000000000000000000000"
+
+// packRefs moves all loose references (except symbolic ones) into
+// .git/packed-refs, recording the peeled value of annotated tags.
+func packRefs() {
+	refs := readPackedRefs()
+	loose := map[string]string{}
+	filepath.WalkDir(filepath.Join(gitDir, "refs"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		value := strings.TrimSpace(string(content))
+		if _, err := hex.DecodeString(value); err != nil || len(value) != 40 {
+			return nil // symbolic or invalid reference
+		}
+		relative, _ := filepath.Rel(gitDir, path)
+		name := filepath.ToSlash(relative)
+		refs[name], loose[name] = value, value
+		return nil
+	})
+
+	var content strings.Builder
+	content.WriteString("# pack-refs with: peeled fully-peeled sorted \n")
+	for _, name := range sortedKeys(refs) {
+		fmt.Fprintf(&content, "%s %s\n", refs[name], name)
+		hash, _ := hex.DecodeString(refs[name])
+		if !hasObject(hash) {
+			continue
+		}
+		if objType, _, _ := readObject(hash); objType == "tag" {
+			fmt.Fprintf(&content, "^%x\n", peelObject(hash, ""))
+		}
+	}
+	writeFileAtomic(filepath.Join(gitDir, "packed-refs"), []byte(content.String()))
+
+	for name, value := range loose {
+		path := filepath.Join(gitDir, filepath.FromSlash(name))
+		if current, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(current)) == value {
+			os.Remove(path)
+			removeEmptyRefDirs(filepath.Dir(path))
+		}
+	}
+}
+
+// removeEmptyRefDirs removes empty directories left after deleting a
+// reference, keeping the top level ones (refs/heads, refs/tags...).
+func removeEmptyRefDirs(dir string) {
+	for {
+		relative, err := filepath.Rel(filepath.Join(gitDir, "refs"), dir)
+		if err != nil || !strings.Contains(filepath.ToSlash(relative), "/") {
+			return
+		}
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// writeFileAtomic writes the content to "<path>.lock" and then renames it
+// to its final name, so readers never see a partial file.
+func writeFileAtomic(path string, content []byte) {
+	lockPath := path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		fatal("fatal: unable to create '%s': %s\n", lockPath, err)
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(lockPath, path)
+	}
+	if err != nil {
+		os.Remove(lockPath)
+		fatal(err.Error())
+	}
+}
+
+// writeRef points a reference to a hash, creating its directories.
+func writeRef(name, hash string) {
+	path := filepath.Join(gitDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fatal(err.Error())
+	}
+	writeFileAtomic(path, []byte(hash+"\n"))
+}
+
+// refLock holds "<ref>.lock", which keeps other processes from updating the
+// ref, so its value can be checked and then changed without races.
+type refLock struct {
+	name, path string
+	file       *os.File
+}
+
+// lockRef creates the lock file of a ref, failing if it already exists.
+func lockRef(name string) (*refLock, error) {
+	path := filepath.Join(gitDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &refLock{name: name, path: path, file: file}, nil
+}
+
+// commit points the locked ref to a hash, or deletes it for the zero hash,
+// and releases the lock.
+func (lock *refLock) commit(hash string) error {
+	if hash == zeroHash {
+		deleteRef(lock.name)
+		lock.unlock()
+		return nil
+	}
+	_, err := lock.file.WriteString(hash + "\n")
+	if closeErr := lock.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(lock.path+".lock", lock.path)
+	}
+	if err != nil {
+		os.Remove(lock.path + ".lock")
+	}
+	return err
+}
+
+// unlock releases the lock without changing the ref, removing the
+// directories made for it if left empty.
+func (lock *refLock) unlock() {
+	lock.file.Close()
+	os.Remove(lock.path + ".lock")
+	removeEmptyRefDirs(filepath.Dir(lock.path))
+}
+
+// writeSymbolicRef makes a symbolic reference (e.g. HEAD) point to another
+// reference.
+func writeSymbolicRef(name, target string) {
+	path := filepath.Join(gitDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fatal(err.Error())
+	}
+	writeFileAtomic(path, []byte("ref: "+target+"\n"))
+}
+
+// deleteRef removes a reference, loose or packed.
+func deleteRef(name string) {
+	path := filepath.Join(gitDir, filepath.FromSlash(name))
+	if err := os.Remove(path); err == nil {
+		removeEmptyRefDirs(filepath.Dir(path))
+	} else if !os.IsNotExist(err) {
+		fatal(err.Error())
+	}
+
+	packedPath := filepath.Join(gitDir, "packed-refs")
+	content, err := os.ReadFile(packedPath)
+	if err != nil {
+		return
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	kept := []string{}
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if _, refName, _ := strings.Cut(line, " "); refName == name && !strings.HasPrefix(line, "#") {
+			// along with its peeled value
+			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "^") {
+				i++
+			}
+			continue
+		}
+		kept = append(kept, lines[i])
+	}
+	if len(kept) != len(lines) {
+		writeFileAtomic(packedPath, []byte(strings.Join(kept, "")))
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A refspec maps refs of a repository to refs of another one, from the
+// remote to the local repository for fetch and the other way for push:
+// "[+]<src>:<dst>". The "+" allows updates that are not fast-forwards, a
+// "*" in both sides matches any part of the name, "^<src>" leaves refs out
+// and, for push, ":<dst>" deletes a remote ref and ":" pushes the branches
+// existing in both sides.
+// reference: https://git-scm.com/docs/git-fetch#Documentation/git-fetch.txt-ltrefspecgt
+// reference: https://git-scm.com/docs/git-push#Documentation/git-push.txt-ltrefspecgt82308203
+type refspec struct {
+	force    bool
+	negative bool
+	glob     bool
+	matching bool // ":" for push
+	src, dst string
+}
+
+// refMapping is a ref matched by a refspec, with the name it maps to. For
+// push, an empty src means deleting dst.
+type refMapping struct {
+	src, dst string
+	force    bool
+}
+
+func parseRefspec(value string, push bool) (*refspec, error) {
+	invalid := fmt.Errorf("invalid refspec '%s'", value)
+	spec := &refspec{}
+	rest := value
+	if rest, spec.negative = strings.CutPrefix(rest, "^"); !spec.negative {
+		rest, spec.force = strings.CutPrefix(rest, "+")
+	}
+
+	var hasDst bool
+	if i := strings.LastIndexByte(rest, ':'); i >= 0 {
+		spec.src, spec.dst, hasDst = rest[:i], rest[i+1:], true
+	} else {
+		spec.src = rest
+	}
+	spec.glob = strings.Contains(spec.src, "*")
+
+	switch {
+	case spec.negative && (hasDst || spec.src == ""):
+		return nil, invalid
+	case spec.glob && hasDst && spec.dst != "" && !strings.Contains(spec.dst, "*"):
+		return nil, invalid
+	case !spec.glob && strings.Contains(spec.dst, "*"):
+		return nil, invalid
+	case strings.Count(spec.src, "*") > 1 || strings.Count(spec.dst, "*") > 1:
+		return nil, invalid
+	case push && spec.src == "" && spec.dst == "":
+		// push the branches with the same name on both sides
+		spec.matching = true
+		return spec, nil
+	case push && spec.src == "" && !hasDst:
+		return nil, invalid
+	case !push && spec.src == "":
+		spec.src = "HEAD"
+	}
+
+	for _, name := range []string{spec.src, spec.dst} {
+		if name != "" && !validRefName(strings.Replace(name, "*", "x", 1)) && !(push && name == spec.src && isHexString(name)) {
+			return nil, invalid
+		}
+	}
+	return spec, nil
+}
+
+// remoteRefspecs returns the refspecs configured for a remote, in
+// remote.<name>.fetch or remote.<name>.push.
+func remoteRefspecs(remoteName, kind string) []*refspec {
+	refspecs := []*refspec{}
+	for _, value := range getConfigAll("remote." + remoteName + "." + kind) {
+		spec, err := parseRefspec(value, kind == "push")
+		if err != nil {
+			fatal("fatal: %s\n", err)
+		}
+		refspecs = append(refspecs, spec)
+	}
+	return refspecs
+}
+
+// validRefName checks the rules of git check-ref-format loosely: no
+// control characters, spaces, "..", "@{" or any of "~^:?[\*", and no
+// component starting with "." or ending with ".lock".
+func validRefName(name string) bool {
+	if name == "" || name == "@" || strings.Contains(name, "..") || strings.Contains(name, "@{") || strings.ContainsAny(name, " ~^:?[\\*") {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || component[0] == '.' || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	return !strings.HasSuffix(name, ".")
+}
+
+// expandRefName lists the full names a short ref name can stand for, in the
+// order they are tried (e.g. "main" is "refs/heads/main" unless there's a
+// tag with that name).
+// reference: https://git-scm.com/docs/gitrevisions#Documentation/gitrevisions.txt-emltrefnamegtemegemmasterememheadsmasterememrefsheadsmasterem
+func expandRefName(name string) []string {
+	return []string{
+		name,
+		"refs/" + name,
+		"refs/tags/" + name,
+		"refs/heads/" + name,
+		"refs/remotes/" + name,
+		"refs/remotes/" + name + "/HEAD",
+	}
+}
+
+// matchGlob returns the part of the name matched by the "*" of a pattern.
+func matchGlob(pattern, name string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// matches checks if a full ref name matches the source of the refspec.
+func (spec *refspec) matches(name string) bool {
+	if spec.glob {
+		_, ok := matchGlob(spec.src, name)
+		return ok
+	}
+	return name == spec.src
+}
+
+// mapName returns the destination of a full ref name matching the source,
+// e.g. the remote-tracking ref of a remote branch.
+func (spec *refspec) mapName(name string) (string, bool) {
+	if !spec.glob {
+		return spec.dst, name == spec.src
+	}
+	match, ok := matchGlob(spec.src, name)
+	if !ok {
+		return "", false
+	}
+	return strings.Replace(spec.dst, "*", match, 1), true
+}
+
+// prefixes are the ones to ask a remote for, to list the refs the refspec
+// can match.
+func (spec *refspec) prefixes() []string {
+	if spec.glob {
+		return []string{spec.src[:strings.IndexByte(spec.src, '*')]}
+	}
+	if strings.HasPrefix(spec.src, "refs/") || spec.src == "HEAD" {
+		return []string{spec.src}
+	}
+	return expandRefName(spec.src)
+}
+
+// String formats the refspec back, as written in config.
+func (spec *refspec) String() string {
+	var value strings.Builder
+	if spec.negative {
+		value.WriteByte('^')
+	} else if spec.force {
+		value.WriteByte('+')
+	}
+	value.WriteString(spec.src)
+	if spec.dst != "" || spec.matching || spec.src == "" {
+		value.WriteString(":" + spec.dst)
+	}
+	return value.String()
+}
+
+// mapRefs applies refspecs to the refs of the source side (remote refs for
+// fetch, local refs for push). A refspec without "*" must match exactly one
+// ref, the first one found with expandRefName for short names. Refs
+// matching a negative refspec are left out. dstNames are the refs on the
+// other side, used by push for ":" and deletions.
+func mapRefs(refspecs []*refspec, srcNames, dstNames []string, push bool) ([]refMapping, error) {
+	mappings := []refMapping{}
+	seen := map[refMapping]bool{}
+	add := func(mapping refMapping) {
+		for _, spec := range refspecs {
+			if spec.negative && mapping.src != "" && spec.matches(mapping.src) {
+				return
+			}
+		}
+		if !seen[mapping] {
+			seen[mapping] = true
+			mappings = append(mappings, mapping)
+		}
+	}
+
+	for _, spec := range refspecs {
+		switch {
+		case spec.negative:
+		case spec.matching:
+			for _, name := range srcNames {
+				if strings.HasPrefix(name, "refs/heads/") && slices.Contains(dstNames, name) {
+					add(refMapping{src: name, dst: name, force: spec.force})
+				}
+			}
+		case spec.glob:
+			for _, name := range srcNames {
+				if dst, ok := spec.mapName(name); ok {
+					add(refMapping{src: name, dst: dst, force: spec.force})
+				}
+			}
+		case push && spec.src == "":
+			dst := findRefName(spec.dst, dstNames)
+			if dst == "" {
+				return nil, fmt.Errorf("unable to delete '%s': remote ref does not exist", spec.dst)
+			}
+			add(refMapping{dst: dst, force: true})
+		default:
+			src := findRefName(spec.src, srcNames)
+			if src == "" && push {
+				// any object can be pushed, e.g. by an abbreviated hash
+				if hash, err := lookupRevision(spec.src); err == nil {
+					src = hex.EncodeToString(hash)
+				}
+			}
+			if src == "" {
+				if push {
+					return nil, fmt.Errorf("src refspec %s does not match any", spec.src)
+				}
+				return nil, fmt.Errorf("couldn't find remote ref %s", spec.src)
+			}
+			dst, err := spec.localName(src, dstNames, push)
+			if err != nil {
+				return nil, err
+			}
+			add(refMapping{src: src, dst: dst, force: spec.force})
+		}
+	}
+	return mappings, nil
+}
+
+// localName completes the destination of a refspec without "*": a short
+// name is a branch for fetch, and for push it's the existing remote ref or
+// a ref of the same kind as the source. Without destination, push updates
+// the ref with the same name.
+func (spec *refspec) localName(src string, dstNames []string, push bool) (string, error) {
+	dst := spec.dst
+	switch {
+	case dst == "" && !push:
+		return "", nil
+	case dst == "" && !strings.HasPrefix(src, "refs/"):
+		return "", fmt.Errorf("%s cannot be resolved to branch", spec.src)
+	case dst == "":
+		dst = src
+	case strings.HasPrefix(dst, "refs/"):
+	case !push:
+		for _, prefix := range []string{"heads/", "tags/", "remotes/"} {
+			if strings.HasPrefix(dst, prefix) {
+				return "refs/" + dst, nil
+			}
+		}
+		dst = "refs/heads/" + dst
+	default:
+		if existing := findRefName(dst, dstNames); existing != "" {
+			return existing, nil
+		}
+		switch {
+		case strings.HasPrefix(src, "refs/heads/"):
+			dst = "refs/heads/" + dst
+		case strings.HasPrefix(src, "refs/tags/"):
+			dst = "refs/tags/" + dst
+		default:
+			return "", fmt.Errorf("the destination you provided is not a full refname (i.e., starting with \"refs/\"): %s", dst)
+		}
+	}
+	return dst, nil
+}
+
+// findRefName returns the full name of a ref among the names, trying the
+// expansions of a short name in order.
+func findRefName(name string, names []string) string {
+	for _, candidate := range expandRefName(name) {
+		if slices.Contains(names, candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Demultiplexing of the side-band (and side-band-64k) capability: each
+// packet of the response starts with a byte telling its channel, 1 for pack
+// data, 2 for progress messages and 3 for a fatal error.
+// reference: https://git-scm.com/docs/protocol-capabilities#_side_band_side_band_64k
+
+const (
+	sidebandData     = 1
+	sidebandProgress = 2
+	sidebandError    = 3
+)
+
+type sidebandReader struct {
+	packets  *pktReader
+	pending  []byte    // data from channel 1 not read yet
+	progress io.Writer // where remote messages go, nil to discard them
+	message  []byte    // incomplete progress line
+	done     bool
+}
+
+// newSidebandReader returns a reader for the pack data (channel 1). Remote
+// progress is written to progress, prefixed with "remote: " like git does.
+func newSidebandReader(packets *pktReader, progress io.Writer) *sidebandReader {
+	return &sidebandReader{packets: packets, progress: progress}
+}
+
+func (r *sidebandReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		kind, data, err := r.packets.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		if kind == pktFlush {
+			r.done = true
+			r.showProgress(nil, true)
+			continue
+		}
+		if kind != pktData || len(data) == 0 {
+			return 0, errors.New("protocol error: bad band packet")
+		}
+
+		switch data[0] {
+		case sidebandData:
+			r.pending = data[1:]
+		case sidebandProgress:
+			r.showProgress(data[1:], false)
+		case sidebandError:
+			r.showProgress(nil, true)
+			return 0, fmt.Errorf("remote error: %s", strings.TrimSpace(string(data[1:])))
+		default:
+			return 0, fmt.Errorf("protocol error: bad band #%d", data[0])
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// showProgress writes the complete lines of remote messages, ended by "\n"
+// or "\r" (progress updates that rewrite the same line).
+func (r *sidebandReader) showProgress(data []byte, final bool) {
+	if r.progress == nil {
+		return
+	}
+	r.message = append(r.message, data...)
+	for {
+		end := bytes.IndexAny(r.message, "\r\n")
+		if end < 0 {
+			break
+		}
+		fmt.Fprintf(r.progress, "remote: %s%c", r.message[:end], r.message[end])
+		r.message = r.message[end+1:]
+	}
+	if final && len(r.message) > 0 {
+		fmt.Fprintf(r.progress, "remote: %s\n", r.message)
+		r.message = nil
+	}
+}
+
+// sidebandWriter multiplexes data on a channel, in packets of up to
+// maxData bytes (plus the channel byte).
+type sidebandWriter struct {
+	packets *pktWriter
+	channel byte
+	maxData int
+}
+
+func newSidebandWriter(packets *pktWriter, channel byte, maxData int) *sidebandWriter {
+	return &sidebandWriter{packets: packets, channel: channel, maxData: maxData}
+}
+
+func (w *sidebandWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		size := len(p)
+		if size > w.maxData {
+			size = w.maxData
+		}
+		packet := append([]byte{w.channel}, p[:size]...)
+		if err := w.packets.writePacket(packet); err != nil {
+			return written, err
+		}
+		written += size
+		p = p[size:]
+	}
+	return written, nil
+}
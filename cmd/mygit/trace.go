@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Debug output, enabled like git's with environment variables: GIT_TRACE
+// for general messages and GIT_TRACE_PACKET for the pkt-lines exchanged
+// with a remote. A value of "1", "2" or "true" writes to stderr, and an
+// absolute path appends to that file.
+// reference: https://git-scm.com/docs/git#Documentation/git.txt-codeGITTRACEcode
+
+var traceWriters = map[string]io.Writer{}
+var traceMutex sync.Mutex
+
+func traceWriter(envName string) io.Writer {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if writer, ok := traceWriters[envName]; ok {
+		return writer
+	}
+	var writer io.Writer
+	switch value := os.Getenv(envName); strings.ToLower(value) {
+	case "", "0", "false":
+	case "1", "2", "true":
+		writer = os.Stderr
+	default:
+		if filepath.IsAbs(value) {
+			file, err := os.OpenFile(value, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: could not open '%s' for tracing: %s\n", value, err)
+				break
+			}
+			writer = file
+		} else {
+			writer = os.Stderr
+		}
+	}
+	traceWriters[envName] = writer
+	return writer
+}
+
+// trace writes a debug message when GIT_TRACE is enabled.
+func trace(format string, args ...any) {
+	if writer := traceWriter("GIT_TRACE"); writer != nil {
+		fmt.Fprintf(writer, "%s trace: %s\n", time.Now().Format("15:04:05.000000"), fmt.Sprintf(format, args...))
+	}
+}
+
+// packTraced tells, by direction, if the start of a pack was seen: the rest
+// of it, on side-band channel 1, isn't dumped until the flush ending it.
+var packTraced [2]bool
+
+// tracePacket logs a pkt-line payload when GIT_TRACE_PACKET is enabled, with
+// non-printable characters escaped. Pack data is not dumped.
+func tracePacket(outgoing bool, data []byte) {
+	writer := traceWriter("GIT_TRACE_PACKET")
+	if writer == nil {
+		return
+	}
+	direction, index := '<', 0
+	if outgoing {
+		direction, index = '>', 1
+	}
+	isPack := len(data) > 0 && data[0] <= 3 && strings.HasPrefix(string(data[1:]), "PACK") || strings.HasPrefix(string(data), "PACK")
+	traceMutex.Lock()
+	skip := packTraced[index] && len(data) > 0 && data[0] == sidebandData
+	if isPack {
+		packTraced[index] = true
+	} else if string(data) == "0000" {
+		packTraced[index] = false
+	}
+	traceMutex.Unlock()
+	if skip {
+		return
+	}
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s packet: %12s%c ", time.Now().Format("15:04:05.000000"), "git", direction)
+	if len(data) > 0 && data[len(data)-1] == '\n' {
+		data = data[:len(data)-1]
+	}
+	if isPack {
+		line.WriteString("PACK ...")
+		data = nil
+	}
+	for _, c := range data {
+		if c == '\t' || (c >= 0x20 && c < 0x7f) {
+			line.WriteByte(c)
+		} else {
+			fmt.Fprintf(&line, "\\%o", c)
+		}
+	}
+	line.WriteByte('\n')
+	io.WriteString(writer, line.String())
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A transport carries the requests to a remote repository's services
+// (git-upload-pack to fetch, git-receive-pack to push) and their responses.
+//
+// Smart HTTP is stateless: the advertisement comes from a GET and each
+// request is a separate POST, so the client has to repeat any state in each
+// request. Transports built on a single connection keep the state.
+// reference: https://git-scm.com/docs/http-protocol
+type transport interface {
+	// advertise starts the service and returns its advertisement of refs
+	// and capabilities. version is the protocol version asked for.
+	advertise(service string, version int) (io.Reader, error)
+	// request sends a request to the service and returns its response.
+	request(service string, body []byte) (io.Reader, error)
+	stateless() bool
+	close() error
+}
+
+func newTransport(url string) (transport, error) {
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return &httpTransport{url: strings.TrimSuffix(url, "/")}, nil
+	}
+	if rest, ok := strings.CutPrefix(url, "git://"); ok {
+		host, path, _ := strings.Cut(rest, "/")
+		path = "/" + path
+		if strings.HasPrefix(path, "/~") {
+			path = path[1:]
+		}
+		return &gitTransport{host: host, path: path}, nil
+	}
+	if user, host, port, path, ok := parseSSHURL(url); ok {
+		return &sshTransport{user: user, host: host, port: port, path: path}, nil
+	}
+	if path, ok := localRepositoryPath(url); ok || strings.HasPrefix(url, "file://") {
+		if !ok {
+			path = strings.TrimPrefix(url, "file://")
+		}
+		dir, err := findGitDir(path)
+		if err != nil {
+			return nil, err
+		}
+		if dir, err = filepath.Abs(dir); err != nil {
+			return nil, err
+		}
+		return &localTransport{dir: dir}, nil
+	}
+	return nil, fmt.Errorf("unsupported repository url: %s", url)
+}
+
+// localRepositoryPath returns the path of a repository given as a plain
+// path instead of a url.
+func localRepositoryPath(url string) (string, bool) {
+	if _, _, _, _, ok := parseSSHURL(url); ok || strings.Contains(url, "://") {
+		return "", false
+	}
+	return url, true
+}
+
+// parseSSHURL splits the urls of repositories accessed through ssh:
+// "ssh://[<user>@]<host>[:<port>]/<path>" or the scp-like syntax
+// "[<user>@]<host>:<path>", recognized by a colon before any slash. A path
+// starting with "~" is relative to a home directory.
+// reference: https://git-scm.com/docs/git-clone#_git_urls
+func parseSSHURL(url string) (user, host, port, path string, ok bool) {
+	var authority string
+	for _, scheme := range []string{"ssh://", "git+ssh://", "ssh+git://"} {
+		if rest, found := strings.CutPrefix(url, scheme); found {
+			authority, path, _ = strings.Cut(rest, "/")
+			path = "/" + path
+			if strings.HasPrefix(path, "/~") {
+				path = path[1:]
+			}
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		colon := strings.IndexByte(url, ':')
+		if colon <= 0 || strings.Contains(url[:colon], "/") || strings.HasPrefix(url[colon:], "://") {
+			return "", "", "", "", false
+		}
+		// "[host:port]:path" is also accepted, like git
+		if strings.HasPrefix(url, "[") {
+			if end := strings.Index(url, "]:"); end > 0 {
+				colon = end + 1
+			}
+		}
+		authority, path, ok = url[:colon], url[colon+1:], true
+	}
+
+	if at := strings.LastIndexByte(authority, '@'); at >= 0 {
+		user, authority = authority[:at], authority[at+1:]
+	}
+	host = authority
+	if strings.HasPrefix(authority, "[") && strings.Contains(authority, "]") {
+		// [<host>] or [<host>:<port>] (IPv6 addresses)
+		end := strings.IndexByte(authority, ']')
+		host = authority[1:end]
+		if rest := authority[end+1:]; strings.HasPrefix(rest, ":") {
+			port = rest[1:]
+		} else if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[:i], ":") {
+			host, port = host[:i], host[i+1:]
+		}
+	} else if i := strings.LastIndexByte(authority, ':'); i >= 0 {
+		host, port = authority[:i], authority[i+1:]
+	}
+	if host == "" || path == "" {
+		return "", "", "", "", false
+	}
+	return user, host, port, path, true
+}
+
+type httpTransport struct {
+	url      string
+	version  int
+	response io.Closer // body of the last response, closed on the next one
+}
+
+func (t *httpTransport) stateless() bool {
+	return true
+}
+
+func (t *httpTransport) advertise(service string, version int) (io.Reader, error) {
+	t.version = version
+	request, err := http.NewRequest("GET", t.url+"/info/refs?service="+service, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t.send(request, "application/x-"+service+"-advertisement")
+}
+
+func (t *httpTransport) request(service string, body []byte) (io.Reader, error) {
+	request, err := http.NewRequest("POST", t.url+"/"+service, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-"+service+"-request")
+	request.Header.Set("Accept", "application/x-"+service+"-result")
+	return t.send(request, "application/x-"+service+"-result")
+}
+
+func (t *httpTransport) send(request *http.Request, contentType string) (io.Reader, error) {
+	if t.version == 2 {
+		request.Header.Set("Git-Protocol", "version=2")
+	}
+	trace("%s %s", request.Method, request.URL)
+	t.close()
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	t.response = response.Body
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("could not fetch %q - status code: %d", t.url, response.StatusCode)
+	}
+	if actual := response.Header.Get("Content-Type"); actual != contentType {
+		return nil, fmt.Errorf("unexpected content type: %q", actual)
+	}
+	return response.Body, nil
+}
+
+func (t *httpTransport) close() error {
+	if t.response == nil {
+		return nil
+	}
+	err := t.response.Close()
+	t.response = nil
+	return err
+}
+
+// localTransport serves a repository on disk in-process: each request is
+// handled by the server side of the service, switching to that repository
+// meanwhile, and the response is returned whole, like smart HTTP.
+type localTransport struct {
+	dir     string
+	version int
+}
+
+func (t *localTransport) stateless() bool {
+	return true
+}
+
+func (t *localTransport) advertise(service string, version int) (io.Reader, error) {
+	t.version = version
+	return t.serve(service, nil, serveOptions{version: version, statelessRPC: true, advertiseRefs: true})
+}
+
+func (t *localTransport) request(service string, body []byte) (io.Reader, error) {
+	return t.serve(service, body, serveOptions{version: t.version, statelessRPC: true})
+}
+
+func (t *localTransport) serve(service string, body []byte, opts serveOptions) (io.Reader, error) {
+	trace("serving %s from %s", service, t.dir)
+	restore := useRepository(t.dir)
+	defer restore()
+	var response bytes.Buffer
+	if err := serveService(service, bytes.NewReader(body), &response, opts); err != nil {
+		trace("%s: %s", service, err)
+	}
+	return &response, nil
+}
+
+func (t *localTransport) close() error {
+	return nil
+}
+
+// serveService runs the server side of a service on the current
+// repository.
+func serveService(service string, in io.Reader, out io.Writer, opts serveOptions) error {
+	switch service {
+	case "git-upload-pack":
+		return uploadPack(in, out, opts)
+	case "git-receive-pack":
+		return receivePack(in, out, opts)
+	}
+	return fmt.Errorf("unsupported service: %s", service)
+}
+
+// findServedRepository finds the repository at a path given to serve it,
+// which can omit the ".git" suffix, like git does. It returns the path
+// where it was found and its git directory, made absolute.
+func findServedRepository(path string) (string, string, error) {
+	dir, err := findGitDir(path)
+	if err != nil {
+		path += ".git"
+		if dir, err = findGitDir(path); err != nil {
+			return "", "", err
+		}
+	}
+	dir, err = filepath.Abs(dir)
+	return path, dir, err
+}
+
+// runServiceCommand runs the server side of a service (the upload-pack and
+// receive-pack commands) on a repository, over stdin and stdout. The
+// protocol version asked for is in GIT_PROTOCOL.
+func runServiceCommand(service, usage string) {
+	var opts serveOptions
+	var path string
+	for _, arg := range os.Args[2:] {
+		switch {
+		case arg == "--stateless-rpc":
+			opts.statelessRPC = true
+		case arg == "--advertise-refs":
+			opts.advertiseRefs = true
+		case strings.HasPrefix(arg, "-") || path != "":
+			printUsageAndExit(usage)
+		default:
+			path = arg
+		}
+	}
+	if path == "" {
+		printUsageAndExit(usage)
+	}
+	_, dir, err := findServedRepository(path)
+	if err != nil {
+		fatal("fatal: '%s' does not appear to be a git repository\n", path)
+	}
+	useRepository(dir)
+	opts.version = protocolVersion(os.Getenv("GIT_PROTOCOL"))
+	if err := serveService(service, os.Stdin, os.Stdout, opts); err != nil {
+		fatal("fatal: %s\n", err)
+	}
+}
+
+// protocolVersion returns the version asked for by a client, from
+// parameters like "version=2" separated by colons (GIT_PROTOCOL, the
+// Git-Protocol header).
+func protocolVersion(parameters string) int {
+	version := 0
+	for _, parameter := range strings.Split(parameters, ":") {
+		if value, ok := strings.CutPrefix(parameter, "version="); ok {
+			version, _ = strconv.Atoi(value)
+		}
+	}
+	return version
+}
+
+// sshTransport runs the service on the remote host with ssh (or the command
+// in GIT_SSH_COMMAND, core.sshCommand or GIT_SSH), speaking the protocol
+// over the standard input and output of the command. It's stateful: the
+// same connection is used for all the requests.
+type sshTransport struct {
+	user, host, port, path string
+	cmd                    *exec.Cmd
+	stdin                  io.WriteCloser
+	stdout                 io.Reader
+}
+
+func (t *sshTransport) stateless() bool {
+	return false
+}
+
+func (t *sshTransport) advertise(service string, version int) (io.Reader, error) {
+	program, args, name := sshCommand()
+	host := t.host
+	if t.user != "" {
+		host = t.user + "@" + host
+	}
+	variant := sshVariant(program, args, name, host)
+	// only OpenSSH can pass GIT_PROTOCOL, and the simple variant only gets
+	// the host and the command
+	if variant == "ssh" && version == 2 {
+		args = append(args, "-o", "SendEnv=GIT_PROTOCOL")
+	}
+	if variant == "tortoiseplink" {
+		args = append(args, "-batch")
+	}
+	if t.port != "" {
+		switch variant {
+		case "simple":
+			fatal("fatal: ssh variant 'simple' does not support setting port\n")
+		case "ssh":
+			args = append(args, "-p", t.port)
+		default:
+			args = append(args, "-P", t.port)
+		}
+	}
+	args = append(args, host, service+" "+shellQuote(t.path))
+
+	t.cmd = exec.Command(program, args...)
+	t.cmd.Env = os.Environ()
+	if version == 2 {
+		t.cmd.Env = append(t.cmd.Env, "GIT_PROTOCOL=version=2")
+	}
+	t.cmd.Stderr = os.Stderr
+	stdin, err := t.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := t.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	trace("run: %s %q", program, args)
+	if err := t.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to run %s: %w", program, err)
+	}
+	t.stdin, t.stdout = stdin, &remoteOutput{stdout}
+	return t.stdout, nil
+}
+
+func (t *sshTransport) request(service string, body []byte) (io.Reader, error) {
+	if _, err := t.stdin.Write(body); err != nil {
+		return nil, fmt.Errorf("unable to write to remote: %w", err)
+	}
+	return t.stdout, nil
+}
+
+// close ends the session with a flush, in case the service still waits
+// for a request, and waits for the command to exit.
+func (t *sshTransport) close() error {
+	if t.cmd == nil {
+		return nil
+	}
+	io.WriteString(t.stdin, "0000")
+	t.stdin.Close()
+	err := t.cmd.Wait()
+	t.cmd = nil
+	return err
+}
+
+// sshCommand returns the program to run for ssh with its first arguments,
+// and the name the ssh variant is guessed from. GIT_SSH_COMMAND and
+// core.sshCommand are run by the shell, with the arguments added.
+func sshCommand() (string, []string, string) {
+	command := os.Getenv("GIT_SSH_COMMAND")
+	if command == "" {
+		command, _ = getConfig("core.sshCommand")
+	}
+	if command != "" {
+		name := command
+		if fields := strings.Fields(command); len(fields) > 0 {
+			name = fields[0]
+		}
+		return "sh", []string{"-c", command + ` "$@"`, command}, name
+	}
+	if program := os.Getenv("GIT_SSH"); program != "" {
+		return program, nil, program
+	}
+	return "ssh", nil, "ssh"
+}
+
+// sshVariant tells which options the ssh command takes: GIT_SSH_VARIANT or
+// ssh.variant (any other value is OpenSSH), else it's guessed from the name of the command and, like git,
+// a command that isn't known is OpenSSH if it accepts "-G" (print the
+// configuration) and "simple" (no options) otherwise.
+func sshVariant(program string, args []string, name, host string) string {
+	variant := os.Getenv("GIT_SSH_VARIANT")
+	if variant == "" {
+		variant, _ = getConfig("ssh.variant")
+	}
+	switch variant {
+	case "simple", "plink", "putty", "tortoiseplink":
+		return variant
+	case "", "auto":
+	default:
+		return "ssh"
+	}
+
+	switch base := strings.ToLower(strings.TrimSuffix(filepath.Base(name), ".exe")); base {
+	case "ssh":
+		return "ssh"
+	case "plink", "tortoiseplink":
+		return base
+	}
+	probe := exec.Command(program, append(slices.Clone(args), "-G", host)...)
+	if err := probe.Run(); err != nil {
+		return "simple"
+	}
+	return "ssh"
+}
+
+// gitTransport talks to a git daemon over TCP (git://). The connection
+// starts with a request naming the service and the repository, then the
+// service speaks the protocol over it, like with ssh.
+// reference: https://git-scm.com/docs/pack-protocol#_git_transport
+type gitTransport struct {
+	host, path string
+	conn       net.Conn
+	output     io.Reader
+}
+
+const defaultDaemonPort = "9418"
+
+func (t *gitTransport) stateless() bool {
+	return false
+}
+
+func (t *gitTransport) advertise(service string, version int) (io.Reader, error) {
+	address := t.host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), defaultDaemonPort)
+	}
+	trace("connecting to %s", address)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", t.host, err)
+	}
+	t.conn, t.output = conn, &remoteOutput{conn}
+
+	// "<service> <path>\0host=<host>\0", then extra parameters after
+	// another NUL
+	request := fmt.Sprintf("%s %s\000host=%s\000", service, t.path, t.host)
+	if version == 2 {
+		request += "\000version=2\000"
+	}
+	if err := newPktWriter(conn).writePacket([]byte(request)); err != nil {
+		return nil, err
+	}
+	return t.output, nil
+}
+
+func (t *gitTransport) request(service string, body []byte) (io.Reader, error) {
+	if _, err := t.conn.Write(body); err != nil {
+		return nil, fmt.Errorf("unable to write to remote: %w", err)
+	}
+	return t.output, nil
+}
+
+// close ends the session with a flush, in case the service still waits
+// for a request.
+func (t *gitTransport) close() error {
+	if t.conn == nil {
+		return nil
+	}
+	io.WriteString(t.conn, "0000")
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// shellQuote quotes a string for the shell between single quotes.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// remoteOutput reads the output of a remote command. The protocol never
+// relies on the end of the output, so reaching it means the remote end
+// failed.
+type remoteOutput struct {
+	reader io.Reader
+}
+
+var errRemoteHungUp = errors.New("the remote end hung up unexpectedly")
+
+func (r *remoteOutput) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		err = errRemoteHungUp
+	}
+	return n, err
+}
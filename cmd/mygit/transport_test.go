@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSSHVariant(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	dir := filepath.Join(t.TempDir(), ".git")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	restore := useRepository(dir)
+	defer restore()
+
+	tests := []struct {
+		env, config string // GIT_SSH_VARIANT and ssh.variant
+		program     string // the probe ("<program> -G <host>") succeeds with true
+		name        string
+		want        string
+	}{
+		{"", "", "ssh", "ssh", "ssh"},
+		{"", "", "/usr/bin/ssh", "/usr/bin/ssh", "ssh"},
+		{"", "", "plink", "/opt/PLink.exe", "plink"},
+		{"", "", "tortoiseplink", "tortoiseplink", "tortoiseplink"},
+		{"", "", "true", "my-ssh", "ssh"},
+		{"", "", "false", "my-ssh", "simple"},
+		{"", "auto", "false", "my-ssh", "simple"},
+		{"", "auto", "false", "plink", "plink"},
+		{"", "putty", "false", "my-ssh", "putty"},
+		{"", "simple", "true", "ssh", "simple"},
+		{"", "unknown", "false", "my-ssh", "ssh"},
+		{"simple", "", "true", "ssh", "simple"},
+		{"plink", "simple", "true", "ssh", "plink"},
+		{"auto", "", "false", "my-ssh", "simple"},
+	}
+	for _, test := range tests {
+		t.Setenv("GIT_SSH_VARIANT", test.env)
+		config := ""
+		if test.config != "" {
+			config = "[ssh]\n\tvariant = " + test.config + "\n"
+		}
+		if err := os.WriteFile(filepath.Join(dir, "config"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := sshVariant(test.program, nil, test.name, "host"); got != test.want {
+			t.Errorf("sshVariant with GIT_SSH_VARIANT=%q, ssh.variant=%q, command %s (%s) = %s, want %s",
+				test.env, test.config, test.name, test.program, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// parseTree decodes the content of a tree object into its entries. Modes
+// are kept as stored (e.g. "40000" for directories).
+func parseTree(content []byte) ([]*treeEntry, error) {
+	entries := []*treeEntry{}
+	for len(content) > 0 {
+		space := bytes.IndexByte(content, ' ')
+		if space <= 0 {
+			return nil, fmt.Errorf("malformed mode in tree entry")
+		}
+		mode := string(content[:space])
+		if strings.Trim(mode, "01234567") != "" {
+			return nil, fmt.Errorf("malformed mode in tree entry")
+		}
+		content = content[space+1:]
+
+		null := bytes.IndexByte(content, 0)
+		if null < 0 || len(content) < null+1+20 {
+			return nil, fmt.Errorf("truncated tree entry")
+		}
+		name := string(content[:null])
+		hash := content[null+1 : null+1+20]
+		content = content[null+1+20:]
+
+		entries = append(entries, &treeEntry{name: name, mode: mode, hash: hash})
+	}
+	return entries, nil
+}
+
+// treeEntryType derives the type of the object an entry points to from its
+// mode, without having to read the object.
+func treeEntryType(mode string) string {
+	switch mode {
+	case "40000", "040000":
+		return "tree"
+	case "160000":
+		return "commit"
+	}
+	return "blob"
+}
+
+// compareTreeEntries orders entries the way git does: byte-wise by name,
+// but with directories compared as if their names ended in "/".
+func compareTreeEntries(a, b *treeEntry) int {
+	return cmp.Compare(treeSortKey(a), treeSortKey(b))
+}
+
+func treeSortKey(entry *treeEntry) string {
+	if treeEntryType(entry.mode) == "tree" {
+		return entry.name + "/"
+	}
+	return entry.name
+}
+
+// encodeTree sorts the entries in canonical order and serializes them into
+// the content of a tree object.
+func encodeTree(entries []*treeEntry) []byte {
+	slices.SortFunc(entries, compareTreeEntries)
+
+	content := []byte{}
+	for _, entry := range entries {
+		content = append(content, []byte(entry.mode)...)
+		content = append(content, ' ')
+		content = append(content, []byte(entry.name)...)
+		content = append(content, '\000')
+		content = append(content, entry.hash...)
+	}
+	return content
+}
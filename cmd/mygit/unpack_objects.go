@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// gitUnpackObjects reads a pack from stdin and writes its objects as loose
+// objects. Deltas can be based on objects already in the repository.
+func gitUnpackObjects() {
+	var dryRun, quiet, strict bool
+	for _, arg := range os.Args[2:] {
+		switch arg {
+		case "-n":
+			dryRun = true
+		case "-q":
+			quiet = true
+		case "--strict":
+			strict = true
+		default:
+			printUsageAndExit("unpack-objects [-n] [-q] [--strict] < <pack-file>")
+		}
+	}
+
+	showProgress := progressEnabled(quiet, false)
+	stream, spooled, err := spoolPackStream(os.Stdin, newProgress(showProgress, "Unpacking objects", 0))
+	if err != nil {
+		fatal("fatal: %s\n", err)
+	}
+	defer spooled.Close()
+	deltas := newProgress(showProgress && stream.deltaCount() > 0, "Resolving deltas", stream.deltaCount())
+
+	// with --strict, the objects referenced by the pack must exist too
+	links := map[string]objectLink{}
+	var linksMutex sync.Mutex
+	err = resolvePack(stream, spooled.File, packThreads(), loadObject, func(entry *packEntry, content []byte) error {
+		if strict {
+			linksMutex.Lock()
+			for _, link := range objectLinks(entry.objType, content) {
+				links[string(link.hash)] = link
+			}
+			linksMutex.Unlock()
+			for _, problem := range checkObject(entry.objType, content) {
+				fmt.Fprintf(os.Stderr, "%s: object %x: %s\n", problem.severity, entry.hash, problem)
+				if problem.severity == "error" {
+					return fmt.Errorf("fsck error in packed object")
+				}
+			}
+		}
+		if !dryRun {
+			hashObject(true, entry.objType, int64(len(content)), content)
+		}
+		if entry.isDelta() {
+			deltas.increment()
+		}
+		return nil
+	})
+	if err != nil {
+		fatal("fatal: %s\n", err)
+	}
+	deltas.done()
+
+	inPack := map[string]bool{}
+	for _, entry := range stream.entries {
+		inPack[string(entry.hash)] = true
+	}
+	for _, key := range sortedKeys(links) {
+		if link := links[key]; !inPack[key] && !hasObject(link.hash) {
+			fatal("fatal: missing %s %x\n", link.objType, link.hash)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Server side of git-upload-pack: the advertisement of the refs, the
+// negotiation of the commits the client already has and the pack with
+// everything else, in protocol versions 0 and 2. The repository served is
+// the current one (gitDir).
+// reference: https://git-scm.com/docs/pack-protocol#_packfile_negotiation
+// reference: https://git-scm.com/docs/protocol-v2#_fetch
+
+func gitUploadPack() {
+	runServiceCommand("git-upload-pack", "upload-pack [--stateless-rpc] [--advertise-refs] <directory>")
+}
+
+type serveOptions struct {
+	version       int  // protocol version asked for by the client
+	statelessRPC  bool // serve a single request, as for smart HTTP
+	advertiseRefs bool // only send the advertisement
+}
+
+// uploadRequest is what a client asked for: the objects it wants, minus
+// the ones reachable from the commits in common.
+type uploadRequest struct {
+	wants      [][]byte
+	common     [][]byte
+	ofsDelta   bool
+	includeTag bool
+	noProgress bool
+}
+
+// uploadPack serves git-upload-pack, reading the requests from in and
+// writing the responses to out.
+func uploadPack(in io.Reader, out io.Writer, opts serveOptions) error {
+	reader, writer := newPktReader(in), newPktWriter(out)
+	if opts.version == 2 {
+		return uploadPackV2(reader, writer, opts)
+	}
+
+	refs := advertisedRefs()
+	if opts.advertiseRefs || !opts.statelessRPC {
+		capabilities := []string{"multi_ack_detailed", "side-band", "side-band-64k", "thin-pack", "ofs-delta", "no-progress", "include-tag"}
+		if len(refs) > 0 && refs[0].name == "HEAD" && refs[0].symref != "" {
+			capabilities = append(capabilities, "symref=HEAD:"+refs[0].symref)
+		}
+		capabilities = append(capabilities, "agent="+agent)
+		if err := writeAdvertisement(writer, refs, capabilities); err != nil {
+			return err
+		}
+	}
+	if opts.advertiseRefs {
+		return nil
+	}
+
+	// wants, with the capabilities chosen by the client after the first one
+	request := &uploadRequest{}
+	var capabilities []string
+	for {
+		line, err := reader.readLine()
+		if err == io.EOF && len(request.wants) == 0 {
+			// the client only wanted the refs
+			return nil
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		value, ok := strings.CutPrefix(line, "want ")
+		if !ok {
+			return rejectRequest(writer, fmt.Errorf("protocol error: expected want, got %q", line))
+		}
+		value, rest, _ := strings.Cut(value, " ")
+		if len(request.wants) == 0 {
+			capabilities = strings.Fields(rest)
+		}
+		want, err := checkWant(value, refs)
+		if err != nil {
+			return rejectRequest(writer, err)
+		}
+		request.wants = append(request.wants, want)
+	}
+	request.ofsDelta = slices.Contains(capabilities, "ofs-delta")
+	request.includeTag = slices.Contains(capabilities, "include-tag")
+	request.noProgress = slices.Contains(capabilities, "no-progress")
+	multiAck := slices.Contains(capabilities, "multi_ack_detailed")
+
+	// haves until the client is done, in rounds ended by a flush. Without
+	// multi_ack_detailed, only the first common commit is acknowledged.
+	var lastCommon string
+	var gotCommon, gotOther bool
+	for {
+		line, err := reader.readLine()
+		switch {
+		case err == io.EOF:
+			if multiAck && gotCommon && !gotOther && request.okToGiveUp() {
+				writer.writeLine("ACK %s ready", lastCommon)
+			}
+			if len(request.common) == 0 || multiAck {
+				writer.writeLine("NAK")
+			}
+			if opts.statelessRPC {
+				return nil
+			}
+			gotCommon, gotOther = false, false
+		case err != nil:
+			return err
+		case strings.HasPrefix(line, "have "):
+			value := strings.TrimPrefix(line, "have ")
+			hash, err := hex.DecodeString(value)
+			if err != nil || len(hash) != 20 {
+				return rejectRequest(writer, fmt.Errorf("protocol error: invalid have %q", value))
+			}
+			if !hasObject(hash) {
+				gotOther = true
+				if multiAck && request.okToGiveUp() {
+					writer.writeLine("ACK %s ready", value)
+				}
+				continue
+			}
+			gotCommon, lastCommon = true, value
+			request.common = append(request.common, hash)
+			if multiAck {
+				writer.writeLine("ACK %s common", value)
+			} else if len(request.common) == 1 {
+				writer.writeLine("ACK %s", value)
+			}
+		case line == "done":
+			if len(request.common) == 0 {
+				writer.writeLine("NAK")
+			} else if multiAck {
+				writer.writeLine("ACK %s", lastCommon)
+			}
+			maxBand := 0
+			if slices.Contains(capabilities, "side-band-64k") {
+				maxBand = pktMaxData - 1
+			} else if slices.Contains(capabilities, "side-band") {
+				maxBand = 999
+			}
+			return writeUploadPack(writer, out, request, maxBand)
+		default:
+			return rejectRequest(writer, fmt.Errorf("protocol error: expected have or done, got %q", line))
+		}
+	}
+}
+
+func uploadPackV2(reader *pktReader, writer *pktWriter, opts serveOptions) error {
+	if opts.advertiseRefs || !opts.statelessRPC {
+		writer.writeLine("version 2")
+		writer.writeLine("agent=%s", agent)
+		writer.writeLine("ls-refs=unborn")
+		writer.writeLine("fetch=")
+		if err := writer.flush(); err != nil {
+			return err
+		}
+	}
+	if opts.advertiseRefs {
+		return nil
+	}
+
+	// "command=<name>" and capabilities, then the arguments after a
+	// delimiter, until a flush. The connection is closed when done.
+	for {
+		lines, end, err := reader.readSection()
+		if err == io.EOF || err == nil && len(lines) == 0 && end == pktFlush {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		command := ""
+		for _, line := range lines {
+			if value, ok := strings.CutPrefix(line, "command="); ok {
+				command = value
+			}
+		}
+		args := []string{}
+		if end == pktDelim {
+			if args, _, err = reader.readSection(); err != nil {
+				return err
+			}
+		}
+
+		switch command {
+		case "ls-refs":
+			err = lsRefsV2(writer, args)
+		case "fetch":
+			err = fetchV2(writer, args)
+		default:
+			err = rejectRequest(writer, fmt.Errorf("unknown command '%s'", command))
+		}
+		if err != nil || opts.statelessRPC {
+			return err
+		}
+	}
+}
+
+func lsRefsV2(writer *pktWriter, args []string) error {
+	var symrefs, peel, unborn bool
+	prefixes := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case arg == "unborn":
+			unborn = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		}
+	}
+
+	for _, ref := range advertisedRefs() {
+		if len(prefixes) > 0 && !slices.ContainsFunc(prefixes, func(prefix string) bool { return strings.HasPrefix(ref.name, prefix) }) {
+			continue
+		}
+		hash := ref.hash
+		if hash == "" {
+			if !unborn {
+				continue
+			}
+			hash = "unborn"
+		}
+		line := hash + " " + ref.name
+		if symrefs && ref.symref != "" {
+			line += " symref-target:" + ref.symref
+		}
+		if peel && ref.peeled != "" {
+			line += " peeled:" + ref.peeled
+		}
+		writer.writeLine("%s", line)
+	}
+	return writer.flush()
+}
+
+func fetchV2(writer *pktWriter, args []string) error {
+	refs := advertisedRefs()
+	request := &uploadRequest{}
+	done := false
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "want "):
+			want, err := checkWant(strings.TrimPrefix(arg, "want "), refs)
+			if err != nil {
+				return rejectRequest(writer, err)
+			}
+			request.wants = append(request.wants, want)
+		case strings.HasPrefix(arg, "have "):
+			if hash, err := hex.DecodeString(strings.TrimPrefix(arg, "have ")); err == nil && len(hash) == 20 && hasObject(hash) {
+				request.common = append(request.common, hash)
+			}
+		case arg == "done":
+			done = true
+		case arg == "ofs-delta":
+			request.ofsDelta = true
+		case arg == "include-tag":
+			request.includeTag = true
+		case arg == "no-progress":
+			request.noProgress = true
+		case arg == "thin-pack":
+		default:
+			return rejectRequest(writer, fmt.Errorf("unexpected line: '%s'", arg))
+		}
+	}
+
+	// without "done", the acknowledgments tell which haves are common and
+	// the pack only follows once that's enough
+	if !done {
+		writer.writeLine("acknowledgments")
+		if len(request.common) == 0 {
+			writer.writeLine("NAK")
+		}
+		for _, hash := range request.common {
+			writer.writeLine("ACK %x", hash)
+		}
+		if !request.okToGiveUp() {
+			return writer.flush()
+		}
+		writer.writeLine("ready")
+		writer.delim()
+	}
+	writer.writeLine("packfile")
+	return writeUploadPack(writer, nil, request, pktMaxData-1)
+}
+
+// okToGiveUp checks if the commits in common are enough to send a small
+// pack: each wanted commit must have one of them as an ancestor.
+func (request *uploadRequest) okToGiveUp() bool {
+	if len(request.common) == 0 {
+		return false
+	}
+	for _, want := range request.wants {
+		if !slices.ContainsFunc(request.common, func(have []byte) bool { return isAncestor(have, want) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeUploadPack sends the pack for a request, multiplexed in packets of
+// up to maxBand bytes with progress messages, or directly to out when
+// maxBand is 0.
+func writeUploadPack(writer *pktWriter, out io.Writer, request *uploadRequest, maxBand int) error {
+	objects := collectObjects(request.wants, request.common)
+	if request.includeTag {
+		objects = append(objects, includedTags(objects)...)
+	}
+
+	progress := io.Discard
+	if maxBand > 0 {
+		out = newSidebandWriter(writer, sidebandData, maxBand)
+		if !request.noProgress {
+			progress = newSidebandWriter(writer, sidebandProgress, maxBand)
+		}
+	}
+	fmt.Fprintf(progress, "Enumerating objects: %d, done.\n", len(objects))
+
+	buffer := bufio.NewWriterSize(out, pktMaxData)
+	opts := defaultPackOptions
+	opts.ofsDelta = request.ofsDelta
+	opts.quiet = true
+	if _, err := writePack(buffer, objects, opts); err != nil {
+		return err
+	}
+	if err := buffer.Flush(); err != nil {
+		return err
+	}
+	if maxBand > 0 {
+		return writer.flush()
+	}
+	return nil
+}
+
+// includedTags returns the annotated tags pointing to objects of the pack
+// that are not in it yet (include-tag).
+func includedTags(objects []*packObject) []*packObject {
+	inPack := map[string]bool{}
+	for _, object := range objects {
+		inPack[string(object.hash)] = true
+	}
+	tags := []*packObject{}
+	refs := listRefs()
+	for _, name := range sortedKeys(refs) {
+		hash, err := hex.DecodeString(refs[name])
+		if !strings.HasPrefix(name, "refs/tags/") || err != nil || inPack[string(hash)] {
+			continue
+		}
+		objType, content, err := loadObject(hash)
+		if err != nil || objType != "tag" {
+			continue
+		}
+		if links := objectLinks(objType, content); len(links) > 0 && inPack[string(links[0].hash)] {
+			tags = append(tags, &packObject{hash: hash, objType: objType, content: content})
+			inPack[string(hash)] = true
+		}
+	}
+	return tags
+}
+
+// advertisedRefs lists the refs of the repository for clients: HEAD (with
+// an empty hash when its branch is unborn) and all the refs, with the
+// objects annotated tags point to.
+func advertisedRefs() []remoteRef {
+	refs := []remoteRef{}
+	if head := (remoteRef{name: "HEAD", hash: readRef("HEAD"), symref: readSymbolicRef("HEAD")}); head.hash != "" || head.symref != "" {
+		refs = append(refs, head)
+	}
+	all := listRefs()
+	for _, name := range sortedKeys(all) {
+		ref := remoteRef{name: name, hash: all[name]}
+		if hash, err := hex.DecodeString(ref.hash); err == nil {
+			if objType, _, err := loadObject(hash); err == nil && objType == "tag" {
+				ref.peeled = hex.EncodeToString(peelObject(hash, ""))
+			}
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// writeAdvertisement writes the refs in the version 0 format, with the
+// capabilities after the first one (or after a fake ref when there are
+// none).
+func writeAdvertisement(writer *pktWriter, refs []remoteRef, capabilities []string) error {
+	first := true
+	for _, ref := range refs {
+		if ref.hash == "" {
+			continue
+		}
+		if first {
+			writer.writeLine("%s %s\000%s", ref.hash, ref.name, strings.Join(capabilities, " "))
+			first = false
+		} else {
+			writer.writeLine("%s %s", ref.hash, ref.name)
+		}
+		if ref.peeled != "" {
+			writer.writeLine("%s %s^{}", ref.peeled, ref.name)
+		}
+	}
+	if first {
+		writer.writeLine("%s capabilities^{}\000%s", zeroHash, strings.Join(capabilities, " "))
+	}
+	return writer.flush()
+}
+
+// checkWant makes sure that a wanted object is one of the advertised refs.
+func checkWant(value string, refs []remoteRef) ([]byte, error) {
+	hash, err := hex.DecodeString(value)
+	if err != nil || len(hash) != 20 {
+		return nil, fmt.Errorf("protocol error: invalid want %q", value)
+	}
+	for _, ref := range refs {
+		if ref.hash == value || ref.peeled == value {
+			return hash, nil
+		}
+	}
+	return nil, fmt.Errorf("upload-pack: not our ref %s", value)
+}
+
+// rejectRequest tells the client why its request failed, and returns the
+// error.
+func rejectRequest(writer *pktWriter, err error) error {
+	writer.writeLine("ERR %s", err)
+	return err
+}
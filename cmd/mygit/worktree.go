@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Moving the working tree from one commit to another (e.g. after a merge),
+// only touching the files that differ between them. As there's no index
+// for most commands yet, local changes are found by comparing the files
+// with the tree of the current commit.
+
+// worktreeMatches checks if the working tree file at a path is the one of
+// the entry (nil meaning no file).
+func worktreeMatches(name string, entry *treeEntry) bool {
+	info, err := os.Lstat(filepath.FromSlash(name))
+	if err != nil {
+		return entry == nil
+	}
+	if entry == nil {
+		return false
+	}
+	switch entry.mode {
+	case "120000":
+		target, err := os.Readlink(filepath.FromSlash(name))
+		if err != nil {
+			return false
+		}
+		return bytes.Equal(hashObject(false, "blob", int64(len(target)), []byte(target)), entry.hash)
+	case "160000":
+		return info.IsDir()
+	}
+	if !info.Mode().IsRegular() || (info.Mode()&0111 != 0) != (entry.mode == "100755") {
+		return false
+	}
+	return bytes.Equal(hashFile(false, name), entry.hash)
+}
+
+// checkWorktree makes sure that moving the working tree from one list of
+// files to another won't lose local changes: the files to update must be
+// unchanged and no untracked file can be in the way.
+func checkWorktree(from, to map[string]*treeEntry, operation string) error {
+	changed, untracked := []string{}, []string{}
+	for _, name := range sortedKeys(changedFiles(from, to)) {
+		if worktreeMatches(name, from[name]) || worktreeMatches(name, to[name]) {
+			continue
+		}
+		if from[name] == nil {
+			untracked = append(untracked, name)
+		} else {
+			changed = append(changed, name)
+		}
+	}
+
+	var message strings.Builder
+	if len(changed) > 0 {
+		fmt.Fprintf(&message, "Your local changes to the following files would be overwritten by %s:\n\t%s\n"+
+			"Please commit your changes or stash them before you %s.\n", operation, strings.Join(changed, "\n\t"), operation)
+	}
+	if len(untracked) > 0 {
+		fmt.Fprintf(&message, "The following untracked working tree files would be overwritten by %s:\n\t%s\n"+
+			"Please move or remove them before you %s.\n", operation, strings.Join(untracked, "\n\t"), operation)
+	}
+	if message.Len() > 0 {
+		return errors.New(message.String() + "Aborting")
+	}
+	return nil
+}
+
+// worktreeClean checks that all the files of the current commit are
+// unchanged in the working tree.
+func worktreeClean(files map[string]*treeEntry) bool {
+	for name, entry := range files {
+		if !worktreeMatches(name, entry) {
+			return false
+		}
+	}
+	return true
+}
+
+// changedFiles returns the paths whose entries differ between two lists of
+// files.
+func changedFiles(from, to map[string]*treeEntry) map[string]bool {
+	changed := map[string]bool{}
+	for name, entry := range from {
+		if !sameTreeEntry(entry, to[name]) {
+			changed[name] = true
+		}
+	}
+	for name, entry := range to {
+		if !sameTreeEntry(from[name], entry) {
+			changed[name] = true
+		}
+	}
+	return changed
+}
+
+// updateWorktree writes the files that changed between two lists of files
+// and removes the ones that are gone, along with directories left empty.
+// The index, if there's one, is rewritten to match.
+func updateWorktree(from, to map[string]*treeEntry) {
+	changed := sortedKeys(changedFiles(from, to))
+	for _, name := range changed {
+		if from[name] != nil && to[name] == nil {
+			path := filepath.FromSlash(name)
+			if err := os.RemoveAll(path); err != nil {
+				fatal("error: unable to unlink '%s': %s\n", name, err)
+			}
+			for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+				if os.Remove(dir) != nil {
+					break
+				}
+			}
+		}
+	}
+	for _, name := range changed {
+		if entry := to[name]; entry != nil && !worktreeMatches(name, entry) {
+			writeWorktreeFile(name, entry)
+		}
+	}
+
+	if fileExists(filepath.Join(gitDir, "index")) {
+		writeIndex(to)
+	}
+}
+
+// writeWorktreeFile checks out a file, replacing whatever is at its path.
+func writeWorktreeFile(name string, entry *treeEntry) {
+	trace("file: %s", name)
+	path := filepath.FromSlash(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fatal(err.Error())
+	}
+	if info, err := os.Lstat(path); err == nil && (info.IsDir() || entry.mode == "120000") {
+		os.RemoveAll(path)
+	}
+
+	switch entry.mode {
+	case "160000":
+		// submodules are not cloned, there's only their directory
+		if err := os.MkdirAll(path, 0755); err != nil {
+			fatal(err.Error())
+		}
+		return
+	case "120000":
+		_, _, target := readObject(entry.hash)
+		if err := os.Symlink(string(target), path); err != nil {
+			fatal(err.Error())
+		}
+		return
+	}
+
+	_, _, content := readObject(entry.hash)
+	perm := os.FileMode(0644)
+	if entry.mode == "100755" {
+		perm = 0755
+	}
+	if err := os.WriteFile(path, content, perm); err != nil {
+		fatal(err.Error())
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		fatal(err.Error())
+	}
+}